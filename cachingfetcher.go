@@ -0,0 +1,146 @@
+package jujusvg
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+)
+
+// CachingFetcher is an IconFetcher which keeps the icons retrieved by
+// another fetcher in a directory on disk, so that icons fetched once,
+// for instance by an HTTPFetcher, need not be fetched again, even by
+// other processes sharing the directory. Only the icons of charms with
+// revisions are cached, as the icons of charms without them may change,
+// and substitute icons are not cached, so that they are fetched again.
+// Failing to read or write the cache does not fail the fetch: icons
+// which cannot be read are fetched again, and those which cannot be
+// written are still returned.
+type CachingFetcher struct {
+	// Dir holds the directory in which icons are kept. It is
+	// created if it does not exist.
+	Dir string
+
+	// Fetcher holds the fetcher used to retrieve icons which are
+	// not in the cache.
+	Fetcher IconFetcher
+}
+
+// FetchIcons implements IconFetcher.FetchIcons.
+func (f *CachingFetcher) FetchIcons(b *charm.BundleData) (map[string][]byte, error) {
+	icons, err := f.FetchTypedIcons(b)
+	if err != nil {
+		return nil, err
+	}
+	return iconData(icons), nil
+}
+
+// FetchTypedIcons implements TypedIconFetcher.FetchTypedIcons.
+func (f *CachingFetcher) FetchTypedIcons(b *charm.BundleData) (map[string]Icon, error) {
+	return f.FetchTypedIconsContext(context.Background(), b)
+}
+
+// FetchTypedIconsContext implements
+// ContextIconFetcher.FetchTypedIconsContext.
+func (f *CachingFetcher) FetchTypedIconsContext(ctx context.Context, b *charm.BundleData) (map[string]Icon, error) {
+	if f.Fetcher == nil {
+		return nil, errgo.New("no fetcher specified")
+	}
+	charmIds, err := UniqueCharms(b)
+	if err != nil {
+		return nil, err
+	}
+	icons := make(map[string]Icon)
+	for _, charmId := range charmIds {
+		if icon, ok := f.read(charmId); ok {
+			icons[charmId.Path()] = icon
+		}
+	}
+	remaining, err := withoutIcons(b, icons)
+	if err != nil {
+		return nil, err
+	}
+	if len(remaining.Services) == 0 {
+		return icons, nil
+	}
+	fetched, err := fetchIcons(ctx, f.Fetcher, remaining)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	for _, charmId := range charmIds {
+		icon, ok := fetched[charmId.Path()]
+		if !ok {
+			continue
+		}
+		icons[charmId.Path()] = icon
+		f.write(charmId, icon)
+	}
+	return icons, nil
+}
+
+// cachePath returns the path of the file holding the icon of the given
+// charm, or the empty string if its icon is not cached.
+func (f *CachingFetcher) cachePath(charmId *charm.URL) string {
+	if charmId.Revision < 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(charmId.Path()))
+	return filepath.Join(f.Dir, hex.EncodeToString(sum[:]))
+}
+
+// read returns the cached icon of the given charm, if there is one. The
+// file holding the icon starts with a line giving its content type.
+func (f *CachingFetcher) read(charmId *charm.URL) (Icon, bool) {
+	path := f.cachePath(charmId)
+	if path == "" {
+		return Icon{}, false
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Icon{}, false
+	}
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return Icon{}, false
+	}
+	return Icon{
+		ContentType: string(data[:i]),
+		Data:        data[i+1:],
+	}, true
+}
+
+// write caches the icon of the given charm. The file is written in full
+// before it is put in place, so that readers never see part of an icon.
+// Empty and substitute icons are not cached.
+func (f *CachingFetcher) write(charmId *charm.URL, icon Icon) {
+	path := f.cachePath(charmId)
+	if path == "" || len(icon.Data) == 0 || icon.Substitute {
+		return
+	}
+	if err := os.MkdirAll(f.Dir, 0755); err != nil {
+		return
+	}
+	tmp, err := ioutil.TempFile(f.Dir, ".icon-")
+	if err != nil {
+		return
+	}
+	_, err = tmp.WriteString(icon.ContentType + "\n")
+	if err == nil {
+		_, err = tmp.Write(icon.Data)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+}
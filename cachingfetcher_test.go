@@ -0,0 +1,212 @@
+package jujusvg
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+)
+
+type CachingFetcherSuite struct{}
+
+var _ = gc.Suite(&CachingFetcherSuite{})
+
+// recordingTypedFetcher is a TypedIconFetcher which returns the icons it
+// holds, recording the services of each bundle it is asked about.
+type recordingTypedFetcher struct {
+	icons map[string]Icon
+	calls [][]string
+	err   error
+}
+
+func (f *recordingTypedFetcher) FetchIcons(*charm.BundleData) (map[string][]byte, error) {
+	return nil, errgo.New("unexpected call to FetchIcons")
+}
+
+func (f *recordingTypedFetcher) FetchTypedIcons(b *charm.BundleData) (map[string]Icon, error) {
+	var names []string
+	for name := range b.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	f.calls = append(f.calls, names)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return f.icons, nil
+}
+
+func (s *CachingFetcherSuite) TestFetchTypedIcons(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	icons := map[string]Icon{
+		"precise/mongodb-21": {
+			ContentType: "image/png",
+			Data:        []byte("mongodb\nicon"),
+		},
+		"~charming-devs/precise/elasticsearch-2": {
+			ContentType: svgContentType,
+			Data:        []byte("<svg>elasticsearch</svg>"),
+		},
+	}
+	dir := filepath.Join(c.MkDir(), "icons")
+	fetcher := &recordingTypedFetcher{
+		icons: icons,
+	}
+	cache := &CachingFetcher{
+		Dir:     dir,
+		Fetcher: fetcher,
+	}
+	fetched, err := cache.FetchTypedIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fetched, gc.DeepEquals, icons)
+	c.Assert(fetcher.calls, gc.DeepEquals, [][]string{
+		{"charmworld", "elasticsearch", "mongodb"},
+	})
+
+	// Only the charm without an icon is fetched again.
+	fetched, err = cache.FetchTypedIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fetched, gc.DeepEquals, icons)
+	c.Assert(fetcher.calls[1:], gc.DeepEquals, [][]string{
+		{"charmworld"},
+	})
+
+	// Another fetcher sharing the directory uses the cache too.
+	other := &recordingTypedFetcher{}
+	data, err := (&CachingFetcher{
+		Dir:     dir,
+		Fetcher: other,
+	}).FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(data, gc.DeepEquals, map[string][]byte{
+		"precise/mongodb-21":                     []byte("mongodb\nicon"),
+		"~charming-devs/precise/elasticsearch-2": []byte("<svg>elasticsearch</svg>"),
+	})
+	c.Assert(other.calls, gc.DeepEquals, [][]string{
+		{"charmworld"},
+	})
+
+	// Only complete icons are left in the directory.
+	entries, err := ioutil.ReadDir(dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.HasLen, 2)
+	for _, entry := range entries {
+		c.Assert(strings.HasPrefix(entry.Name(), "."), gc.Equals, false)
+	}
+}
+
+func (s *CachingFetcherSuite) TestUnrevisionedCharms(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(`
+services:
+  mongodb:
+    charm: "cs:precise/mongodb"
+    num_units: 1
+`))
+	c.Assert(err, gc.IsNil)
+	dir := c.MkDir()
+	fetcher := &recordingTypedFetcher{
+		icons: map[string]Icon{
+			"precise/mongodb": {
+				ContentType: svgContentType,
+				Data:        []byte("<svg/>"),
+			},
+		},
+	}
+	cache := &CachingFetcher{
+		Dir:     dir,
+		Fetcher: fetcher,
+	}
+	for i := 0; i < 2; i++ {
+		_, err := cache.FetchTypedIcons(b)
+		c.Assert(err, gc.IsNil)
+	}
+	// The icon may change, so it is fetched each time.
+	c.Assert(fetcher.calls, gc.HasLen, 2)
+	entries, err := ioutil.ReadDir(dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.HasLen, 0)
+}
+
+func (s *CachingFetcherSuite) TestErrors(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	_, err = new(CachingFetcher).FetchTypedIcons(b)
+	c.Assert(err, gc.ErrorMatches, "no fetcher specified")
+
+	cache := &CachingFetcher{
+		Dir: c.MkDir(),
+		Fetcher: &recordingTypedFetcher{
+			err: errgo.New("bad-wolf"),
+		},
+	}
+	_, err = cache.FetchTypedIcons(b)
+	c.Assert(err, gc.ErrorMatches, "bad-wolf")
+
+	// Icons are still returned when the cache cannot be written.
+	file := filepath.Join(c.MkDir(), "file")
+	err = ioutil.WriteFile(file, nil, 0644)
+	c.Assert(err, gc.IsNil)
+	cache = &CachingFetcher{
+		Dir: file,
+		Fetcher: &recordingTypedFetcher{
+			icons: map[string]Icon{
+				"precise/mongodb-21": {
+					ContentType: svgContentType,
+					Data:        []byte("<svg/>"),
+				},
+			},
+		},
+	}
+	icons, err := cache.FetchTypedIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.HasLen, 1)
+}
+
+func (s *CachingFetcherSuite) TestFallbackNotCached(c *gc.C) {
+	var mu sync.Mutex
+	fail := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			http.Error(w, "bad-wolf", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "<svg>icon</svg>")
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	cache := &CachingFetcher{
+		Dir: c.MkDir(),
+		Fetcher: &HTTPFetcher{
+			IconURL: func(ref *charm.URL) string {
+				return ts.URL + "/" + ref.Path()
+			},
+			Fallback: []byte("<svg>fallback</svg>"),
+		},
+	}
+	icons, err := cache.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons["precise/mongodb-21"], gc.DeepEquals, []byte("<svg>fallback</svg>"))
+
+	// The fallback icons were not cached, so the real icons are
+	// fetched once the server recovers.
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	icons, err = cache.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons["precise/mongodb-21"], gc.DeepEquals, []byte("<svg>icon</svg>"))
+}
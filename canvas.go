@@ -2,12 +2,22 @@ package jujusvg
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"image"
 	"io"
 	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
 
 	svg "github.com/ajstarks/svgo"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
 
 	"gopkg.in/juju/jujusvg.v1/assets"
 )
@@ -17,21 +27,276 @@ const (
 	serviceBlockSize   = 189
 	healthCircleRadius = 10
 	relationLineWidth  = 2
+	tintOpacity        = 0.5
+	shadowOpacity      = 0.3
+	dimmedOpacity      = 0.2
+	storageBadgeWidth  = 24
+	storageBadgeHeight = 20
+	storageBadgeOffset = 24
+	seriesBannerHeight = 30
+	seriesBadgeWidth   = 64
+	seriesBadgeHeight  = 18
+	seriesBadgeOffset  = 12
+	shapeSize          = 128
+	minCaptionFontSize = 12
+	labelFontSize      = serviceBlockSize / 10
+	labelGap           = 6
+	modelFontSize      = 12
+	modelLineHeight    = modelFontSize + 2
+	noteFontSize       = 12
+	charmLegendMargin  = 20
+	charmLegendIcon    = 32
+	charmLegendRow     = charmLegendIcon + 8
+	charmLegendFont    = 14
+	notePadding        = 4
+	noteGap            = 4
+	maxLabelLength     = 18
 	maxInt             = int(^uint(0) >> 1)
 	minInt             = -(maxInt - 1)
 	maxHeight          = 450
 	maxWidth           = 1000
 
-	fontColor     = "#505050"
-	relationColor = "#38B44A"
+	fontColor         = "#505050"
+	relationColor     = "#38B44A"
+	storageBadgeColor = "#6F6F6F"
+	seriesColor       = "#DD4814"
+	shapeColor        = "#E5E5E5"
+	offerColor        = "#888888"
+	modelColor        = "#888888"
+	noteColor         = "#FFFFFF"
+	offerRelationDash = "8,4"
+	miniMapColor      = "#DD4814"
+
+	// miniMapSize holds the length of the longer side of the
+	// mini-map, and miniMapMargin its distance from the edges of
+	// the image.
+	miniMapSize   = 200
+	miniMapMargin = 10
 )
 
-// Canvas holds the parsed form of a bundle or environment.
+// Canvas holds the parsed form of a bundle or environment. It is safe to
+// call Marshal on a Canvas from multiple goroutines at once.
 type Canvas struct {
+	// mu serializes calls to Marshal, which lays out the
+	// services and records icon ids in the canvas.
+	mu sync.Mutex
+
 	services      []*service
 	relations     []*serviceRelation
-	iconsRendered map[string]bool
+	iconsRendered map[string]string
 	iconIds       map[string]string
+
+	// ctx holds the context of the current call to Marshal, which
+	// stops drawing once it is done.
+	ctx context.Context
+
+	// iconTint, if set, returns the color used to tint the
+	// icon of the named service.
+	iconTint func(string) string
+
+	// interfaceColor, if set, returns the color of relations
+	// with the given interface name.
+	interfaceColor func(string) string
+
+	// compactIcons holds whether insignificant whitespace is
+	// removed from icons before they are embedded.
+	compactIcons bool
+
+	// iconError, if set, is called with the path of each charm
+	// whose icon cannot be embedded and the reason why.
+	iconError func(string, error)
+
+	// placeholderIcon, if set, returns the placeholder embedded
+	// for charms with the given name whose icons are missing or
+	// cannot be embedded.
+	placeholderIcon func(charmName string) []byte
+
+	// duplicateRelation, if set, is called with the endpoints of
+	// each relation which duplicates an earlier one in the bundle.
+	duplicateRelation func([]string)
+
+	// requireIcons holds whether creating the canvas fails if
+	// any service has no icon.
+	requireIcons bool
+
+	// iconMode holds how icons are included when no fetcher
+	// is specified.
+	iconMode IconMode
+
+	// iconURL and iconFetcher hold the icon URL function and
+	// fetcher used by Render.
+	iconURL     func(*charm.URL) string
+	iconFetcher IconFetcher
+
+	// storageBadgeColor holds the color of the badge drawn on
+	// services which declare storage. If it is empty, no
+	// badges are drawn.
+	storageBadgeColor string
+
+	// namespaces holds the namespace declarations to add to or
+	// override on the root element, keyed by prefix. An empty
+	// URI removes the declaration.
+	namespaces map[string]string
+
+	// textRendering and shapeRendering, if set, hold the values
+	// of the text-rendering and shape-rendering properties set on
+	// the root element.
+	textRendering  string
+	shapeRendering string
+
+	// series holds the default series of the bundle. If
+	// seriesColor is not empty, the series is shown in a banner
+	// drawn in that color. If seriesBadgeColor is not empty,
+	// services using another series are marked with a badge
+	// drawn in that color.
+	series           string
+	seriesColor      string
+	seriesBadgeColor string
+
+	// origin holds where the origin of the coordinate system
+	// lies within the diagram.
+	origin Origin
+
+	// serviceAttrs, if set, returns extra attributes for the
+	// given service.
+	serviceAttrs func(string, *charm.ServiceSpec) map[string]string
+
+	// labelPosition holds where the names of services are
+	// shown.
+	labelPosition LabelPosition
+
+	// maxLabelLength holds the number of characters of the names
+	// of services shown in their labels. If it is zero,
+	// maxLabelLength, which fits across a service block, is used;
+	// if it is negative, names are shown in full.
+	maxLabelLength int
+
+	// topologyOnly holds whether service positions and icons
+	// are ignored, showing only how services are related.
+	topologyOnly bool
+
+	// round, if set, converts the coordinates of services in
+	// bundle annotations to pixels.
+	round func(float64) int
+
+	// formatLength, if set, formats fractional lengths written
+	// to the SVG.
+	formatLength func(float64) string
+
+	// shape, if set, returns the shape drawn behind the icon of
+	// services with the given charm.
+	shape func(*charm.URL) Shape
+
+	// interfaceDash, if set, returns the dash pattern of
+	// relations with the given interface name.
+	interfaceDash func(string) string
+
+	// perimeterRelations holds whether relations are attached
+	// around the perimeters of services.
+	perimeterRelations bool
+
+	// relationsInFront holds whether relations are drawn over
+	// services rather than behind them.
+	relationsInFront bool
+
+	// caption holds text shown alongside the diagram, and
+	// captionPosition where it is shown.
+	caption         string
+	captionPosition CaptionPosition
+
+	// clip holds the region of the diagram to render. If it is
+	// empty, the whole diagram is rendered.
+	clip image.Rectangle
+
+	// description and tags hold the description and tags of
+	// the bundle, which are shown above the diagram if
+	// showDescription is set.
+	description     string
+	tags            []string
+	showDescription bool
+
+	// aspectRatio, if not zero, holds the ratio of the width to
+	// the height of the image, which is padded to match it.
+	aspectRatio image.Point
+
+	// minUnitScale and maxUnitScale, if maxUnitScale is not zero,
+	// hold the bounds of the scale at which services are drawn
+	// according to their number of units.
+	minUnitScale float64
+	maxUnitScale float64
+
+	// readableIds holds whether the ids of icons are derived
+	// from the paths of their charms rather than numbered.
+	readableIds bool
+
+	// crossModel holds whether relations to applications offered
+	// by other models are shown.
+	crossModel bool
+
+	// serviceList holds whether a list of the services is shown
+	// below the diagram.
+	serviceList bool
+
+	// charmLegend holds whether a panel showing the icon and name
+	// of each charm is shown beside the diagram.
+	charmLegend bool
+
+	// padding holds the empty space left around the diagram.
+	padding padding
+
+	// showConstraints holds whether the constraints of services
+	// are shown when hovering over them.
+	showConstraints bool
+
+	// serviceModel, if set, returns the name of the model to
+	// which the named service belongs.
+	serviceModel func(serviceName string) string
+
+	// iconShadow, if set, describes the drop shadow drawn
+	// beneath service icons.
+	iconShadow *IconShadow
+
+	// relationWeight, if set, returns the weight of the relation
+	// between the given endpoints, which is drawn with a width
+	// between minRelationWidth and maxRelationWidth according to
+	// weightScale.
+	relationWeight   func(endpoints []string) (float64, bool)
+	minRelationWidth float64
+	maxRelationWidth float64
+	weightScale      WeightScale
+
+	// relationNote, if set, returns the note shown beside the
+	// relation between the given endpoints.
+	relationNote func(endpoints []string) string
+
+	// relationPriority, if set, returns the priority of relations
+	// with the given interface. Relations with higher priorities
+	// are drawn over those with lower ones.
+	relationPriority func(interfaceName string) int
+
+	// relationGradients holds whether relations are drawn with
+	// gradients blending the colors of their services.
+	relationGradients bool
+
+	// selfRelations holds whether relations between a service
+	// and itself are shown.
+	selfRelations bool
+
+	// focus holds the name of the service which, along with its
+	// relations and related services, is shown at full opacity.
+	focus string
+
+	// diffLegend holds whether a legend explaining the colors
+	// used to highlight differences is shown below the diagram.
+	diffLegend bool
+
+	// colorBlindSafe holds whether differences are highlighted
+	// with colors from ColorBlindPalette and dash patterns.
+	colorBlindSafe bool
+
+	// miniMap holds whether an overview of the whole diagram is
+	// drawn in the corner of the image.
+	miniMap bool
 }
 
 // service represents a service deployed to an environment and contains the
@@ -39,15 +304,101 @@ type Canvas struct {
 type service struct {
 	name      string
 	charmPath string
+	// charmName holds the name of the service's charm.
+	charmName string
 	iconUrl   string
 	iconSrc   []byte
 	point     image.Point
+	tint      string
+	status    diffStatus
+	// storageCount holds the number of storage constraints
+	// declared by the service.
+	storageCount int
+	// shape holds the shape drawn behind the icon.
+	shape Shape
+	// attrs holds extra attributes added to the group holding
+	// the service's elements.
+	attrs map[string]string
+	// labelPosition holds where the service's name is shown.
+	labelPosition LabelPosition
+	// label, if not empty, holds the shortened name shown in the
+	// service's label.
+	label string
+	// hideIcon holds whether the service is drawn without an icon.
+	hideIcon bool
+	// scale, if not zero, holds the scale at which the service is
+	// drawn about its center.
+	scale float64
+	// offer holds whether the service stands for an application
+	// offered by another model, named by its offer URL.
+	offer bool
+	// series holds the series of the service's charm if it
+	// differs from the default series of the bundle.
+	series string
+	// dimmed holds whether the service is drawn faded because
+	// it is not related to the focus service.
+	dimmed bool
+	// shadow holds whether the service's icon is drawn with the
+	// drop shadow defined by the canvas.
+	shadow bool
+	// model, if set, holds the name of the model to which the
+	// service belongs, shown beneath its name.
+	model string
+	// constraints, if set, holds the constraints of the service,
+	// shown when hovering over it.
+	constraints string
+	// units holds the number of units of the service.
+	units int
+	// colorBlindSafe holds whether the service's status is
+	// highlighted as described by WithColorBlindSafe.
+	colorBlindSafe bool
 }
 
 // serviceRelation represents a relation created between two services.
 type serviceRelation struct {
 	serviceA *service
 	serviceB *service
+	status   diffStatus
+	// interfaceName identifies what the relation carries.
+	interfaceName string
+	// color holds the color of the relation, if it is not
+	// drawn in the default color.
+	color string
+	// dash holds the dash pattern of the relation's line. If
+	// it is empty, the line is solid.
+	dash string
+	// colorBlindSafe holds whether the relation's status is
+	// highlighted as described by WithColorBlindSafe.
+	colorBlindSafe bool
+	// perimeter holds whether the relation is attached to the
+	// services' perimeters facing each other rather than to the
+	// closest of their cardinal points.
+	perimeter bool
+	// formatLength, if set, formats fractional lengths written
+	// when drawing the relation.
+	formatLength func(float64) string
+	// dimmed holds whether the relation is drawn faded because
+	// it does not involve the focus service.
+	dimmed bool
+	// weight holds the weight of the relation, if weighted is
+	// true.
+	weight   float64
+	weighted bool
+	// width, if positive, holds the width of the relation's line
+	// in place of the default.
+	width float64
+	// note, if set, holds the text of the note shown beside the
+	// relation.
+	note string
+	// gradientId, if set, holds the id of the gradient blending
+	// the colors of the relation's services with which the
+	// relation is drawn.
+	gradientId string
+}
+
+// padding holds the space left on each side of the diagram.
+type padding struct {
+	top, right, bottom, left int
 }
 
 // line represents a line segment with two endpoints.
@@ -56,71 +407,512 @@ type line struct {
 }
 
 // definition creates any necessary defs that can be used later in the SVG.
-func (s *service) definition(canvas *svg.SVG, iconsRendered map[string]bool, iconIds map[string]string) error {
-	if len(s.iconSrc) == 0 || iconsRendered[s.charmPath] {
+// Each distinct icon is defined once, keyed in iconsRendered by a hash of
+// its contents, so that charms with identical icons share a definition.
+func (s *service) definition(canvas *svg.SVG, iconsRendered map[string]string, iconIds map[string]string) error {
+	if s.tint != "" {
+		s.tintDefinition(canvas)
+	}
+	if len(s.iconSrc) == 0 {
 		return nil
 	}
-	iconsRendered[s.charmPath] = true
-	iconIds[s.charmPath] = fmt.Sprintf("icon-%d", len(iconsRendered))
+	sum := sha256.Sum256(s.iconSrc)
+	key := hex.EncodeToString(sum[:])
+	if id, ok := iconsRendered[key]; ok {
+		iconIds[s.charmPath] = id
+		return nil
+	}
+	if iconIds[s.charmPath] == "" {
+		iconIds[s.charmPath] = fmt.Sprintf("icon-%d", len(iconsRendered)+1)
+	}
+	iconsRendered[key] = iconIds[s.charmPath]
+
+	// Process the icon in full before writing it, so that a
+	// malformed icon cannot corrupt the document.
+	var buf bytes.Buffer
+	if err := processIcon(bytes.NewReader(s.iconSrc), &buf, iconIds[s.charmPath]); err != nil {
+		buf.Reset()
+		processIcon(strings.NewReader(placeholderIcon), &buf, iconIds[s.charmPath])
+		buf.WriteTo(canvas.Writer)
+		return err
+	}
+	_, err := buf.WriteTo(canvas.Writer)
+	return err
+}
+
+// tintDefinition creates the filter used to tint the service's icon by
+// overlaying the tint color on the opaque parts of the icon.
+func (s *service) tintDefinition(canvas *svg.SVG) {
+	canvas.Filter(s.tintId())
+	fmt.Fprintf(canvas.Writer, `<feFlood flood-color="%s" flood-opacity="%g" result="tint" />`+"\n",
+		escapeString(s.tint), tintOpacity)
+	canvas.FeComposite(svg.Filterspec{In: "tint", In2: "SourceAlpha", Result: "tintedIcon"}, "in", 0, 0, 0, 0)
+	canvas.FeMerge([]string{"SourceGraphic", "tintedIcon"})
+	canvas.Fend()
+}
+
+// shadowDefinition defines the filter which draws the given drop shadow
+// beneath icons.
+func shadowDefinition(canvas *svg.SVG, shadow *IconShadow) {
+	// The filter region is extended to hold the whole shadow.
+	margin := int(math.Ceil(float64(shadow.extent()) * 100 / iconSize))
+	canvas.Filter("iconShadow", fmt.Sprintf(`x="-%d%%" y="-%d%%" width="%d%%" height="%d%%"`,
+		margin, margin, 100+2*margin, 100+2*margin))
+	in := "SourceAlpha"
+	if shadow.Blur > 0 {
+		canvas.FeGaussianBlur(svg.Filterspec{In: in, Result: "blur"}, shadow.Blur, shadow.Blur)
+		in = "blur"
+	}
+	canvas.FeOffset(svg.Filterspec{In: in, Result: "offset"}, shadow.Offset.X, shadow.Offset.Y)
+	fmt.Fprintf(canvas.Writer, `<feFlood flood-color="%s" flood-opacity="%g" result="color" />`+"\n",
+		escapeString(shadow.Color), shadowOpacity)
+	canvas.FeComposite(svg.Filterspec{In: "color", In2: "offset", Result: "shadow"}, "in", 0, 0, 0, 0)
+	canvas.FeMerge([]string{"shadow", "SourceGraphic"})
+	canvas.Fend()
+}
+
+// extent returns how far, in pixels, the shadow may reach beyond the
+// edges of the icon, allowing three standard deviations for the blur.
+func (shadow *IconShadow) extent() int {
+	offset := math.Max(math.Abs(float64(shadow.Offset.X)), math.Abs(float64(shadow.Offset.Y)))
+	return int(math.Ceil(offset + 3*shadow.Blur))
+}
 
-	// Temporary solution:
-	iconBuf := bytes.NewBuffer(s.iconSrc)
-	return processIcon(iconBuf, canvas.Writer, iconIds[s.charmPath])
+// shadowBounds returns the bounds of the service extended to hold the
+// shadow of its icon.
+func (c *Canvas) shadowBounds(s *service) image.Rectangle {
+	bounds := s.bounds()
+	if !s.shadow {
+		return bounds
+	}
+	if margin := c.iconShadow.extent() - (serviceBlockSize-iconSize)/2; margin > 0 {
+		bounds = bounds.Inset(-margin)
+	}
+	return bounds
+}
+
+// tintId returns the id of the filter used to tint the service's icon.
+func (s *service) tintId() string {
+	return "tint-" + s.name
 }
 
 // usage creates any necessary tags for actually using the service in the SVG.
 func (s *service) usage(canvas *svg.SVG, iconIds map[string]string) {
+	if s.offer {
+		s.offerUsage(canvas)
+		return
+	}
 	canvas.Use(
 		s.point.X,
 		s.point.Y,
 		"#serviceBlock",
 		fmt.Sprintf(`id=%q`, s.name))
-	if len(s.iconSrc) > 0 {
+	if s.status != diffUnchanged {
+		canvas.Roundrect(
+			s.point.X,
+			s.point.Y,
+			serviceBlockSize,
+			serviceBlockSize,
+			diffCornerRadius,
+			diffCornerRadius,
+			s.diffAttrs()...,
+		)
+	}
+	if s.shape != ShapeNone {
+		s.shapeBackground(canvas)
+	}
+	var iconAttrs []string
+	if s.tint != "" {
+		iconAttrs = append(iconAttrs, fmt.Sprintf(`filter="url(#%s)"`, s.tintId()))
+	}
+	if s.shadow && (len(s.iconSrc) > 0 || !s.hideIcon) {
+		// The icon may already have a filter of its own to tint
+		// it, so apply the shadow to a group around it.
+		canvas.Group(`filter="url(#iconShadow)"`)
+	}
+	switch {
+	case len(s.iconSrc) > 0:
 		canvas.Use(
 			s.point.X+serviceBlockSize/2-iconSize/2,
 			s.point.Y+serviceBlockSize/2-iconSize/2,
 			"#"+iconIds[s.charmPath],
-			fmt.Sprintf(`width="%d" height="%d"`, iconSize, iconSize),
+			append([]string{fmt.Sprintf(`width="%d" height="%d"`, iconSize, iconSize)}, iconAttrs...)...,
 		)
-	} else {
+	case !s.hideIcon:
 		canvas.Image(
 			s.point.X+serviceBlockSize/2-iconSize/2,
 			s.point.Y+serviceBlockSize/2-iconSize/2,
 			iconSize,
 			iconSize,
 			s.iconUrl,
+			iconAttrs...,
 		)
 	}
-	canvas.Textlines(
-		s.point.X+serviceBlockSize/2,
-		s.point.Y+serviceBlockSize/6,
-		[]string{s.name},
-		serviceBlockSize/10,
-		0,
-		"#505050",
-		"middle")
+	if s.shadow && (len(s.iconSrc) > 0 || !s.hideIcon) {
+		canvas.Gend()
+	}
+	labelY := s.point.Y + serviceBlockSize/6
+	switch s.labelPosition {
+	case LabelNone:
+		return
+	case LabelAbove:
+		labelY = s.point.Y - labelGap
+	case LabelBelow:
+		labelY = s.point.Y + serviceBlockSize + labelFontSize
+	}
+	if s.model != "" {
+		// The model is shown beneath the name, so move the name
+		// up to make room when it is shown above the service.
+		if s.labelPosition == LabelAbove {
+			labelY -= modelLineHeight
+		}
+		canvas.Text(
+			s.point.X+serviceBlockSize/2,
+			labelY+modelLineHeight,
+			s.model,
+			fmt.Sprintf("font-size:%dpx;fill:%s;text-anchor:middle", modelFontSize, modelColor))
+	}
+	if s.label == "" {
+		canvas.Textlines(
+			s.point.X+serviceBlockSize/2,
+			labelY,
+			[]string{s.name},
+			labelFontSize,
+			0,
+			"#505050",
+			"middle")
+		return
+	}
+	// Keep the full name available as a tooltip.
+	canvas.Gstyle(fmt.Sprintf("font-size:%dpx;fill:#505050;text-anchor:middle", labelFontSize))
+	canvas.Title(s.name)
+	canvas.Text(s.point.X+serviceBlockSize/2, labelY, s.label)
+	canvas.Gend()
+}
+
+// offerUsage draws a service standing for an application offered by
+// another model as a dashed box holding the offer URL.
+func (s *service) offerUsage(canvas *svg.SVG) {
+	canvas.Roundrect(
+		s.point.X+diffLineWidth,
+		s.point.Y+diffLineWidth,
+		serviceBlockSize-2*diffLineWidth,
+		serviceBlockSize-2*diffLineWidth,
+		diffCornerRadius,
+		diffCornerRadius,
+		fmt.Sprintf(`fill="#FFFFFF" stroke=%q stroke-width="%dpx" stroke-dasharray="%s"`, offerColor, relationLineWidth, offerRelationDash),
+		fmt.Sprintf(`id=%q`, s.name),
+	)
+	x, y := s.point.X+serviceBlockSize/2, s.point.Y+serviceBlockSize/2
+	canvas.Text(x, y-labelFontSize, "offer", fmt.Sprintf("font-size:14px;fill:%s;text-anchor:middle", offerColor))
+	canvas.Gstyle(fmt.Sprintf("font-size:%dpx;fill:%s;text-anchor:middle", labelFontSize, fontColor))
+	defer canvas.Gend()
+	if s.label == "" {
+		canvas.Text(x, y+labelFontSize/2, s.name)
+		return
+	}
+	// Keep the full URL available as a tooltip.
+	canvas.Title(s.name)
+	canvas.Text(x, y+labelFontSize/2, s.label)
+}
+
+// shortLabel returns the label shown for a service with the given name,
+// which is empty if the name is shown in full. Longer names are cut short
+// and end in an ellipsis.
+func shortLabel(name string, max int) string {
+	switch {
+	case max < 0:
+		return ""
+	case max == 0:
+		max = maxLabelLength
+	}
+	if utf8.RuneCountInString(name) <= max {
+		return ""
+	}
+	return string([]rune(name)[:max-1]) + "…"
+}
+
+// diffAttrs returns the attributes of the outline highlighting the
+// service's status.
+func (s *service) diffAttrs() []string {
+	attrs := []string{
+		fmt.Sprintf(`fill="none" stroke=%q stroke-width="%dpx"`, s.status.color(s.colorBlindSafe), diffLineWidth),
+	}
+	if s.colorBlindSafe {
+		attrs = append(attrs, fmt.Sprintf(`stroke-dasharray=%q`, s.status.dash()))
+	}
+	return attrs
+}
+
+// shapeBackground draws the service's shape centered behind its icon.
+func (s *service) shapeBackground(canvas *svg.SVG) {
+	c := s.center()
+	r := shapeSize / 2
+	style := fmt.Sprintf("fill:%s", shapeColor)
+	switch s.shape {
+	case ShapeRect:
+		canvas.Rect(c.X-r, c.Y-r, shapeSize, shapeSize, style)
+	case ShapeHexagon:
+		// A hexagon with two sides parallel to the x axis.
+		xs := make([]int, 6)
+		ys := make([]int, 6)
+		for i := range xs {
+			angle := float64(i) * math.Pi / 3
+			xs[i] = c.X + int(math.Floor(float64(r)*math.Cos(angle)+0.5))
+			ys[i] = c.Y + int(math.Floor(float64(r)*math.Sin(angle)+0.5))
+		}
+		canvas.Polygon(xs, ys, style)
+	case ShapeCylinder:
+		ry := shapeSize / 8
+		canvas.Path(
+			fmt.Sprintf("M%d,%d v%d a%d,%d 0 0,0 %d,0 v%d a%d,%d 0 0,0 %d,0 z",
+				c.X-r, c.Y-r+ry,
+				shapeSize-2*ry,
+				r, ry, shapeSize,
+				-(shapeSize-2*ry),
+				r, ry, -shapeSize,
+			),
+			style,
+		)
+		canvas.Ellipse(c.X, c.Y-r+ry, r, ry, style+";stroke:#FFFFFF;stroke-width:2px")
+	}
+}
+
+// storageBadge draws a cylinder in the top right corner of the service
+// block, labeled with the number of storage constraints declared by the
+// service.
+func (s *service) storageBadge(canvas *svg.SVG, color string) {
+	x := s.point.X + serviceBlockSize - storageBadgeOffset - storageBadgeWidth
+	y := s.point.Y + storageBadgeOffset
+	rx, ry := storageBadgeWidth/2, storageBadgeWidth/6
+	canvas.Path(
+		fmt.Sprintf("M%d,%d v%d a%d,%d 0 0,0 %d,0 v%d a%d,%d 0 0,0 %d,0 z",
+			x, y+ry,
+			storageBadgeHeight,
+			rx, ry, storageBadgeWidth,
+			-storageBadgeHeight,
+			rx, ry, -storageBadgeWidth),
+		fmt.Sprintf("fill:%s", escapeString(color)),
+	)
+	canvas.Ellipse(x+rx, y+ry, rx, ry, fmt.Sprintf("fill:%s;stroke:#FFFFFF;stroke-width:1px", escapeString(color)))
+	canvas.Text(
+		x+rx,
+		y+ry+storageBadgeHeight/2+ry,
+		fmt.Sprint(s.storageCount),
+		"font-size:12px;fill:#FFFFFF;text-anchor:middle",
+	)
+}
+
+// seriesBadge draws a badge naming the service's series at the bottom of
+// the service block.
+func (s *service) seriesBadge(canvas *svg.SVG, color string) {
+	x := s.point.X + serviceBlockSize/2
+	y := s.point.Y + serviceBlockSize - seriesBadgeOffset
+	canvas.Roundrect(
+		x-seriesBadgeWidth/2,
+		y-seriesBadgeHeight,
+		seriesBadgeWidth,
+		seriesBadgeHeight,
+		4,
+		4,
+		fmt.Sprintf("fill:%s", escapeString(color)),
+	)
+	canvas.Text(x, y-5, s.series, "font-size:12px;fill:#FFFFFF;text-anchor:middle")
 }
 
 // definition creates any necessary defs that can be used later in the SVG.
 func (r *serviceRelation) definition(canvas *svg.SVG) {
+	if !r.hasGradient() {
+		return
+	}
+	// The gradient is laid along the line itself, as gradients
+	// relative to the bounding box of a horizontal or vertical
+	// line are not drawn.
+	l := r.line()
+	fmt.Fprintf(canvas.Writer, `<linearGradient id="%s" gradientUnits="userSpaceOnUse" x1="%d" y1="%d" x2="%d" y2="%d">`+"\n",
+		escapeString(r.gradientId), l.p0.X, l.p0.Y, l.p1.X, l.p1.Y)
+	fmt.Fprintf(canvas.Writer, `<stop offset="0%%" stop-color="%s" />`+"\n", escapeString(r.endpointColor(r.serviceA)))
+	fmt.Fprintf(canvas.Writer, `<stop offset="100%%" stop-color="%s" />`+"\n", escapeString(r.endpointColor(r.serviceB)))
+	io.WriteString(canvas.Writer, "</linearGradient>\n")
+}
+
+// hasGradient reports whether the relation is drawn with a gradient
+// blending the colors of its services. Relations highlighted as
+// differences are always drawn in the color of their status.
+func (r *serviceRelation) hasGradient() bool {
+	return r.gradientId != "" && r.status == diffUnchanged && r.serviceA != r.serviceB
+}
+
+// endpointColor returns the color of the given service at the end of a
+// relation drawn with a gradient: the color of its status if it differs,
+// otherwise its tint, otherwise the color of the relation.
+func (r *serviceRelation) endpointColor(s *service) string {
+	switch {
+	case s.status != diffUnchanged:
+		return s.status.color(s.colorBlindSafe)
+	case s.tint != "":
+		return s.tint
+	}
+	return r.lineColor()
+}
+
+// lineColor returns the color in which the relation is drawn.
+func (r *serviceRelation) lineColor() string {
+	if r.status != diffUnchanged {
+		return r.status.color(r.colorBlindSafe)
+	}
+	if r.color != "" {
+		return r.color
+	}
+	return relationColor
+}
+
+// line returns the line along which the relation is drawn.
+func (r *serviceRelation) line() line {
+	if r.perimeter {
+		return r.perimeterRelation()
+	}
+	return r.shortestRelation()
 }
 
 // usage creates any necessary tags for actually using the relation in the SVG.
 func (r *serviceRelation) usage(canvas *svg.SVG) {
-	l := r.shortestRelation()
-	canvas.Line(
-		l.p0.X,
-		l.p0.Y,
-		l.p1.X,
-		l.p1.Y,
-		fmt.Sprintf(`stroke=%q`, relationColor),
-		fmt.Sprintf(`stroke-width="%dpx"`, relationLineWidth),
-		fmt.Sprintf(`stroke-dasharray=%q`, strokeDashArray(l)),
-	)
-	mid := l.p0.Add(l.p1).Div(2).Sub(point(healthCircleRadius, healthCircleRadius))
+	if r.dimmed {
+		canvas.Group(fmt.Sprintf(`opacity="%g"`, dimmedOpacity))
+		defer canvas.Gend()
+	}
+	color := r.lineColor()
+	stroke := fmt.Sprintf(`stroke="%s"`, escapeString(color))
+	if r.hasGradient() {
+		stroke = fmt.Sprintf(`stroke="url(#%s)"`, escapeString(r.gradientId))
+	}
+	var mid image.Point
+	if r.serviceA == r.serviceB {
+		mid = r.loopUsage(canvas, stroke)
+	} else {
+		mid = r.lineUsage(canvas, stroke)
+	}
+	mid = mid.Sub(point(healthCircleRadius, healthCircleRadius))
+	if color != relationColor {
+		// The shared health circle definition is drawn in the
+		// default relation color, so draw one in this color.
+		healthCircle(canvas, mid, color)
+		return
+	}
 	canvas.Use(mid.X, mid.Y, "#healthCircle")
 }
 
+// lineDash returns the dash pattern of the relation's line, which
+// shows its status if it is highlighted as described by
+// WithColorBlindSafe.
+func (r *serviceRelation) lineDash() string {
+	if r.colorBlindSafe && r.status != diffUnchanged {
+		return r.status.dash()
+	}
+	return r.dash
+}
+
+// lineUsage draws the relation as a line between its services, leaving a
+// gap for the health indicator, and returns the middle of the line.
+func (r *serviceRelation) lineUsage(canvas *svg.SVG, stroke string) image.Point {
+	l := r.line()
+	dash := r.lineDash()
+	if dash == "" {
+		canvas.Line(
+			l.p0.X,
+			l.p0.Y,
+			l.p1.X,
+			l.p1.Y,
+			stroke,
+			fmt.Sprintf(`stroke-width="%spx"`, r.strokeWidth()),
+			fmt.Sprintf(`stroke-dasharray=%q`, strokeDashArray(l, r.formatLength)),
+		)
+	} else {
+		// The dash pattern cannot also leave a gap for the
+		// health circle, so draw the line in two parts.
+		for _, part := range l.split(healthCircleRadius) {
+			canvas.Line(
+				part.p0.X,
+				part.p0.Y,
+				part.p1.X,
+				part.p1.Y,
+				stroke,
+				fmt.Sprintf(`stroke-width="%spx"`, r.strokeWidth()),
+				fmt.Sprintf(`stroke-dasharray=%q`, dash),
+			)
+		}
+	}
+	return l.p0.Add(l.p1).Div(2)
+}
+
+// strokeWidth returns the width of the relation's line, which is set
+// according to its weight when WithRelationWeights is used.
+func (r *serviceRelation) strokeWidth() string {
+	if r.width <= 0 {
+		return strconv.Itoa(relationLineWidth)
+	}
+	if r.formatLength != nil {
+		return r.formatLength(r.width)
+	}
+	return strconv.FormatFloat(math.Floor(r.width*100+0.5)/100, 'f', -1, 64)
+}
+
+// loopUsage draws a relation between a service and itself as a loop
+// around the top right corner of the service, leaving a gap for the
+// health indicator, and returns the middle of the loop.
+func (r *serviceRelation) loopUsage(canvas *svg.SVG, stroke string) image.Point {
+	corner, radius := r.loop()
+	// Angles are measured clockwise from the positive x axis, as
+	// y increases downwards. The loop leaves the top of the service
+	// at 180 degrees and returns to its right side at 450 degrees,
+	// with the health indicator at 315 degrees.
+	at := func(degrees float64) image.Point {
+		a := degrees * math.Pi / 180
+		return corner.Add(point(
+			int(math.Floor(float64(radius)*math.Cos(a)+0.5)),
+			int(math.Floor(float64(radius)*math.Sin(a)+0.5)),
+		))
+	}
+	gap := float64(healthCircleRadius) / float64(radius) * 180 / math.Pi
+	arc := func(p0, p1 image.Point) string {
+		return fmt.Sprintf("M%d,%d A%d,%d 0 0,1 %d,%d", p0.X, p0.Y, radius, radius, p1.X, p1.Y)
+	}
+	attrs := []string{
+		`fill="none"`,
+		stroke,
+		fmt.Sprintf(`stroke-width="%spx"`, r.strokeWidth()),
+	}
+	if dash := r.lineDash(); dash != "" {
+		attrs = append(attrs, fmt.Sprintf(`stroke-dasharray=%q`, dash))
+	}
+	canvas.Path(arc(at(180), at(315-gap))+" "+arc(at(315+gap), at(450)), attrs...)
+	return at(315)
+}
+
+// loop returns the center and radius of the circle along which a relation
+// between a service and itself is drawn.
+func (r *serviceRelation) loop() (image.Point, int) {
+	b := r.serviceA.bounds()
+	return point(b.Max.X, b.Min.Y), b.Dx() / 4
+}
+
+// healthCircle draws a relation health indicator with its top-left corner
+// at the given point.
+func healthCircle(canvas *svg.SVG, p image.Point, color string) {
+	canvas.Circle(
+		p.X+healthCircleRadius,
+		p.Y+healthCircleRadius,
+		healthCircleRadius,
+		fmt.Sprintf("stroke:%s;fill:none;stroke-width:%dpx", escapeString(color), relationLineWidth),
+	)
+	canvas.Circle(
+		p.X+healthCircleRadius,
+		p.Y+healthCircleRadius,
+		healthCircleRadius/2,
+		fmt.Sprintf("fill:%s", escapeString(color)),
+	)
+}
+
 // shortestRelation finds the shortest line between two services, assuming
 // that each service can be connected on one of four cardinal points only.
 func (r *serviceRelation) shortestRelation() line {
@@ -143,21 +935,95 @@ func (r *serviceRelation) shortestRelation() line {
 	return shortestPair
 }
 
+// perimeterRelation finds the line between the perimeters of two services
+// along the line joining their centers, so that relations to services in
+// different directions attach at different points.
+func (r *serviceRelation) perimeterRelation() line {
+	centerA, centerB := r.serviceA.center(), r.serviceB.center()
+	return line{
+		p0: r.serviceA.perimeterPoint(centerB),
+		p1: r.serviceB.perimeterPoint(centerA),
+	}
+}
+
+// center returns the point at the center of the service block.
+func (s *service) center() image.Point {
+	return point(s.point.X+serviceBlockSize/2, s.point.Y+serviceBlockSize/2)
+}
+
+// size returns the length of the sides of the service block as drawn.
+func (s *service) size() int {
+	if s.scale == 0 {
+		return serviceBlockSize
+	}
+	return int(math.Floor(serviceBlockSize*s.scale + 0.5))
+}
+
+// bounds returns the rectangle covered by the service block as drawn.
+func (s *service) bounds() image.Rectangle {
+	size := s.size()
+	min := s.center().Sub(point(size/2, size/2))
+	return image.Rectangle{min, min.Add(point(size, size))}
+}
+
+// perimeterPoint returns the point at which the line from the center of
+// the service block towards p crosses the edge of the block.
+func (s *service) perimeterPoint(p image.Point) image.Point {
+	c := s.center()
+	d := p.Sub(c)
+	extent := math.Max(math.Abs(float64(d.X)), math.Abs(float64(d.Y)))
+	if extent == 0 {
+		return c
+	}
+	scale := float64(s.size()/2) / extent
+	return point(
+		c.X+int(math.Floor(float64(d.X)*scale+0.5)),
+		c.Y+int(math.Floor(float64(d.Y)*scale+0.5)),
+	)
+}
+
 // cardinalPoints generates the points for each of the four cardinal points
 // of each service.
 func (s *service) cardinalPoints() []image.Point {
+	c, b := s.center(), s.bounds()
 	return []image.Point{
-		point(s.point.X+serviceBlockSize/2, s.point.Y),
-		point(s.point.X, s.point.Y+serviceBlockSize/2),
-		point(s.point.X+serviceBlockSize/2, s.point.Y+serviceBlockSize),
-		point(s.point.X+serviceBlockSize, s.point.Y+serviceBlockSize/2),
+		point(c.X, b.Min.Y),
+		point(b.Min.X, c.Y),
+		point(c.X, b.Max.Y),
+		point(b.Max.X, c.Y),
 	}
 }
 
 // strokeDashArray generates the stroke-dasharray attribute content so that
-// the relation health indicator is placed in an empty space.
-func strokeDashArray(l line) string {
-	return fmt.Sprintf("%.2f, %d", l.length()/2-healthCircleRadius, healthCircleRadius*2)
+// the relation health indicator is placed in an empty space. Fractional
+// lengths are written using the given function, or with two decimal
+// places if it is nil.
+func strokeDashArray(l line, formatLength func(float64) string) string {
+	length := l.length()/2 - healthCircleRadius
+	if formatLength == nil {
+		return fmt.Sprintf("%.2f, %d", length, healthCircleRadius*2)
+	}
+	return fmt.Sprintf("%s, %d", formatLength(length), healthCircleRadius*2)
+}
+
+// split returns the parts of the line either side of a gap of the given
+// radius around its midpoint. No parts are returned if the line is too
+// short to have any.
+func (l *line) split(radius int) []line {
+	length := l.length()
+	half := length/2 - float64(radius)
+	if half <= 0 {
+		return nil
+	}
+	d := l.p1.Sub(l.p0)
+	offset := point(
+		int(math.Floor(float64(d.X)*half/length+0.5)),
+		int(math.Floor(float64(d.Y)*half/length+0.5)),
+	)
+	return []line{
+		{p0: l.p0, p1: l.p0.Add(offset)},
+		{p0: l.p1.Sub(offset), p1: l.p1},
+	}
 }
 
 // length calculates the length of a line.
@@ -173,6 +1039,9 @@ func (c *Canvas) addService(s *service) {
 
 // addRelation adds a new relation to the canvas.
 func (c *Canvas) addRelation(r *serviceRelation) {
+	if c.relationGradients {
+		r.gradientId = fmt.Sprintf("relationGradient%d", len(c.relations))
+	}
 	c.relations = append(c.relations, r)
 }
 
@@ -184,84 +1053,347 @@ func (c *Canvas) layout() (int, int) {
 	maxWidth := minInt
 	maxHeight := minInt
 
-	for _, service := range c.services {
-		if service.point.X < minWidth {
-			minWidth = service.point.X
+	extend := func(bounds image.Rectangle) {
+		if bounds.Min.X < minWidth {
+			minWidth = bounds.Min.X
 		}
-		if service.point.Y < minHeight {
-			minHeight = service.point.Y
+		if bounds.Min.Y < minHeight {
+			minHeight = bounds.Min.Y
 		}
-		if service.point.X > maxWidth {
-			maxWidth = service.point.X
+		if bounds.Max.X > maxWidth {
+			maxWidth = bounds.Max.X
 		}
-		if service.point.Y > maxHeight {
-			maxHeight = service.point.Y
+		if bounds.Max.Y > maxHeight {
+			maxHeight = bounds.Max.Y
 		}
 	}
 	for _, service := range c.services {
-		service.point = service.point.Sub(point(minWidth, minHeight))
+		extend(c.shadowBounds(service))
+	}
+	// Leave room for relations looping outside their service.
+	for _, relation := range c.relations {
+		if relation.serviceA == relation.serviceB {
+			corner, radius := relation.loop()
+			extend(image.Rect(corner.X-radius, corner.Y-radius, corner.X+radius, corner.Y+radius))
+		}
 	}
-	return abs(maxWidth-minWidth) + serviceBlockSize,
-		abs(maxHeight-minHeight) + serviceBlockSize
+	// Leave room for notes beside relations.
+	for _, relation := range c.relations {
+		if relation.note != "" {
+			extend(c.noteBounds(relation))
+		}
+	}
+	// Leave room for labels shown outside the services.
+	top, bottom := 0, 0
+	switch c.labelPosition {
+	case LabelAbove:
+		top = labelFontSize + labelGap
+	case LabelBelow:
+		bottom = labelFontSize + labelGap
+	}
+	for _, service := range c.services {
+		if service.model != "" {
+			if c.labelPosition == LabelAbove {
+				top += modelLineHeight
+			} else if c.labelPosition == LabelBelow {
+				bottom += modelLineHeight
+			}
+			break
+		}
+	}
+	top += c.padding.top
+	bottom += c.padding.bottom
+	for _, service := range c.services {
+		service.point = service.point.Sub(point(minWidth-c.padding.left, minHeight-top))
+	}
+	return abs(maxWidth-minWidth) + c.padding.left + c.padding.right, abs(maxHeight-minHeight) + top + bottom
 }
 
 func (c *Canvas) definition(canvas *svg.SVG) {
 	canvas.Def()
 	defer canvas.DefEnd()
 
-	// Service block.
-	canvas.Group(`id="serviceBlock"`,
-		`transform="scale(0.8)"`)
-	io.WriteString(canvas.Writer, assets.ServiceModule)
-	canvas.Gend() // Gid
+	serviceBlockDefinition(canvas)
+
+	if c.iconShadow != nil {
+		shadowDefinition(canvas, c.iconShadow)
+	}
 
 	// Relation health circle.
 	canvas.Gid("healthCircle")
-	canvas.Circle(
-		healthCircleRadius,
-		healthCircleRadius,
-		healthCircleRadius,
-		fmt.Sprintf("stroke:%s;fill:none;stroke-width:%dpx", relationColor, relationLineWidth),
-	)
-	canvas.Circle(
-		healthCircleRadius,
-		healthCircleRadius,
-		healthCircleRadius/2,
-		fmt.Sprintf("fill:%s", relationColor),
-	)
+	healthCircle(canvas, point(0, 0), relationColor)
 	canvas.Gend()
 
+	// Region to which the diagram is clipped.
+	if !c.clip.Empty() {
+		canvas.ClipPath(`id="diagramClip"`)
+		canvas.Rect(c.clip.Min.X, c.clip.Min.Y, c.clip.Dx(), c.clip.Dy())
+		canvas.ClipEnd()
+	}
+
 	// Service and relation specific defs.
 	for _, relation := range c.relations {
+		if c.ctx.Err() != nil {
+			return
+		}
 		relation.definition(canvas)
 	}
 	for _, service := range c.services {
+		if c.ctx.Err() != nil {
+			return
+		}
 		service.definition(canvas, c.iconsRendered, c.iconIds)
 	}
 }
 
+// serviceBlockDefinition defines the block drawn behind every service.
+func serviceBlockDefinition(canvas *svg.SVG) {
+	canvas.Group(`id="serviceBlock"`,
+		`transform="scale(0.8)"`)
+	io.WriteString(canvas.Writer, assets.ServiceModule)
+	canvas.Gend() // Gid
+}
+
 func (c *Canvas) relationsGroup(canvas *svg.SVG) {
 	canvas.Gid("relations")
 	defer canvas.Gend()
-	for _, relation := range c.relations {
+	for _, relation := range c.orderedRelations() {
+		if c.ctx.Err() != nil {
+			return
+		}
 		relation.usage(canvas)
 	}
 }
 
+// relationNotesGroup draws the notes given by WithRelationNotes in front
+// of the relations and services.
+func (c *Canvas) relationNotesGroup(canvas *svg.SVG) {
+	if c.relationNote == nil {
+		return
+	}
+	canvas.Gid("relationNotes")
+	defer canvas.Gend()
+	for _, relation := range c.relations {
+		if relation.note == "" {
+			continue
+		}
+		if relation.dimmed {
+			canvas.Group(fmt.Sprintf(`opacity="%g"`, dimmedOpacity))
+		}
+		bounds := c.noteBounds(relation)
+		canvas.Roundrect(bounds.Min.X, bounds.Min.Y, bounds.Dx(), bounds.Dy(), 3, 3,
+			fmt.Sprintf(`fill="%s" stroke="%s" stroke-width="1px"`, noteColor, escapeString(relation.lineColor())))
+		canvas.Text(bounds.Min.X+bounds.Dx()/2, bounds.Max.Y-notePadding-2, relation.note,
+			fmt.Sprintf("font-size:%dpx;fill:%s;text-anchor:middle", noteFontSize, fontColor))
+		if relation.dimmed {
+			canvas.Gend()
+		}
+	}
+}
+
+// noteSize returns the size of the callout holding the given note.
+func noteSize(note string) image.Point {
+	// Assume the average character is half as wide as it is
+	// high.
+	return point(
+		utf8.RuneCountInString(note)*noteFontSize/2+2*notePadding,
+		noteFontSize+2*notePadding,
+	)
+}
+
+// noteBounds returns the bounds of the callout holding the note of the
+// given relation. The callout is placed beside the relation's line,
+// clear of the line and its health indicator, at the first of several
+// positions along the line at which it does not overlap any service.
+// The note of a relation between a service and itself is placed outside
+// its loop.
+func (c *Canvas) noteBounds(r *serviceRelation) image.Rectangle {
+	size := noteSize(r.note)
+	half := [2]float64{float64(size.X) / 2, float64(size.Y) / 2}
+	// at returns the bounds of the callout beside the point p,
+	// at a distance from it in the direction (dx, dy), which
+	// must be a unit vector.
+	at := func(p image.Point, dx, dy, distance float64) image.Rectangle {
+		// Move the center of the callout far enough that its
+		// nearest edge is the given distance from p.
+		distance += math.Abs(dx)*half[0] + math.Abs(dy)*half[1]
+		center := p.Add(point(
+			int(math.Floor(dx*distance+0.5)),
+			int(math.Floor(dy*distance+0.5)),
+		))
+		min := center.Sub(point(size.X/2, size.Y/2))
+		return image.Rectangle{min, min.Add(size)}
+	}
+	if r.serviceA == r.serviceB {
+		corner, radius := r.loop()
+		return at(corner, math.Sqrt2/2, -math.Sqrt2/2, float64(radius+healthCircleRadius+noteGap))
+	}
+	l := r.line()
+	dx, dy := float64(l.p1.X-l.p0.X), float64(l.p1.Y-l.p0.Y)
+	length := math.Hypot(dx, dy)
+	// The normal to the line, pointing up for horizontal lines.
+	nx, ny := 0.0, -1.0
+	if length > 0 {
+		nx, ny = dy/length, -dx/length
+		if ny > 0 || ny == 0 && nx < 0 {
+			nx, ny = -nx, -ny
+		}
+	}
+	var first image.Rectangle
+	for i, t := range []float64{0.5, 0.35, 0.65, 0.2, 0.8} {
+		p := l.p0.Add(point(
+			int(math.Floor(dx*t+0.5)),
+			int(math.Floor(dy*t+0.5)),
+		))
+		for j, side := range []float64{1, -1} {
+			bounds := at(p, side*nx, side*ny, healthCircleRadius+noteGap)
+			if i == 0 && j == 0 {
+				first = bounds
+			}
+			if !c.overlapsService(bounds) {
+				return bounds
+			}
+		}
+	}
+	return first
+}
+
+// overlapsService reports whether the given bounds overlap the block of
+// any service.
+func (c *Canvas) overlapsService(bounds image.Rectangle) bool {
+	for _, s := range c.services {
+		if bounds.Overlaps(s.bounds()) {
+			return true
+		}
+	}
+	return false
+}
+
+// orderedRelations returns the relations in the order in which they are
+// drawn: by increasing priority, as chosen with WithRelationPriority, and
+// otherwise in the order in which they were added.
+func (c *Canvas) orderedRelations() []*serviceRelation {
+	if c.relationPriority == nil {
+		return c.relations
+	}
+	relations := relationsByPriority{
+		relations:  make([]*serviceRelation, len(c.relations)),
+		priorities: make([]int, len(c.relations)),
+	}
+	for i, r := range c.relations {
+		relations.relations[i] = r
+		relations.priorities[i] = c.relationPriority(r.interfaceName)
+	}
+	sort.Stable(relations)
+	return relations.relations
+}
+
+// relationsByPriority implements sort.Interface to order relations by
+// their priorities.
+type relationsByPriority struct {
+	relations  []*serviceRelation
+	priorities []int
+}
+
+func (r relationsByPriority) Len() int           { return len(r.relations) }
+func (r relationsByPriority) Less(i, j int) bool { return r.priorities[i] < r.priorities[j] }
+func (r relationsByPriority) Swap(i, j int) {
+	r.relations[i], r.relations[j] = r.relations[j], r.relations[i]
+	r.priorities[i], r.priorities[j] = r.priorities[j], r.priorities[i]
+}
+
 func (c *Canvas) servicesGroup(canvas *svg.SVG) {
 	canvas.Gid("services")
 	defer canvas.Gend()
 	for _, service := range c.services {
-		service.usage(canvas, c.iconIds)
+		if c.ctx.Err() != nil {
+			return
+		}
+		c.drawService(canvas, service)
 	}
 }
 
-// Marshal renders the SVG to the given io.Writer.
+// drawService draws the service along with its badges.
+func (c *Canvas) drawService(canvas *svg.SVG, service *service) {
+	if service.dimmed {
+		canvas.Group(fmt.Sprintf(`opacity="%g"`, dimmedOpacity))
+		defer canvas.Gend()
+	}
+	if len(service.attrs) > 0 {
+		canvas.Group(service.attributes()...)
+		defer canvas.Gend()
+	}
+	if service.constraints != "" {
+		// Show the constraints when hovering over the service.
+		canvas.Group()
+		canvas.Title("constraints: " + service.constraints)
+		defer canvas.Gend()
+	}
+	if service.scale != 0 && service.scale != 1 {
+		center := service.center()
+		canvas.Group(fmt.Sprintf(`transform="translate(%d,%d) scale(%.4g) translate(%d,%d)"`,
+			center.X, center.Y, service.scale, -center.X, -center.Y))
+		defer canvas.Gend()
+	}
+	service.usage(canvas, c.iconIds)
+	if c.storageBadgeColor != "" && service.storageCount > 0 {
+		service.storageBadge(canvas, c.storageBadgeColor)
+	}
+	if c.seriesBadgeColor != "" && service.series != "" {
+		service.seriesBadge(canvas, c.seriesBadgeColor)
+	}
+}
+
+// attributes returns the extra attributes of the service formatted for
+// use on an element, in name order. Attributes whose names are not valid
+// XML names are omitted.
+func (s *service) attributes() []string {
+	names := make([]string, 0, len(s.attrs))
+	for name := range s.attrs {
+		if isXMLName(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	attrs := make([]string, len(names))
+	for i, name := range names {
+		attrs[i] = fmt.Sprintf(`%s="%s"`, name, escapeString(s.attrs[name]))
+	}
+	return attrs
+}
+
+// Marshal renders the SVG to the given io.Writer. Concurrent calls are
+// serialized.
 func (c *Canvas) Marshal(w io.Writer) {
+	c.marshal(context.Background(), w, nil)
+}
+
+// MarshalGroup renders the diagram to the given io.Writer as a single
+// group, without the root svg element, for embedding in a larger SVG
+// document with its top left corner at the point p. It returns the width
+// and height of the diagram. The document must declare the SVG and XLink
+// namespaces and must not use the ids of the elements defined by the
+// diagram, such as serviceBlock. Concurrent calls are serialized.
+func (c *Canvas) MarshalGroup(w io.Writer, p image.Point) (width, height int) {
+	return c.marshal(context.Background(), w, &p)
+}
+
+// marshal renders the SVG to the given io.Writer, as a standalone
+// document or, if at is not nil, as a group translated to the point it
+// holds, and returns the size of the image. It stops drawing, leaving
+// the output incomplete, once ctx is done.
+func (c *Canvas) marshal(ctx context.Context, w io.Writer, at *image.Point) (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ctx = ctx
+	defer func() {
+		c.ctx = nil
+	}()
+
 	// Initialize maps for service icons, which are used both in definition
 	// and use methods for services.
-	c.iconsRendered = make(map[string]bool)
-	c.iconIds = make(map[string]string)
+	c.iconsRendered = make(map[string]string)
+	c.iconIds = c.newIconIds()
 
 	// TODO check write errors and return an error from
 	// Marshal if the write fails. The svg package does not
@@ -269,18 +1401,565 @@ func (c *Canvas) Marshal(w io.Writer) {
 	// is to wrap the writer in a custom writer that panics
 	// on error, and catch the panic here.
 	width, height := c.layout()
+	diagramWidth, diagramHeight := width, height
+	clipped := !c.clip.Empty()
+	var legendCharms []*service
+	if c.charmLegend && !clipped {
+		legendCharms = c.legendCharms()
+	}
+	// The charm legend is shown beside the diagram, so bodyHeight
+	// holds the height of whichever of them is taller.
+	panel := charmLegendSize(legendCharms)
+	width += panel.X
+	bodyHeight := diagramHeight
+	if panel.Y > bodyHeight {
+		height += panel.Y - bodyHeight
+		bodyHeight = panel.Y
+	}
+	bannerHeight := 0
+	if c.seriesColor != "" && c.series != "" && !clipped {
+		bannerHeight = seriesBannerHeight
+	}
+	captionHeight := 0
+	if c.caption != "" && !clipped {
+		captionHeight = 2 * captionFontSize(width)
+	}
+	var descriptionLines []string
+	if c.showDescription && !clipped {
+		descriptionLines = c.descriptionLines(width)
+	}
+	descriptionHeight := descriptionBlockHeight(descriptionLines, width)
+	legendHeight := 0
+	if c.diffLegend && !clipped {
+		legendHeight = diffLegendHeight
+	}
+	var serviceListLines []string
+	if c.serviceList && !clipped {
+		serviceListLines = c.serviceListLines()
+	}
+	serviceListHeight := descriptionBlockHeight(serviceListLines, width)
+	height += bannerHeight + descriptionHeight + legendHeight + serviceListHeight + captionHeight
+	// translation holds the position in the image of the origin
+	// of the diagram.
+	translation := image.ZP
+	if clipped {
+		width, height = c.clip.Dx(), c.clip.Dy()
+		translation = image.ZP.Sub(c.clip.Min)
+	}
+	offset := c.origin.offset(width, height)
+	viewBox := c.letterbox(image.Rect(offset.X, offset.Y, offset.X+width, offset.Y+height))
 
 	canvas := svg.New(w)
-	canvas.Start(
-		width,
-		height,
-		fmt.Sprintf(`style="font-family:Ubuntu, sans-serif;" viewBox="0 0 %d %d"`,
-			width, height),
+	if at == nil {
+		c.start(canvas, viewBox)
+		defer canvas.End()
+	} else {
+		c.startGroup(canvas, viewBox, *at)
+		defer canvas.Gend()
+	}
+	c.definition(canvas)
+	if ctx.Err() != nil {
+		return viewBox.Dx(), viewBox.Dy()
+	}
+	if bannerHeight > 0 {
+		c.seriesBanner(canvas, offset, width)
+		// Leave room for the banner above the diagram.
+		offset.Y += bannerHeight
+	}
+	if descriptionHeight > 0 {
+		drawDescription(canvas, offset, descriptionLines, width)
+		offset.Y += descriptionHeight
+	}
+	if captionHeight > 0 {
+		p := offset
+		if c.captionPosition.top() {
+			// Leave room for the caption above the diagram.
+			offset.Y += captionHeight
+		} else {
+			p.Y += bodyHeight + legendHeight + serviceListHeight
+		}
+		c.drawCaption(canvas, p, width)
+	}
+	c.drawDiagram(canvas, translation.Add(offset), clipped)
+	if len(legendCharms) > 0 {
+		drawCharmLegend(canvas, offset.Add(point(diagramWidth, 0)), legendCharms, c.iconIds)
+	}
+	if legendHeight > 0 {
+		drawDiffLegend(canvas, offset.Add(point(0, bodyHeight)), c.colorBlindSafe)
+	}
+	if serviceListHeight > 0 {
+		canvas.Gid("serviceList")
+		drawDescription(canvas, offset.Add(point(0, bodyHeight+legendHeight)), serviceListLines, width)
+		canvas.Gend()
+	}
+	if c.miniMap {
+		c.drawMiniMap(canvas, viewBox, image.Pt(diagramWidth, diagramHeight))
+	}
+	return viewBox.Dx(), viewBox.Dy()
+}
+
+// legendCharms returns a service using each charm shown in the diagram,
+// in order of charm path, from which the charm legend is drawn.
+func (c *Canvas) legendCharms() []*service {
+	var charms []*service
+	seen := make(map[string]bool)
+	for _, s := range c.services {
+		if seen[s.charmPath] || s.offer {
+			continue
+		}
+		seen[s.charmPath] = true
+		charms = append(charms, s)
+	}
+	sort.Sort(servicesByCharmPath(charms))
+	return charms
+}
+
+// servicesByCharmPath implements sort.Interface to order services by the
+// paths of their charms.
+type servicesByCharmPath []*service
+
+func (s servicesByCharmPath) Len() int           { return len(s) }
+func (s servicesByCharmPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s servicesByCharmPath) Less(i, j int) bool { return s[i].charmPath < s[j].charmPath }
+
+// charmLegendSize returns the size of the panel listing the charms of
+// the given services.
+func charmLegendSize(charms []*service) image.Point {
+	if len(charms) == 0 {
+		return image.ZP
+	}
+	textWidth := 0
+	for _, s := range charms {
+		// Assume the average character is half as wide as it
+		// is high.
+		if w := len(s.charmName) * charmLegendFont / 2; w > textWidth {
+			textWidth = w
+		}
+		if w := len(s.charmPath) * modelFontSize / 2; w > textWidth {
+			textWidth = w
+		}
+	}
+	return point(
+		2*charmLegendMargin+charmLegendIcon+8+textWidth,
+		2*charmLegendMargin+len(charms)*charmLegendRow-8,
 	)
+}
+
+// drawCharmLegend draws a panel, with its top left corner at the given
+// point, listing the charms of the given services, each shown by its
+// icon, name and path. Embedded icons are reused from their definitions
+// in the diagram, using the given ids.
+func drawCharmLegend(canvas *svg.SVG, p image.Point, charms []*service, iconIds map[string]string) {
+	canvas.Gid("charmLegend")
+	defer canvas.Gend()
+	x := p.X + charmLegendMargin
+	y := p.Y + charmLegendMargin
+	for _, s := range charms {
+		switch {
+		case len(s.iconSrc) > 0:
+			canvas.Use(x, y, "#"+iconIds[s.charmPath],
+				fmt.Sprintf(`width="%d" height="%d"`, charmLegendIcon, charmLegendIcon))
+		case !s.hideIcon:
+			canvas.Image(x, y, charmLegendIcon, charmLegendIcon, s.iconUrl)
+		}
+		textX := x + charmLegendIcon + 8
+		canvas.Text(textX, y+charmLegendFont, s.charmName, fmt.Sprintf("font-size:%dpx;fill:%s", charmLegendFont, fontColor))
+		canvas.Text(textX, y+30, s.charmPath, fmt.Sprintf("font-size:%dpx;fill:%s", modelFontSize, modelColor))
+		y += charmLegendRow
+	}
+}
+
+// letterbox returns the view box r padded evenly on either side, or above
+// and below, so that it has the aspect ratio requested by WithAspectRatio.
+func (c *Canvas) letterbox(r image.Rectangle) image.Rectangle {
+	ratio := c.aspectRatio
+	if ratio == image.ZP {
+		return r
+	}
+	width, height := r.Dx(), r.Dy()
+	if width*ratio.Y < height*ratio.X {
+		// Pillarbox.
+		pad := (height*ratio.X+ratio.Y-1)/ratio.Y - width
+		r.Min.X -= pad / 2
+		r.Max.X += pad - pad/2
+	} else {
+		// Letterbox.
+		pad := (width*ratio.Y+ratio.X-1)/ratio.X - height
+		r.Min.Y -= pad / 2
+		r.Max.Y += pad - pad/2
+	}
+	return r
+}
+
+// drawDiagram draws the relations and services with the origin of the
+// diagram at the given point in the image.
+func (c *Canvas) drawDiagram(canvas *svg.SVG, translation image.Point, clipped bool) {
+	if translation != image.ZP {
+		// Move all the elements together so that the origin
+		// lies where requested.
+		canvas.Translate(translation.X, translation.Y)
+		defer canvas.Gend()
+	}
+	if clipped {
+		canvas.Group(`clip-path="url(#diagramClip)"`)
+		defer canvas.Gend()
+	}
+	groups := []func(*svg.SVG){c.relationsGroup, c.servicesGroup, c.relationNotesGroup}
+	if c.relationsInFront {
+		groups[0], groups[1] = groups[1], groups[0]
+	}
+	for _, group := range groups {
+		if c.ctx.Err() != nil {
+			return
+		}
+		group(canvas)
+	}
+}
+
+// drawMiniMap draws an overview of the whole diagram, which has the given
+// size, scaled down to fit in the bottom right corner of the view box.
+// Services are drawn as plain blocks joined by their relations and, if
+// the diagram is clipped, the rendered region is outlined.
+func (c *Canvas) drawMiniMap(canvas *svg.SVG, viewBox image.Rectangle, size image.Point) {
+	longest := size.X
+	if size.Y > longest {
+		longest = size.Y
+	}
+	scale := 1.0
+	if longest > miniMapSize {
+		scale = float64(miniMapSize) / float64(longest)
+	}
+	boxWidth := int(math.Floor(float64(size.X)*scale + 0.5))
+	boxHeight := int(math.Floor(float64(size.Y)*scale + 0.5))
+	canvas.Group(`id="miniMap"`,
+		fmt.Sprintf(`transform="translate(%d,%d) scale(%.4g)"`,
+			viewBox.Max.X-boxWidth-miniMapMargin,
+			viewBox.Max.Y-boxHeight-miniMapMargin,
+			scale))
+	defer canvas.Gend()
+	// The stroke widths are given in pixels of the image
+	// rather than of the diagram.
+	canvas.Rect(0, 0, size.X, size.Y,
+		fmt.Sprintf(`fill="#FFFFFF" fill-opacity="0.9" stroke="%s" vector-effect="non-scaling-stroke"`, fontColor))
+	for _, r := range c.relations {
+		p0, p1 := r.serviceA.center(), r.serviceB.center()
+		canvas.Line(p0.X, p0.Y, p1.X, p1.Y,
+			fmt.Sprintf(`stroke="%s" vector-effect="non-scaling-stroke"`, relationColor))
+	}
+	for _, s := range c.services {
+		b := s.bounds()
+		canvas.Rect(b.Min.X, b.Min.Y, b.Dx(), b.Dy(),
+			fmt.Sprintf(`fill="%s"`, fontColor))
+	}
+	if !c.clip.Empty() {
+		canvas.Rect(c.clip.Min.X, c.clip.Min.Y, c.clip.Dx(), c.clip.Dy(),
+			fmt.Sprintf(`fill="none" stroke="%s" stroke-width="2" vector-effect="non-scaling-stroke"`, miniMapColor))
+	}
+}
+
+// newIconIds returns the ids of the icons to be used for each charm, keyed
+// by charm path. If readable ids were not requested, it returns an empty
+// map, and icons are numbered as they are defined.
+func (c *Canvas) newIconIds() map[string]string {
+	iconIds := make(map[string]string)
+	if !c.readableIds {
+		return iconIds
+	}
+	used := make(map[string]bool)
+	for _, s := range c.services {
+		if len(s.iconSrc) == 0 || iconIds[s.charmPath] != "" {
+			continue
+		}
+		// Different paths may have the same slug, so
+		// number any later ones.
+		base := "icon-" + slug(s.charmPath)
+		id := base
+		for i := 2; used[id]; i++ {
+			id = fmt.Sprintf("%s-%d", base, i)
+		}
+		used[id] = true
+		iconIds[s.charmPath] = id
+	}
+	return iconIds
+}
+
+// slug returns s in lower case with each run of characters other than
+// letters and digits replaced by a single hyphen.
+func slug(s string) string {
+	var buf bytes.Buffer
+	hyphen := false
+	for _, r := range strings.ToLower(s) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			if hyphen && buf.Len() > 0 {
+				buf.WriteByte('-')
+			}
+			hyphen = false
+			buf.WriteRune(r)
+		} else {
+			hyphen = true
+		}
+	}
+	return buf.String()
+}
+
+// MarshalService writes an SVG image showing only the named service to w.
+// The service is drawn as it is in the full diagram, along with its label
+// and badges, in an image just large enough to hold it. An error is
+// returned if the canvas holds no such service.
+func (c *Canvas) MarshalService(w io.Writer, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var s *service
+	for _, service := range c.services {
+		if service.name == name {
+			s = service
+			break
+		}
+	}
+	if s == nil {
+		return errgo.Newf("service %q not found", name)
+	}
+	c.iconsRendered = make(map[string]string)
+	c.iconIds = c.newIconIds()
+
+	bounds := c.shadowBounds(s)
+	// Leave room for a label shown outside the service.
+	modelHeight := 0
+	if s.model != "" {
+		modelHeight = modelLineHeight
+	}
+	switch s.labelPosition {
+	case LabelAbove:
+		bounds.Min.Y -= labelFontSize + labelGap + modelHeight
+	case LabelBelow:
+		bounds.Max.Y += labelFontSize + labelGap + modelHeight
+	}
+	canvas := svg.New(w)
+	c.start(canvas, image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
 	defer canvas.End()
-	c.definition(canvas)
-	c.relationsGroup(canvas)
-	c.servicesGroup(canvas)
+	canvas.Def()
+	serviceBlockDefinition(canvas)
+	if s.shadow {
+		shadowDefinition(canvas, c.iconShadow)
+	}
+	s.definition(canvas, c.iconsRendered, c.iconIds)
+	canvas.DefEnd()
+	canvas.Translate(-bounds.Min.X, -bounds.Min.Y)
+	defer canvas.Gend()
+	c.drawService(canvas, s)
+	return nil
+}
+
+// captionFontSize returns the font size of a caption on an image of the
+// given width.
+func captionFontSize(width int) int {
+	size := width / 48
+	if size < minCaptionFontSize {
+		return minCaptionFontSize
+	}
+	return size
+}
+
+// drawCaption draws the caption in a band across the image of the given
+// width, starting at the given point.
+func (c *Canvas) drawCaption(canvas *svg.SVG, p image.Point, width int) {
+	size := captionFontSize(width)
+	x, anchor := p.X+size, "start"
+	if c.captionPosition.right() {
+		x, anchor = p.X+width-size, "end"
+	}
+	canvas.Text(x, p.Y+size+size/3, c.caption,
+		fmt.Sprintf("font-size:%dpx;fill:%s;text-anchor:%s", size, fontColor, anchor))
+}
+
+// descriptionLines returns the lines of text showing the description and
+// tags of the bundle on an image of the given width. The description is
+// wrapped to fit the image.
+func (c *Canvas) descriptionLines(width int) []string {
+	size := captionFontSize(width)
+	// Assume the average character is half as wide as it is
+	// high.
+	maxChars := (width - 2*size) * 2 / size
+	var lines []string
+	for _, para := range strings.Split(c.description, "\n") {
+		line := ""
+		for _, word := range strings.Fields(para) {
+			if line != "" && len(line)+1+len(word) > maxChars {
+				lines = append(lines, line)
+				line = ""
+			}
+			if line != "" {
+				line += " "
+			}
+			line += word
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(c.tags) > 0 {
+		lines = append(lines, "tags: "+strings.Join(c.tags, ", "))
+	}
+	return lines
+}
+
+// serviceListLines returns the lines of text listing each service along
+// with its charm and number of units, in the order in which the services
+// were added.
+func (c *Canvas) serviceListLines() []string {
+	var lines []string
+	for _, s := range c.services {
+		if s.offer {
+			continue
+		}
+		units := "units"
+		if s.units == 1 {
+			units = "unit"
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s, %d %s", s.name, s.charmPath, s.units, units))
+	}
+	return lines
+}
+
+// descriptionBlockHeight returns the height of the block showing the
+// given lines of description on an image of the given width.
+func descriptionBlockHeight(lines []string, width int) int {
+	if len(lines) == 0 {
+		return 0
+	}
+	size := captionFontSize(width)
+	return len(lines)*size*3/2 + size
+}
+
+// drawDescription draws the given lines of description in a block across
+// the image of the given width, starting at the given point.
+func drawDescription(canvas *svg.SVG, p image.Point, lines []string, width int) {
+	size := captionFontSize(width)
+	canvas.Textlines(p.X+size, p.Y+size*3/2, lines, size, size*3/2, fontColor, "start")
+}
+
+// MarshalContext is like Marshal, but stops drawing and writing and
+// returns ctx.Err() if ctx is done before the SVG has been written in
+// full, in which case the output will be incomplete.
+func (c *Canvas) MarshalContext(ctx context.Context, w io.Writer) error {
+	cw := &contextWriter{
+		ctx: ctx,
+		w:   w,
+	}
+	c.marshal(ctx, cw, nil)
+	if cw.err != nil {
+		return cw.err
+	}
+	return ctx.Err()
+}
+
+// contextWriter is an io.Writer which discards all writes once its
+// context is done.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+	err error
+}
+
+// Write implements io.Writer.Write.
+func (w *contextWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		w.err = w.ctx.Err()
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	return w.w.Write(p)
+}
+
+// seriesBanner draws a banner naming the series of the bundle across the
+// top of the image, which starts at the given point.
+func (c *Canvas) seriesBanner(canvas *svg.SVG, p image.Point, width int) {
+	canvas.Rect(p.X, p.Y, width, seriesBannerHeight, fmt.Sprintf("fill:%s", escapeString(c.seriesColor)))
+	canvas.Text(p.X+seriesBannerHeight/2, p.Y+seriesBannerHeight/2+6, "series: "+c.series, "font-size:18px;fill:#FFFFFF")
+}
+
+// start begins the SVG document showing the given view box. The root
+// element declares the SVG and XLink namespaces, as modified by any
+// WithNamespace options.
+func (c *Canvas) start(canvas *svg.SVG, viewBox image.Rectangle) {
+	width, height := viewBox.Dx(), viewBox.Dy()
+	attrs := fmt.Sprintf(`style="%s" viewBox="%d %d %d %d"`,
+		c.rootStyle(), viewBox.Min.X, viewBox.Min.Y, width, height)
+	if len(c.namespaces) == 0 {
+		canvas.Start(width, height, attrs)
+		return
+	}
+	// The svg package always declares the default namespaces,
+	// so write the root element directly.
+	namespaces := map[string]string{
+		"":      svgNamespace,
+		"xlink": xlinkNamespace,
+	}
+	for prefix, uri := range c.namespaces {
+		if uri == "" {
+			delete(namespaces, prefix)
+		} else {
+			namespaces[prefix] = uri
+		}
+	}
+	fmt.Fprintf(canvas.Writer, "<?xml version=\"1.0\"?>\n<svg width=\"%d\" height=\"%d\"\n     %s", width, height, attrs)
+	writeNamespaces(canvas, namespaces)
+	io.WriteString(canvas.Writer, ">\n")
+}
+
+// startGroup begins a group holding the diagram, translated so that the
+// top left corner of the given view box lies at the point p of the
+// document in which it is embedded. The group declares only the
+// namespaces added by WithNamespace options, as the document must
+// already declare the SVG and XLink namespaces.
+func (c *Canvas) startGroup(canvas *svg.SVG, viewBox image.Rectangle, p image.Point) {
+	t := p.Sub(viewBox.Min)
+	fmt.Fprintf(canvas.Writer, `<g transform="translate(%d,%d)" style="%s"`, t.X, t.Y, c.rootStyle())
+	namespaces := make(map[string]string)
+	for prefix, uri := range c.namespaces {
+		if uri != "" && prefix != "" && prefix != "xlink" {
+			namespaces[prefix] = uri
+		}
+	}
+	writeNamespaces(canvas, namespaces)
+	io.WriteString(canvas.Writer, ">\n")
+}
+
+// writeNamespaces writes attributes declaring the given namespaces,
+// keyed by prefix, in order of prefix. Prefixes which are not valid XML
+// names without colons, or which are reserved, are ignored.
+func writeNamespaces(canvas *svg.SVG, namespaces map[string]string) {
+	prefixes := make([]string, 0, len(namespaces))
+	for prefix := range namespaces {
+		if prefix != "" && (!isXMLName(prefix) || prefix == "xmlns") {
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		name := "xmlns"
+		if prefix != "" {
+			name += ":" + prefix
+		}
+		fmt.Fprintf(canvas.Writer, "\n     %s=\"%s\"", name, escapeString(namespaces[prefix]))
+	}
+}
+
+// rootStyle returns the style of the element holding the diagram, which
+// holds any rendering hints given by WithRenderingHints so that they are
+// inherited by all elements.
+func (c *Canvas) rootStyle() string {
+	style := "font-family:Ubuntu, sans-serif;"
+	if c.textRendering != "" {
+		style += "text-rendering:" + escapeString(c.textRendering) + ";"
+	}
+	if c.shapeRendering != "" {
+		style += "shape-rendering:" + escapeString(c.shapeRendering) + ";"
+	}
+	return style
 }
 
 // abs returns the absolute value of a number.
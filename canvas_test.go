@@ -2,15 +2,20 @@ package jujusvg
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
+	"fmt"
 	"image"
 	"io"
+	"strconv"
+	"strings"
 
 	"github.com/ajstarks/svgo"
 	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
 
 	"gopkg.in/juju/jujusvg.v1/assets"
+	"gopkg.in/juju/jujusvg.v1/jujusvgtest"
 )
 
 type CanvasSuite struct{}
@@ -53,7 +58,7 @@ func (s *CanvasSuite) TestServiceRender(c *gc.C) {
 				},
 				iconSrc: []byte("<svg>bar</svg>"),
 			},
-			expected: `<svg:svg xmlns:svg="http://www.w3.org/2000/svg" id="icon-1">bar</svg:svg><use x="0" y="0" xlink:href="#serviceBlock" id="bar" />
+			expected: `<svg:svg xmlns:svg="http://www.w3.org/2000/svg" id="icon-1" viewBox="0 0 96 96" preserveAspectRatio="xMidYMid meet">bar</svg:svg><use x="0" y="0" xlink:href="#serviceBlock" id="bar" />
 <use x="46" y="46" xlink:href="#icon-1" width="96" height="96" />
 <g style="font-size:18px;fill:#505050;text-anchor:middle">
 <text x="94" y="31" >bar</text>
@@ -76,11 +81,55 @@ func (s *CanvasSuite) TestServiceRender(c *gc.C) {
 <g style="font-size:18px;fill:#505050;text-anchor:middle">
 <text x="94" y="31" >baz</text>
 </g>
+`,
+		},
+		{
+			about: "Service of another charm with an identical icon",
+			service: service{
+				name:      "quux",
+				charmPath: "quux",
+				point: image.Point{
+					X: 0,
+					Y: 0,
+				},
+				iconSrc: []byte("<svg>bar</svg>"),
+			},
+			expected: `<use x="0" y="0" xlink:href="#serviceBlock" id="quux" />
+<use x="46" y="46" xlink:href="#icon-1" width="96" height="96" />
+<g style="font-size:18px;fill:#505050;text-anchor:middle">
+<text x="94" y="31" >quux</text>
+</g>
+`,
+		},
+		{
+			about: "Service with tinted icon",
+			service: service{
+				name: "qux",
+				point: image.Point{
+					X: 0,
+					Y: 0,
+				},
+				iconUrl: "qux",
+				tint:    "#FF0000",
+			},
+			expected: `<filter id="tint-qux" >
+<feFlood flood-color="#FF0000" flood-opacity="0.5" result="tint" />
+<feComposite in="tint" in2="SourceAlpha" result="tintedIcon"  operator="in" k1="0" k2="0" k3="0" k4="0" />
+<feMerge>
+<feMergeNode in="SourceGraphic"/>
+<feMergeNode in="tintedIcon"/>
+</feMerge>
+</filter>
+<use x="0" y="0" xlink:href="#serviceBlock" id="qux" />
+<image x="46" y="46" width="96" height="96" xlink:href="qux" filter="url(#tint-qux)" />
+<g style="font-size:18px;fill:#505050;text-anchor:middle">
+<text x="94" y="31" >qux</text>
+</g>
 `,
 		},
 	}
 	// Maintain our list of rendered icons outside the loop.
-	iconsRendered := make(map[string]bool)
+	iconsRendered := make(map[string]string)
 	iconIds := make(map[string]string)
 	for _, test := range tests {
 		var buf bytes.Buffer
@@ -91,6 +140,46 @@ func (s *CanvasSuite) TestServiceRender(c *gc.C) {
 	}
 }
 
+func (s *CanvasSuite) TestServiceShapes(c *gc.C) {
+	tests := []struct {
+		shape    Shape
+		expected string
+	}{{
+		shape:    ShapeNone,
+		expected: "",
+	}, {
+		shape: ShapeRect,
+		expected: `<rect x="30" y="30" width="128" height="128" style="fill:#E5E5E5"/>
+`,
+	}, {
+		shape: ShapeHexagon,
+		expected: `<polygon points="158,94 126,149 62,149 30,94 62,39 126,39" style="fill:#E5E5E5"/>
+`,
+	}, {
+		shape: ShapeCylinder,
+		expected: `<path d="M30,46 v96 a64,16 0 0,0 128,0 v-96 a64,16 0 0,0 -128,0 z" style="fill:#E5E5E5"/>
+<ellipse cx="94" cy="46" rx="64" ry="16" style="fill:#E5E5E5;stroke:#FFFFFF;stroke-width:2px"/>
+`,
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: shape %d", i, test.shape)
+		var buf bytes.Buffer
+		svg := svg.New(&buf)
+		svc := service{
+			name:    "foo",
+			iconUrl: "foo",
+			shape:   test.shape,
+		}
+		svc.usage(svg, nil)
+		c.Assert(buf.String(), gc.Equals, `<use x="0" y="0" xlink:href="#serviceBlock" id="foo" />
+`+test.expected+`<image x="46" y="46" width="96" height="96" xlink:href="foo" />
+<g style="font-size:18px;fill:#505050;text-anchor:middle">
+<text x="94" y="31" >foo</text>
+</g>
+`)
+	}
+}
+
 func (s *CanvasSuite) TestRelationRender(c *gc.C) {
 	// Ensure that the Relation's definition and usage methods output the
 	// proper SVG elements.
@@ -118,6 +207,111 @@ func (s *CanvasSuite) TestRelationRender(c *gc.C) {
 `)
 }
 
+func (s *CanvasSuite) TestColoredRelationRender(c *gc.C) {
+	var buf bytes.Buffer
+	svg := svg.New(&buf)
+	relation := serviceRelation{
+		serviceA: &service{
+			point: image.Point{
+				X: 0,
+				Y: 0,
+			},
+		},
+		serviceB: &service{
+			point: image.Point{
+				X: 100,
+				Y: 100,
+			},
+		},
+		color: "#FF0000",
+	}
+	relation.usage(svg)
+	c.Assert(buf.String(), gc.Equals,
+		`<line x1="94" y1="189" x2="100" y2="194" stroke="#FF0000" stroke-width="2px" stroke-dasharray="-6.09, 20" />
+<circle cx="97" cy="191" r="10" style="stroke:#FF0000;fill:none;stroke-width:2px"/>
+<circle cx="97" cy="191" r="5" style="fill:#FF0000"/>
+`)
+}
+
+func (s *CanvasSuite) TestDashedRelationRender(c *gc.C) {
+	var buf bytes.Buffer
+	svg := svg.New(&buf)
+	relation := serviceRelation{
+		serviceA: &service{
+			point: image.Point{
+				X: 0,
+				Y: 0,
+			},
+		},
+		serviceB: &service{
+			point: image.Point{
+				X: 300,
+				Y: 0,
+			},
+		},
+		dash: "5, 3",
+	}
+	relation.usage(svg)
+	c.Assert(buf.String(), gc.Equals,
+		`<line x1="189" y1="94" x2="235" y2="94" stroke="#38B44A" stroke-width="2px" stroke-dasharray="5, 3" />
+<line x1="254" y1="94" x2="300" y2="94" stroke="#38B44A" stroke-width="2px" stroke-dasharray="5, 3" />
+<use x="234" y="84" xlink:href="#healthCircle" />
+`)
+}
+
+func (s *CanvasSuite) TestPerimeterRelation(c *gc.C) {
+	hub := &service{
+		point: image.Point{
+			X: 0,
+			Y: 0,
+		},
+	}
+	tests := []struct {
+		about    string
+		peer     image.Point
+		expected line
+	}{{
+		about: "to the right",
+		peer:  image.Point{X: 400, Y: 0},
+		expected: line{
+			p0: image.Point{X: 188, Y: 94},
+			p1: image.Point{X: 400, Y: 94},
+		},
+	}, {
+		about: "diagonal",
+		peer:  image.Point{X: 400, Y: 200},
+		expected: line{
+			p0: image.Point{X: 188, Y: 141},
+			p1: image.Point{X: 400, Y: 247},
+		},
+	}, {
+		about: "above",
+		peer:  image.Point{X: 100, Y: -400},
+		expected: line{
+			p0: image.Point{X: 118, Y: 0},
+			p1: image.Point{X: 171, Y: -212},
+		},
+	}, {
+		about: "same place",
+		peer:  image.Point{X: 0, Y: 0},
+		expected: line{
+			p0: image.Point{X: 94, Y: 94},
+			p1: image.Point{X: 94, Y: 94},
+		},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		relation := serviceRelation{
+			serviceA: hub,
+			serviceB: &service{
+				point: test.peer,
+			},
+			perimeter: true,
+		}
+		c.Assert(relation.perimeterRelation(), gc.Equals, test.expected)
+	}
+}
+
 func (s *CanvasSuite) TestLayout(c *gc.C) {
 	// Ensure that the SVG is sized exactly around the positioned services.
 	canvas := Canvas{}
@@ -159,6 +353,32 @@ func (s *CanvasSuite) TestLayout(c *gc.C) {
 	c.Assert(height, gc.Equals, 389)
 }
 
+func (s *CanvasSuite) TestLayoutScaledServices(c *gc.C) {
+	// Scaled services are sized about their centers.
+	canvas := Canvas{}
+	canvas.addService(&service{
+		scale: 2,
+	})
+	small := &service{
+		point: image.Point{
+			X: 300,
+			Y: 0,
+		},
+		scale: 0.5,
+	}
+	canvas.addService(small)
+	width, height := canvas.layout()
+	c.Assert(width, gc.Equals, 537)
+	c.Assert(height, gc.Equals, 378)
+	c.Assert(small.bounds(), gc.Equals, image.Rect(442, 142, 537, 237))
+	c.Assert(small.cardinalPoints(), gc.DeepEquals, []image.Point{
+		{489, 142},
+		{442, 189},
+		{489, 237},
+		{537, 189},
+	})
+}
+
 func (s *CanvasSuite) TestMarshal(c *gc.C) {
 	// Ensure that the internal representation of the canvas can be marshalled
 	// to SVG.
@@ -205,7 +425,7 @@ func (s *CanvasSuite) TestMarshal(c *gc.C) {
 <circle cx="10" cy="10" r="10" style="stroke:#38B44A;fill:none;stroke-width:2px"/>
 <circle cx="10" cy="10" r="5" style="fill:#38B44A"/>
 </g>
-<svg xmlns="http://www.w3.org/2000/svg" class="blah" id="icon-1">
+<svg xmlns="http://www.w3.org/2000/svg" class="blah" id="icon-1" viewBox="0 0 96 96" preserveAspectRatio="xMidYMid meet">
 <circle cx="20" cy="20" r="20" style="fill:#000"></circle>
 </svg>
 </defs>
@@ -257,3 +477,1370 @@ func xmlTokens(c *gc.C, data []byte) []xml.Token {
 		toks = append(toks, xml.CopyToken(tok))
 	}
 }
+
+func (s *CanvasSuite) TestStorageBadge(c *gc.C) {
+	var buf bytes.Buffer
+	svg := svg.New(&buf)
+	svc := service{
+		point: image.Point{
+			X: 100,
+			Y: 100,
+		},
+		storageCount: 2,
+	}
+	svc.storageBadge(svg, "#FF0000")
+	c.Assert(buf.String(), gc.Equals,
+		`<path d="M241,128 v20 a12,4 0 0,0 24,0 v-20 a12,4 0 0,0 -24,0 z" style="fill:#FF0000"/>
+<ellipse cx="253" cy="128" rx="12" ry="4" style="fill:#FF0000;stroke:#FFFFFF;stroke-width:1px"/>
+<text x="253" y="142" style="font-size:12px;fill:#FFFFFF;text-anchor:middle">2</text>
+`)
+}
+
+func (s *CanvasSuite) TestMarshalWithNamespaces(c *gc.C) {
+	var buf bytes.Buffer
+	canvas := Canvas{}
+	canvas.addService(&service{
+		name:    "service-a",
+		iconUrl: "a.svg",
+	})
+	WithNamespace("jujusvg", "http://example.com/jujusvg")(&canvas)
+	WithNamespace("xlink", "")(&canvas)
+	// Invalid prefixes are ignored.
+	WithNamespace(`a="x" onload="alert(1)" b`, "http://example.com/bad-wolf")(&canvas)
+	WithNamespace("a:b", "http://example.com/bad-wolf")(&canvas)
+	WithNamespace("xmlns", "http://example.com/bad-wolf")(&canvas)
+	canvas.Marshal(&buf)
+	c.Logf("%s", buf)
+	assertXMLEqual(c, buf.Bytes(), []byte(`
+<?xml version="1.0"?>
+<svg width="189" height="189"
+     style="font-family:Ubuntu, sans-serif;" viewBox="0 0 189 189"
+     xmlns="http://www.w3.org/2000/svg"
+     xmlns:jujusvg="http://example.com/jujusvg">
+<defs>
+<g id="serviceBlock" transform="scale(0.8)" >`+assets.ServiceModule+`
+</g>
+<g id="healthCircle">
+<circle cx="10" cy="10" r="10" style="stroke:#38B44A;fill:none;stroke-width:2px"/>
+<circle cx="10" cy="10" r="5" style="fill:#38B44A"/>
+</g>
+</defs>
+<g id="relations">
+</g>
+<g id="services">
+<use x="0" y="0" xlink:href="#serviceBlock" id="service-a" />
+<image x="46" y="46" width="96" height="96" xlink:href="a.svg" />
+<g style="font-size:18px;fill:#505050;text-anchor:middle">
+<text x="94" y="31" >service-a</text>
+</g>
+</g>
+</svg>
+`))
+}
+
+func (s *CanvasSuite) TestMarshalWithRenderingHints(c *gc.C) {
+	tests := []struct {
+		about          string
+		textRendering  string
+		shapeRendering string
+		expectStyle    string
+	}{{
+		about:       "no hints",
+		expectStyle: `style="font-family:Ubuntu, sans-serif;"`,
+	}, {
+		about:          "both hints",
+		textRendering:  "optimizeLegibility",
+		shapeRendering: "crispEdges",
+		expectStyle:    `style="font-family:Ubuntu, sans-serif;text-rendering:optimizeLegibility;shape-rendering:crispEdges;"`,
+	}, {
+		about:         "text hint only",
+		textRendering: "geometricPrecision",
+		expectStyle:   `style="font-family:Ubuntu, sans-serif;text-rendering:geometricPrecision;"`,
+	}, {
+		about:          "shape hint only",
+		shapeRendering: "geometricPrecision",
+		expectStyle:    `style="font-family:Ubuntu, sans-serif;shape-rendering:geometricPrecision;"`,
+	}, {
+		about:         "escaped hint",
+		textRendering: `"auto"`,
+		expectStyle:   `style="font-family:Ubuntu, sans-serif;text-rendering:&#34;auto&#34;;"`,
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		var buf bytes.Buffer
+		canvas := Canvas{}
+		canvas.addService(&service{
+			name:    "service-a",
+			iconUrl: "a.svg",
+		})
+		WithRenderingHints(test.textRendering, test.shapeRendering)(&canvas)
+		canvas.Marshal(&buf)
+		c.Assert(buf.String(), jc.Contains, `<svg width="189" height="189"
+     `+test.expectStyle+` viewBox="0 0 189 189"`)
+	}
+}
+
+func (s *CanvasSuite) TestConcurrentMarshal(c *gc.C) {
+	canvas := Canvas{}
+	serviceA := &service{
+		name:      "service-a",
+		charmPath: "trusty/svc-a",
+		point: image.Point{
+			X: 50,
+			Y: 50,
+		},
+		iconSrc: []byte(`<svg xmlns="http://www.w3.org/2000/svg"></svg>`),
+	}
+	serviceB := &service{
+		name: "service-b",
+		point: image.Point{
+			X: 150,
+			Y: 150,
+		},
+	}
+	canvas.addService(serviceA)
+	canvas.addService(serviceB)
+	canvas.addRelation(&serviceRelation{
+		serviceA: serviceA,
+		serviceB: serviceB,
+	})
+	var expected bytes.Buffer
+	canvas.Marshal(&expected)
+
+	const n = 10
+	results := make(chan string, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			var buf bytes.Buffer
+			canvas.Marshal(&buf)
+			results <- buf.String()
+		}()
+	}
+	for i := 0; i < n; i++ {
+		c.Assert(<-results, gc.Equals, expected.String())
+	}
+}
+
+func (s *CanvasSuite) TestMarshalWithOrigin(c *gc.C) {
+	var tests = []struct {
+		about     string
+		origin    Origin
+		viewBox   string
+		transform string
+	}{{
+		about:   "top left",
+		origin:  OriginTopLeft,
+		viewBox: "0 0 289 289",
+	}, {
+		about:     "bottom left",
+		origin:    OriginBottomLeft,
+		viewBox:   "0 -289 289 289",
+		transform: "translate(0,-289)",
+	}, {
+		about:     "center",
+		origin:    OriginCenter,
+		viewBox:   "-144 -144 289 289",
+		transform: "translate(-144,-144)",
+	}}
+	for _, test := range tests {
+		c.Logf("test: %s", test.about)
+		canvas := Canvas{}
+		canvas.addService(&service{
+			name: "service-a",
+		})
+		canvas.addService(&service{
+			name: "service-b",
+			point: image.Point{
+				X: 100,
+				Y: 100,
+			},
+		})
+		WithOrigin(test.origin)(&canvas)
+		var buf bytes.Buffer
+		canvas.Marshal(&buf)
+		toks := xmlTokens(c, buf.Bytes())
+		root := toks[2].(xml.StartElement)
+		c.Assert(root.Attr[3].Name.Local, gc.Equals, "viewBox")
+		c.Assert(root.Attr[3].Value, gc.Equals, test.viewBox)
+		var transform string
+		for _, tok := range toks {
+			if el, ok := tok.(xml.StartElement); ok && el.Name.Local == "g" {
+				if len(el.Attr) > 0 && el.Attr[0].Name.Local == "transform" {
+					transform = el.Attr[0].Value
+				}
+			}
+		}
+		c.Assert(transform, gc.Equals, test.transform)
+	}
+}
+
+func (s *CanvasSuite) TestMarshalGroup(c *gc.C) {
+	var tests = []struct {
+		about     string
+		origin    Origin
+		transform string
+	}{{
+		about:     "top left",
+		origin:    OriginTopLeft,
+		transform: "translate(10,20)",
+	}, {
+		about:     "bottom left",
+		origin:    OriginBottomLeft,
+		transform: "translate(10,309)",
+	}, {
+		about:     "center",
+		origin:    OriginCenter,
+		transform: "translate(154,164)",
+	}}
+	for _, test := range tests {
+		c.Logf("test: %s", test.about)
+		canvas := Canvas{}
+		canvas.addService(&service{
+			name:    "service-a",
+			iconUrl: "a.svg",
+		})
+		canvas.addService(&service{
+			name: "service-b",
+			point: image.Point{
+				X: 100,
+				Y: 100,
+			},
+		})
+		WithOrigin(test.origin)(&canvas)
+		WithNamespace("jujusvg", "http://example.com/jujusvg")(&canvas)
+		var buf bytes.Buffer
+		width, height := canvas.MarshalGroup(&buf, image.Pt(10, 20))
+		c.Assert(width, gc.Equals, 289)
+		c.Assert(height, gc.Equals, 289)
+		c.Assert(buf.String(), jc.HasPrefix, `<g transform="`+test.transform+`" style="font-family:Ubuntu, sans-serif;"
+     xmlns:jujusvg="http://example.com/jujusvg">
+<defs>
+`)
+		c.Assert(buf.String(), jc.HasSuffix, "</g>\n</g>\n")
+
+		// The group may be embedded in another document.
+		doc := `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="400" height="400">
+<rect x="0" y="0" width="400" height="400" fill="#FFFFFF"/>
+` + buf.String() + `</svg>
+`
+		c.Assert(doc, jujusvgtest.IsValidSVG)
+	}
+}
+
+func (s *CanvasSuite) TestMarshalWithClip(c *gc.C) {
+	var tests = []struct {
+		about     string
+		origin    Origin
+		viewBox   string
+		transform string
+	}{{
+		about:     "top left",
+		origin:    OriginTopLeft,
+		viewBox:   "0 0 100 50",
+		transform: "translate(-50,-150)",
+	}, {
+		about:     "center",
+		origin:    OriginCenter,
+		viewBox:   "-50 -25 100 50",
+		transform: "translate(-100,-175)",
+	}}
+	for _, test := range tests {
+		c.Logf("test: %s", test.about)
+		canvas := Canvas{series: "trusty"}
+		canvas.addService(&service{
+			name: "service-a",
+		})
+		canvas.addService(&service{
+			name: "service-b",
+			point: image.Point{
+				X: 100,
+				Y: 100,
+			},
+		})
+		WithOrigin(test.origin)(&canvas)
+		WithSeries("")(&canvas)
+		WithClip(image.Rect(150, 200, 50, 150))(&canvas)
+		var buf bytes.Buffer
+		canvas.Marshal(&buf)
+		toks := xmlTokens(c, buf.Bytes())
+		root := toks[2].(xml.StartElement)
+		c.Assert(root.Attr[3].Name.Local, gc.Equals, "viewBox")
+		c.Assert(root.Attr[3].Value, gc.Equals, test.viewBox)
+		var transform, clipPath string
+		var clipRect []xml.Attr
+		for i, tok := range toks {
+			el, ok := tok.(xml.StartElement)
+			if !ok {
+				continue
+			}
+			switch {
+			case el.Name.Local == "g" && len(el.Attr) > 0 && el.Attr[0].Name.Local == "transform":
+				transform = el.Attr[0].Value
+			case el.Name.Local == "g" && len(el.Attr) > 0 && el.Attr[0].Name.Local == "clip-path":
+				clipPath = el.Attr[0].Value
+			case el.Name.Local == "clipPath":
+				for _, tok := range toks[i+1:] {
+					if el, ok := tok.(xml.StartElement); ok {
+						clipRect = el.Attr
+						break
+					}
+				}
+			}
+		}
+		c.Assert(transform, gc.Equals, test.transform)
+		c.Assert(clipPath, gc.Equals, "url(#diagramClip)")
+		c.Assert(clipRect, gc.HasLen, 4)
+		c.Assert([]string{clipRect[0].Value, clipRect[1].Value, clipRect[2].Value, clipRect[3].Value},
+			gc.DeepEquals, []string{"50", "150", "100", "50"})
+		// The series banner is not drawn when clipping.
+		c.Assert(buf.String(), gc.Not(gc.Matches), "(?s).*series: trusty.*")
+	}
+}
+
+func (s *CanvasSuite) TestMarshalContext(c *gc.C) {
+	canvas := Canvas{}
+	canvas.addService(&service{
+		name: "service-a",
+	})
+	var expected bytes.Buffer
+	canvas.Marshal(&expected)
+
+	var buf bytes.Buffer
+	err := canvas.MarshalContext(context.Background(), &buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(buf.String(), gc.Equals, expected.String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	buf.Reset()
+	err = canvas.MarshalContext(ctx, &buf)
+	c.Assert(err, gc.Equals, context.Canceled)
+	c.Assert(buf.Len(), gc.Equals, 0)
+}
+
+func (s *CanvasSuite) TestMarshalStopsWhenContextDone(c *gc.C) {
+	canvas := Canvas{}
+	serviceA := &service{name: "service-a"}
+	serviceB := &service{name: "service-b", point: point(200, 0)}
+	canvas.addService(serviceA)
+	canvas.addService(serviceB)
+	canvas.addRelation(&serviceRelation{
+		serviceA: serviceA,
+		serviceB: serviceB,
+	})
+
+	// Cancel the context once the relations have been drawn.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var buf bytes.Buffer
+	w := writerFunc(func(p []byte) (int, error) {
+		n, err := buf.Write(p)
+		if bytes.Contains(buf.Bytes(), []byte(`id="relations"`)) {
+			cancel()
+		}
+		return n, err
+	})
+	canvas.marshal(ctx, w, nil)
+	c.Assert(buf.String(), gc.Matches, `(?s).*id="relations".*`)
+	c.Assert(buf.String(), gc.Not(gc.Matches), `(?s).*id="services".*`)
+	c.Assert(buf.String(), gc.Not(gc.Matches), `(?s).*service-a.*`)
+}
+
+// writerFunc implements io.Writer with a function.
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func (s *CanvasSuite) TestMarshalWithRelationsInFront(c *gc.C) {
+	for _, inFront := range []bool{false, true} {
+		c.Logf("relations in front: %v", inFront)
+		canvas := Canvas{}
+		if inFront {
+			WithRelationsInFront()(&canvas)
+		}
+		var buf bytes.Buffer
+		canvas.Marshal(&buf)
+		var groups []string
+		for _, tok := range xmlTokens(c, buf.Bytes()) {
+			if el, ok := tok.(xml.StartElement); ok && el.Name.Local == "g" {
+				for _, attr := range el.Attr {
+					if attr.Name.Local == "id" && (attr.Value == "relations" || attr.Value == "services") {
+						groups = append(groups, attr.Value)
+					}
+				}
+			}
+		}
+		if inFront {
+			c.Assert(groups, gc.DeepEquals, []string{"services", "relations"})
+		} else {
+			c.Assert(groups, gc.DeepEquals, []string{"relations", "services"})
+		}
+	}
+}
+
+func (s *CanvasSuite) TestMarshalWithAspectRatio(c *gc.C) {
+	var tests = []struct {
+		about         string
+		width, height int
+		expect        string
+	}{{
+		about:  "pillarbox",
+		width:  16,
+		height: 9,
+		expect: `<svg width="336" height="189"
+     style="font-family:Ubuntu, sans-serif;" viewBox="-73 0 336 189"`,
+	}, {
+		about:  "letterbox",
+		width:  9,
+		height: 16,
+		expect: `<svg width="189" height="336"
+     style="font-family:Ubuntu, sans-serif;" viewBox="0 -73 189 336"`,
+	}, {
+		about:  "uneven padding",
+		width:  2,
+		height: 1,
+		expect: `<svg width="378" height="189"
+     style="font-family:Ubuntu, sans-serif;" viewBox="-94 0 378 189"`,
+	}, {
+		about:  "matching ratio",
+		width:  1,
+		height: 1,
+		expect: `<svg width="189" height="189"
+     style="font-family:Ubuntu, sans-serif;" viewBox="0 0 189 189"`,
+	}, {
+		about:  "invalid ratio",
+		width:  0,
+		height: 1,
+		expect: `<svg width="189" height="189"
+     style="font-family:Ubuntu, sans-serif;" viewBox="0 0 189 189"`,
+	}}
+	for _, test := range tests {
+		c.Logf("test: %s", test.about)
+		canvas := Canvas{}
+		canvas.addService(&service{
+			name: "service-a",
+		})
+		WithAspectRatio(test.width, test.height)(&canvas)
+		var buf bytes.Buffer
+		canvas.Marshal(&buf)
+		c.Assert(buf.String(), jc.Contains, test.expect)
+	}
+}
+
+func (s *CanvasSuite) TestMarshalWithMiniMap(c *gc.C) {
+	canvas := Canvas{}
+	serviceA := &service{
+		name: "service-a",
+	}
+	serviceB := &service{
+		name: "service-b",
+		point: image.Point{
+			X: 811,
+			Y: 311,
+		},
+	}
+	canvas.addService(serviceA)
+	canvas.addService(serviceB)
+	canvas.addRelation(&serviceRelation{
+		serviceA: serviceA,
+		serviceB: serviceB,
+	})
+	WithClip(image.Rect(0, 0, 300, 200))(&canvas)
+	WithMiniMap()(&canvas)
+	var buf bytes.Buffer
+	canvas.Marshal(&buf)
+	var transform string
+	var elements []string
+	depth := 0
+	for _, tok := range xmlTokens(c, buf.Bytes()) {
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if depth > 0 {
+				depth++
+				elements = append(elements, tok.Name.Local)
+				continue
+			}
+			if tok.Name.Local == "g" && len(tok.Attr) == 2 && tok.Attr[0].Value == "miniMap" {
+				transform = tok.Attr[1].Value
+				depth = 1
+			}
+		case xml.EndElement:
+			if depth > 0 {
+				depth--
+			}
+		}
+	}
+	c.Assert(transform, gc.Equals, "translate(90,90) scale(0.2)")
+	// The background, the relation, both services and the
+	// outline of the clipped region.
+	c.Assert(elements, gc.DeepEquals, []string{"rect", "line", "rect", "rect", "rect"})
+}
+
+func (s *CanvasSuite) TestMarshalWithoutMiniMap(c *gc.C) {
+	canvas := Canvas{}
+	canvas.addService(&service{
+		name: "service-a",
+	})
+	var buf bytes.Buffer
+	canvas.Marshal(&buf)
+	c.Assert(buf.String(), gc.Not(jc.Contains), `id="miniMap"`)
+}
+
+func (s *CanvasSuite) TestMarshalWithDescription(c *gc.C) {
+	canvas := Canvas{
+		description: "A bundle which <deploys> a search engine backed by a document store.\nSecond  paragraph.",
+		tags:        []string{"search", "database"},
+	}
+	canvas.addService(&service{
+		name: "service-a",
+	})
+	canvas.addService(&service{
+		name: "service-b",
+		point: image.Point{
+			X: 100,
+			Y: 100,
+		},
+	})
+	WithDescription()(&canvas)
+	var buf bytes.Buffer
+	canvas.Marshal(&buf)
+	c.Assert(buf.String(), jc.Contains, `<svg width="289" height="373"`)
+	c.Assert(buf.String(), jc.Contains, `<g style="font-size:12px;fill:#505050;text-anchor:start">
+<text x="12" y="18" >A bundle which &lt;deploys&gt; a search engine</text>
+<text x="12" y="36" >backed by a document store.</text>
+<text x="12" y="54" >Second paragraph.</text>
+<text x="12" y="72" >tags: search, database</text>
+</g>`)
+	c.Assert(buf.String(), jc.Contains, `<g transform="translate(0,84)">`)
+}
+
+func (s *CanvasSuite) TestMarshalWithEmptyDescription(c *gc.C) {
+	canvas := Canvas{}
+	canvas.addService(&service{
+		name: "service-a",
+	})
+	WithDescription()(&canvas)
+	var buf bytes.Buffer
+	canvas.Marshal(&buf)
+	c.Assert(buf.String(), jc.Contains, `<svg width="189" height="189"`)
+	c.Assert(buf.String(), gc.Not(jc.Contains), `<g transform="translate(`)
+}
+
+func (s *CanvasSuite) TestMarshalWithServiceList(c *gc.C) {
+	canvas := Canvas{}
+	canvas.addService(&service{
+		name:      "service-a",
+		charmPath: "trusty/service-a-1",
+		units:     1,
+	})
+	canvas.addService(&service{
+		name:      "service-b",
+		charmPath: "trusty/service-b-2",
+		units:     3,
+		point: image.Point{
+			X: 100,
+			Y: 100,
+		},
+	})
+	canvas.addService(&service{
+		name:  "prod.offer",
+		offer: true,
+		point: image.Point{
+			X: 100,
+			Y: 0,
+		},
+	})
+	WithServiceList()(&canvas)
+	WithCaption("caption", CaptionBottomLeft)(&canvas)
+	var buf bytes.Buffer
+	canvas.Marshal(&buf)
+	c.Assert(buf.String(), jc.Contains, `<svg width="289" height="361"`)
+	c.Assert(buf.String(), jc.Contains, `<g id="serviceList">
+<g style="font-size:12px;fill:#505050;text-anchor:start">
+<text x="12" y="307" >service-a: trusty/service-a-1, 1 unit</text>
+<text x="12" y="325" >service-b: trusty/service-b-2, 3 units</text>
+</g>
+</g>`)
+	// The caption is shown below the list.
+	c.Assert(buf.String(), jc.Contains, `<text x="12" y="353" style="font-size:12px;fill:#505050;text-anchor:start">caption</text>`)
+	xmlTokens(c, buf.Bytes())
+}
+
+func (s *CanvasSuite) TestMarshalService(c *gc.C) {
+	canvas := Canvas{}
+	canvas.addService(&service{
+		name:    "service-a",
+		iconSrc: []byte(`<svg xmlns="http://www.w3.org/2000/svg"><circle r="1"/></svg>`),
+		point: image.Point{
+			X: 100,
+			Y: 50,
+		},
+		charmPath:    "trusty/service-a-1",
+		storageCount: 1,
+	})
+	canvas.addService(&service{
+		name:          "service-b",
+		iconSrc:       []byte(`<svg xmlns="http://www.w3.org/2000/svg"><rect/></svg>`),
+		charmPath:     "trusty/service-b-1",
+		labelPosition: LabelBelow,
+	})
+	WithStorageBadges("")(&canvas)
+
+	var buf bytes.Buffer
+	err := canvas.MarshalService(&buf, "service-a")
+	c.Assert(err, gc.IsNil)
+	c.Assert(buf.String(), jc.Contains, `<svg width="189" height="189"`)
+	c.Assert(buf.String(), jc.Contains, `<circle r="1">`)
+	c.Assert(buf.String(), gc.Not(jc.Contains), `<rect></rect>`)
+	c.Assert(buf.String(), jc.Contains, `<g transform="translate(-100,-50)">
+<use x="100" y="50" xlink:href="#serviceBlock" id="service-a" />`)
+	c.Assert(buf.String(), jc.Contains, `<path d="M241,78 `)
+	xmlTokens(c, buf.Bytes())
+
+	// Room is left for labels outside the service.
+	buf.Reset()
+	err = canvas.MarshalService(&buf, "service-b")
+	c.Assert(err, gc.IsNil)
+	c.Assert(buf.String(), jc.Contains, `<svg width="189" height="213"`)
+
+	err = canvas.MarshalService(&buf, "service-c")
+	c.Assert(err, gc.ErrorMatches, `service "service-c" not found`)
+}
+
+func (s *CanvasSuite) TestShortLabel(c *gc.C) {
+	var tests = []struct {
+		name   string
+		max    int
+		expect string
+	}{{
+		name:   "mysql",
+		max:    0,
+		expect: "",
+	}, {
+		name:   "a-very-long-service-name",
+		max:    0,
+		expect: "a-very-long-servi…",
+	}, {
+		name:   "a-very-long-service-name",
+		max:    -1,
+		expect: "",
+	}, {
+		name:   "wordpress",
+		max:    9,
+		expect: "",
+	}, {
+		name:   "wordpress",
+		max:    5,
+		expect: "word…",
+	}, {
+		name:   "ünïcödé-sërvïcé",
+		max:    8,
+		expect: "ünïcödé…",
+	}}
+	for _, test := range tests {
+		c.Logf("test: %q, %d", test.name, test.max)
+		c.Assert(shortLabel(test.name, test.max), gc.Equals, test.expect)
+	}
+}
+
+func (s *CanvasSuite) TestShortLabelRender(c *gc.C) {
+	var buf bytes.Buffer
+	svg := svg.New(&buf)
+	serviceA := &service{
+		name:  "service-a",
+		label: "serv…",
+	}
+	serviceA.usage(svg, map[string]string{})
+	c.Assert(buf.String(), gc.Equals,
+		`<use x="0" y="0" xlink:href="#serviceBlock" id="service-a" />
+<image x="46" y="46" width="96" height="96" xlink:href="" />
+<g style="font-size:18px;fill:#505050;text-anchor:middle">
+<title>service-a</title>
+<text x="94" y="31" >serv…</text>
+</g>
+`)
+}
+
+func (s *CanvasSuite) TestSlug(c *gc.C) {
+	var tests = []struct {
+		s      string
+		expect string
+	}{
+		{"trusty/mysql-23", "trusty-mysql-23"},
+		{"~charming-devs/precise/elasticsearch-2", "charming-devs-precise-elasticsearch-2"},
+		{"Trusty//MySQL__23/", "trusty-mysql-23"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		c.Assert(slug(test.s), gc.Equals, test.expect, gc.Commentf("%q", test.s))
+	}
+}
+
+func (s *CanvasSuite) TestMarshalWithReadableIds(c *gc.C) {
+	canvas := Canvas{}
+	for _, path := range []string{"trusty/mysql-23", "~trusty/mysql-23", "trusty/mysql-23", "trusty/wordpress-1"} {
+		canvas.addService(&service{
+			name:      "service-" + strconv.Itoa(len(canvas.services)),
+			charmPath: path,
+			iconSrc:   []byte(`<svg xmlns="http://www.w3.org/2000/svg"><title>` + path + `</title></svg>`),
+		})
+	}
+	WithReadableIds()(&canvas)
+	var buf bytes.Buffer
+	canvas.Marshal(&buf)
+	var ids []string
+	for _, tok := range xmlTokens(c, buf.Bytes()) {
+		if el, ok := tok.(xml.StartElement); ok && el.Name.Local == "svg" {
+			for _, attr := range el.Attr {
+				if attr.Name.Local == "id" {
+					ids = append(ids, attr.Value)
+				}
+			}
+		}
+	}
+	c.Assert(ids, gc.DeepEquals, []string{"icon-trusty-mysql-23", "icon-trusty-mysql-23-2", "icon-trusty-wordpress-1"})
+	c.Assert(buf.String(), jc.Contains, `xlink:href="#icon-trusty-mysql-23-2"`)
+}
+
+func (s *CanvasSuite) TestMarshalWithCaption(c *gc.C) {
+	var tests = []struct {
+		about     string
+		position  CaptionPosition
+		text      string
+		transform string
+	}{{
+		about:    "bottom right",
+		position: CaptionBottomRight,
+		text:     `<text x="277" y="305" style="font-size:12px;fill:#505050;text-anchor:end">as of &lt;now&gt;</text>`,
+	}, {
+		about:    "bottom left",
+		position: CaptionBottomLeft,
+		text:     `<text x="12" y="305" style="font-size:12px;fill:#505050;text-anchor:start">as of &lt;now&gt;</text>`,
+	}, {
+		about:     "top left",
+		position:  CaptionTopLeft,
+		text:      `<text x="12" y="16" style="font-size:12px;fill:#505050;text-anchor:start">as of &lt;now&gt;</text>`,
+		transform: `<g transform="translate(0,24)">`,
+	}, {
+		about:     "top right",
+		position:  CaptionTopRight,
+		text:      `<text x="277" y="16" style="font-size:12px;fill:#505050;text-anchor:end">as of &lt;now&gt;</text>`,
+		transform: `<g transform="translate(0,24)">`,
+	}}
+	for _, test := range tests {
+		c.Logf("test: %s", test.about)
+		canvas := Canvas{}
+		canvas.addService(&service{
+			name: "service-a",
+		})
+		canvas.addService(&service{
+			name: "service-b",
+			point: image.Point{
+				X: 100,
+				Y: 100,
+			},
+		})
+		WithCaption("as of <now>", test.position)(&canvas)
+		var buf bytes.Buffer
+		canvas.Marshal(&buf)
+		// The image is extended to make room for the caption.
+		c.Assert(buf.String(), jc.Contains, `viewBox="0 0 289 313"`)
+		c.Assert(buf.String(), jc.Contains, test.text)
+		if test.transform != "" {
+			c.Assert(buf.String(), jc.Contains, test.transform)
+		} else {
+			c.Assert(buf.String(), gc.Not(jc.Contains), `<g transform="translate(`)
+		}
+	}
+}
+
+func (s *CanvasSuite) TestServiceAttributes(c *gc.C) {
+	canvas := Canvas{}
+	canvas.addService(&service{
+		name:    "service-a",
+		iconUrl: "a",
+		attrs: map[string]string{
+			"data-name":  "service-a",
+			"data-charm": `cs:"a"&<b>`,
+			"bad name":   "x",
+			"2bad":       "x",
+			"":           "x",
+		},
+	})
+	canvas.addService(&service{
+		name:    "service-b",
+		iconUrl: "b",
+	})
+	var buf bytes.Buffer
+	canvas.Marshal(&buf)
+	c.Assert(buf.String(), jc.Contains, `<g data-charm="cs:&#34;a&#34;&amp;&lt;b&gt;" data-name="service-a" >
+<use x="0" y="0" xlink:href="#serviceBlock" id="service-a" />`)
+	c.Assert(buf.String(), gc.Not(jc.Contains), "bad")
+	// Services without attributes are not grouped.
+	c.Assert(buf.String(), jc.Contains, `</g>
+<use x="0" y="0" xlink:href="#serviceBlock" id="service-b" />`)
+}
+
+func (s *CanvasSuite) TestMalformedIconDefinition(c *gc.C) {
+	var buf bytes.Buffer
+	svg := svg.New(&buf)
+	svc := service{
+		name:      "foo",
+		charmPath: "foo",
+		iconSrc:   []byte("<svg><g></svg>"),
+	}
+	err := svc.definition(svg, make(map[string]string), make(map[string]string))
+	c.Assert(err, gc.ErrorMatches, "cannot get token: .*")
+	// The placeholder is written in place of the icon.
+	var expected bytes.Buffer
+	err = processIcon(strings.NewReader(placeholderIcon), &expected, "icon-1")
+	c.Assert(err, gc.IsNil)
+	c.Assert(buf.String(), gc.Equals, expected.String())
+}
+
+func (s *CanvasSuite) TestLabelPosition(c *gc.C) {
+	tests := []struct {
+		position LabelPosition
+		label    string
+		height   int
+		y        int
+	}{{
+		position: LabelInside,
+		label:    `<text x="94" y="31" >foo</text>`,
+		height:   189,
+	}, {
+		position: LabelAbove,
+		label:    `<text x="94" y="18" >foo</text>`,
+		height:   213,
+		y:        24,
+	}, {
+		position: LabelBelow,
+		label:    `<text x="94" y="207" >foo</text>`,
+		height:   213,
+	}, {
+		position: LabelNone,
+		height:   189,
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: position %d", i, test.position)
+		canvas := Canvas{}
+		WithLabelPosition(test.position)(&canvas)
+		svc := &service{
+			name:          "foo",
+			iconUrl:       "foo",
+			labelPosition: test.position,
+		}
+		canvas.addService(svc)
+		width, height := canvas.layout()
+		c.Assert(width, gc.Equals, 189)
+		c.Assert(height, gc.Equals, test.height)
+		c.Assert(svc.point, gc.Equals, image.Point{0, test.y})
+
+		var buf bytes.Buffer
+		svc.usage(svg.New(&buf), nil)
+		if test.label == "" {
+			c.Assert(buf.String(), gc.Not(jc.Contains), "<text")
+		} else {
+			c.Assert(buf.String(), jc.Contains, test.label)
+		}
+	}
+}
+
+func (s *CanvasSuite) TestStrokeDashArray(c *gc.C) {
+	l := line{
+		p0: image.Point{0, 0},
+		p1: image.Point{100, 45},
+	}
+	var tests = []struct {
+		about        string
+		formatLength func(float64) string
+		expect       string
+	}{{
+		about:  "default precision",
+		expect: "44.83, 20",
+	}, {
+		about: "whole pixels",
+		formatLength: func(x float64) string {
+			return strconv.FormatFloat(x, 'f', 0, 64)
+		},
+		expect: "45, 20",
+	}, {
+		about: "one decimal place",
+		formatLength: func(x float64) string {
+			return strconv.FormatFloat(x, 'f', 1, 64)
+		},
+		expect: "44.8, 20",
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		c.Assert(strokeDashArray(l, test.formatLength), gc.Equals, test.expect)
+	}
+}
+
+func (s *CanvasSuite) TestMarshalDimmed(c *gc.C) {
+	serviceA := &service{
+		name:  "service-a",
+		point: image.Point{0, 0},
+	}
+	serviceB := &service{
+		name:   "service-b",
+		point:  image.Point{0, 300},
+		dimmed: true,
+	}
+	canvas := Canvas{}
+	canvas.addService(serviceA)
+	canvas.addService(serviceB)
+	canvas.addRelation(&serviceRelation{
+		serviceA: serviceA,
+		serviceB: serviceB,
+		dimmed:   true,
+	})
+
+	var buf bytes.Buffer
+	canvas.Marshal(&buf)
+	c.Assert(buf.String(), jc.Contains, `<g id="relations">
+<g opacity="0.2" >
+<line `)
+	c.Assert(buf.String(), jc.Contains, `<use x="0" y="0" xlink:href="#serviceBlock" id="service-a" />`)
+	c.Assert(buf.String(), jc.Contains, `<g opacity="0.2" >
+<use x="0" y="300" xlink:href="#serviceBlock" id="service-b" />`)
+	xmlTokens(c, buf.Bytes())
+}
+
+func (s *CanvasSuite) TestMarshalRelationGradients(c *gc.C) {
+	serviceA := &service{
+		name:  "service-a",
+		point: image.Point{0, 0},
+		tint:  "#FF0000",
+	}
+	serviceB := &service{
+		name:  "service-b",
+		point: image.Point{0, 300},
+	}
+	serviceC := &service{
+		name:   "service-c",
+		point:  image.Point{300, 0},
+		status: diffAdded,
+	}
+	canvas := Canvas{}
+	WithRelationGradients()(&canvas)
+	canvas.addService(serviceA)
+	canvas.addService(serviceB)
+	canvas.addService(serviceC)
+	canvas.addRelation(&serviceRelation{
+		serviceA: serviceA,
+		serviceB: serviceB,
+	})
+	canvas.addRelation(&serviceRelation{
+		serviceA: serviceA,
+		serviceB: serviceC,
+		dash:     "4,2",
+	})
+	canvas.addRelation(&serviceRelation{
+		serviceA: serviceB,
+		serviceB: serviceC,
+		status:   diffAdded,
+	})
+
+	var buf bytes.Buffer
+	canvas.Marshal(&buf)
+	c.Assert(buf.String(), jc.Contains, `<linearGradient id="relationGradient0" gradientUnits="userSpaceOnUse" x1="94" y1="189" x2="94" y2="300">
+<stop offset="0%" stop-color="#FF0000" />
+<stop offset="100%" stop-color="#38B44A" />
+</linearGradient>
+<linearGradient id="relationGradient1" gradientUnits="userSpaceOnUse" x1="189" y1="94" x2="300" y2="94">
+<stop offset="0%" stop-color="#FF0000" />
+<stop offset="100%" stop-color="`+addedColor+`" />
+</linearGradient>
+`)
+	c.Assert(buf.String(), gc.Not(jc.Contains), `id="relationGradient2"`)
+	c.Assert(buf.String(), jc.Contains, `<line x1="94" y1="189" x2="94" y2="300" stroke="url(#relationGradient0)" `)
+	c.Assert(buf.String(), jc.Contains, `stroke="url(#relationGradient1)" stroke-width="2px" stroke-dasharray="4,2" />`)
+	c.Assert(buf.String(), jc.Contains, `stroke="`+addedColor+`" stroke-width="2px"`)
+	xmlTokens(c, buf.Bytes())
+}
+
+func (s *CanvasSuite) TestMarshalSelfRelation(c *gc.C) {
+	serviceA := &service{
+		name:  "service-a",
+		point: image.Point{0, 0},
+	}
+	canvas := Canvas{}
+	canvas.addService(serviceA)
+	canvas.addRelation(&serviceRelation{
+		serviceA: serviceA,
+		serviceB: serviceA,
+	})
+	canvas.addRelation(&serviceRelation{
+		serviceA: serviceA,
+		serviceB: serviceA,
+		color:    "#FF0000",
+		dash:     "4,2",
+	})
+
+	var buf bytes.Buffer
+	canvas.Marshal(&buf)
+	// Room is left for the loops above and to the right of the service.
+	c.Assert(buf.String(), jc.Contains, `<svg width="236" height="236"`)
+	c.Assert(buf.String(), jc.Contains, `<path d="M142,47 A47,47 0 0,1 214,7 M229,22 A47,47 0 0,1 189,94" fill="none" stroke="#38B44A" stroke-width="2px" />
+<use x="212" y="4" xlink:href="#healthCircle" />
+<path d="M142,47 A47,47 0 0,1 214,7 M229,22 A47,47 0 0,1 189,94" fill="none" stroke="#FF0000" stroke-width="2px" stroke-dasharray="4,2" />
+<circle cx="222" cy="14" r="10" style="stroke:#FF0000;fill:none;stroke-width:2px"/>`)
+	xmlTokens(c, buf.Bytes())
+}
+
+func (s *CanvasSuite) TestMarshalIconShadows(c *gc.C) {
+	canvas := Canvas{}
+	WithIconShadows(IconShadow{
+		Blur:   2,
+		Offset: image.Point{3, 4},
+	})(&canvas)
+	canvas.addService(&service{
+		name:    "service-a",
+		iconUrl: "http://0.1.2.3/a.svg",
+		tint:    "#FF0000",
+		shadow:  true,
+	})
+
+	var buf bytes.Buffer
+	canvas.Marshal(&buf)
+	c.Assert(buf.String(), jc.Contains, `<filter id="iconShadow" x="-11%" y="-11%" width="122%" height="122%" >
+<feGaussianBlur in="SourceAlpha" result="blur"  stdDeviation="2 2" />
+<feOffset in="blur" result="offset"  dx="3" dy="4" />
+<feFlood flood-color="#000000" flood-opacity="0.3" result="color" />`)
+	// The shadow applies to the tinted icon.
+	c.Assert(buf.String(), jc.Contains, `<g filter="url(#iconShadow)" >
+<image x="46" y="46" width="96" height="96" xlink:href="http://0.1.2.3/a.svg" filter="url(#tint-service-a)" />
+</g>`)
+	// The shadow fits within the service block.
+	c.Assert(buf.String(), jc.Contains, `<svg width="189" height="189"`)
+	xmlTokens(c, buf.Bytes())
+
+	// Room is left for shadows reaching beyond the service block.
+	WithIconShadows(IconShadow{
+		Color:  "#0000FF",
+		Offset: image.Point{-50, 0},
+	})(&canvas)
+	buf.Reset()
+	canvas.Marshal(&buf)
+	c.Assert(buf.String(), jc.Contains, `<svg width="197" height="197"`)
+	c.Assert(buf.String(), jc.Contains, `<filter id="iconShadow" x="-53%" y="-53%" width="206%" height="206%" >
+<feOffset in="SourceAlpha" result="offset"  dx="-50" dy="0" />
+<feFlood flood-color="#0000FF" flood-opacity="0.3" result="color" />`)
+	c.Assert(buf.String(), jc.Contains, `<image x="50" y="50" width="96" height="96"`)
+
+	buf.Reset()
+	err := canvas.MarshalService(&buf, "service-a")
+	c.Assert(err, gc.IsNil)
+	c.Assert(buf.String(), jc.Contains, `<svg width="197" height="197"`)
+	c.Assert(buf.String(), jc.Contains, `<filter id="iconShadow" `)
+}
+
+func (s *CanvasSuite) TestServiceModelLabel(c *gc.C) {
+	var tests = []struct {
+		about          string
+		labelPosition  LabelPosition
+		expectHeight   int
+		expectName     string
+		expectModel    string
+		expectNoModels bool
+	}{{
+		about:        "inside",
+		expectHeight: 189,
+		expectName:   `<text x="94" y="31" >service-a</text>`,
+		expectModel:  `<text x="94" y="45" style="font-size:12px;fill:#888888;text-anchor:middle">production</text>`,
+	}, {
+		about:         "above",
+		labelPosition: LabelAbove,
+		expectHeight:  189 + 24 + 14,
+		expectName:    `<text x="94" y="18" >service-a</text>`,
+		expectModel:   `<text x="94" y="32" style="font-size:12px;fill:#888888;text-anchor:middle">production</text>`,
+	}, {
+		about:         "below",
+		labelPosition: LabelBelow,
+		expectHeight:  189 + 24 + 14,
+		expectName:    `<text x="94" y="207" >service-a</text>`,
+		expectModel:   `<text x="94" y="221" style="font-size:12px;fill:#888888;text-anchor:middle">production</text>`,
+	}, {
+		about:          "none",
+		labelPosition:  LabelNone,
+		expectHeight:   189,
+		expectNoModels: true,
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		canvas := Canvas{
+			labelPosition: test.labelPosition,
+		}
+		canvas.addService(&service{
+			name:          "service-a",
+			hideIcon:      true,
+			labelPosition: test.labelPosition,
+			model:         "production",
+		})
+		var buf bytes.Buffer
+		canvas.Marshal(&buf)
+		c.Assert(buf.String(), jc.Contains, fmt.Sprintf(`<svg width="189" height="%d"`, test.expectHeight))
+		if test.expectNoModels {
+			c.Assert(buf.String(), gc.Not(jc.Contains), "production")
+			continue
+		}
+		c.Assert(buf.String(), jc.Contains, test.expectName)
+		c.Assert(buf.String(), jc.Contains, test.expectModel)
+		xmlTokens(c, buf.Bytes())
+	}
+}
+
+func (s *CanvasSuite) TestOrderedRelations(c *gc.C) {
+	serviceA := &service{name: "service-a"}
+	serviceB := &service{name: "service-b"}
+	canvas := Canvas{}
+	for _, name := range []string{"db", "", "http", "website", "db"} {
+		canvas.addRelation(&serviceRelation{
+			serviceA:      serviceA,
+			serviceB:      serviceB,
+			interfaceName: name,
+		})
+	}
+	order := func() []int {
+		var order []int
+		for _, r := range canvas.orderedRelations() {
+			for i, added := range canvas.relations {
+				if r == added {
+					order = append(order, i)
+				}
+			}
+		}
+		return order
+	}
+	c.Assert(order(), jc.DeepEquals, []int{0, 1, 2, 3, 4})
+
+	WithRelationPriority(func(interfaceName string) int {
+		switch interfaceName {
+		case "db":
+			return 2
+		case "http", "website":
+			return 1
+		}
+		return 0
+	})(&canvas)
+	c.Assert(order(), jc.DeepEquals, []int{1, 2, 3, 0, 4})
+	// The relations themselves are left in the order added.
+	c.Assert(canvas.relations[0].interfaceName, gc.Equals, "db")
+}
+
+func (s *CanvasSuite) TestWithPadding(c *gc.C) {
+	var tests = []struct {
+		about  string
+		values []int
+		expect padding
+	}{{
+		about: "no values",
+	}, {
+		about:  "one value",
+		values: []int{10},
+		expect: padding{10, 10, 10, 10},
+	}, {
+		about:  "two values",
+		values: []int{10, 20},
+		expect: padding{10, 20, 10, 20},
+	}, {
+		about:  "three values",
+		values: []int{10, 20, 30},
+		expect: padding{10, 20, 30, 20},
+	}, {
+		about:  "four values",
+		values: []int{10, 20, 30, 40},
+		expect: padding{10, 20, 30, 40},
+	}, {
+		about:  "extra values",
+		values: []int{10, 20, 30, 40, 50},
+		expect: padding{10, 20, 30, 40},
+	}, {
+		about:  "negative values",
+		values: []int{-10, 20},
+		expect: padding{0, 20, 0, 20},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		var canvas Canvas
+		WithPadding(test.values...)(&canvas)
+		c.Assert(canvas.padding, gc.Equals, test.expect)
+	}
+}
+
+func (s *CanvasSuite) TestLayoutWithPadding(c *gc.C) {
+	canvas := Canvas{
+		labelPosition: LabelAbove,
+	}
+	WithPadding(10, 20, 30, 40)(&canvas)
+	svc := &service{
+		name:          "service-a",
+		point:         image.Point{100, 100},
+		labelPosition: LabelAbove,
+	}
+	canvas.addService(svc)
+	width, height := canvas.layout()
+	c.Assert(width, gc.Equals, 189+20+40)
+	c.Assert(height, gc.Equals, 189+labelFontSize+labelGap+10+30)
+	c.Assert(svc.point, gc.Equals, image.Point{40, 10 + labelFontSize + labelGap})
+}
+
+func (s *CanvasSuite) TestWeighRelations(c *gc.C) {
+	weights := map[string]float64{
+		"a": 0,
+		"b": 9,
+		"c": 99,
+	}
+	var tests = []struct {
+		about  string
+		scale  WeightScale
+		min    float64
+		max    float64
+		expect map[string]string
+	}{{
+		about: "linear",
+		scale: LinearWeights,
+		min:   1,
+		max:   12,
+		expect: map[string]string{
+			"a": "1",
+			"b": "2",
+			"c": "12",
+			"":  "2",
+		},
+	}, {
+		about: "log",
+		scale: LogWeights,
+		min:   1,
+		max:   3,
+		expect: map[string]string{
+			"a": "1",
+			"b": "2",
+			"c": "3",
+			"":  "2",
+		},
+	}, {
+		about: "invalid range",
+		scale: LinearWeights,
+		min:   3,
+		max:   1,
+		expect: map[string]string{
+			"a": "2",
+			"b": "2",
+			"c": "2",
+			"":  "2",
+		},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		var canvas Canvas
+		WithRelationWeights(func(endpoints []string) (float64, bool) {
+			w, ok := weights[endpointsInterface(endpoints)]
+			return w, ok
+		}, test.min, test.max, test.scale)(&canvas)
+		services := map[string]*service{
+			"service-a": {name: "service-a"},
+			"service-b": {name: "service-b"},
+		}
+		for _, name := range []string{"a", "b", "c", ""} {
+			endpoints := []string{"service-a", "service-b"}
+			if name != "" {
+				endpoints = []string{"service-a:" + name, "service-b:" + name}
+			}
+			r, err := canvas.newRelation(endpoints, services)
+			c.Assert(err, gc.IsNil)
+			canvas.addRelation(r)
+		}
+		canvas.weighRelations()
+		widths := make(map[string]string)
+		for _, r := range canvas.relations {
+			widths[r.interfaceName] = r.strokeWidth()
+		}
+		c.Assert(widths, jc.DeepEquals, test.expect)
+	}
+}
+
+func (s *CanvasSuite) TestRelationStrokeWidth(c *gc.C) {
+	r := serviceRelation{}
+	c.Assert(r.strokeWidth(), gc.Equals, "2")
+	r.width = 3.14159
+	c.Assert(r.strokeWidth(), gc.Equals, "3.14")
+	r.formatLength = func(x float64) string {
+		return strconv.FormatFloat(x, 'f', 0, 64)
+	}
+	c.Assert(r.strokeWidth(), gc.Equals, "3")
+}
+
+func (s *CanvasSuite) TestNoteBounds(c *gc.C) {
+	serviceA := &service{
+		name: "service-a",
+	}
+	serviceB := &service{
+		name:  "service-b",
+		point: image.Point{400, 0},
+	}
+	canvas := Canvas{}
+	canvas.addService(serviceA)
+	canvas.addService(serviceB)
+	relation := &serviceRelation{
+		serviceA: serviceA,
+		serviceB: serviceB,
+		note:     "TLS required",
+	}
+	// The note is shown above the middle of the line, clear of the
+	// health indicator.
+	c.Assert(relation.line(), gc.Equals, line{image.Point{189, 94}, image.Point{400, 94}})
+	c.Assert(canvas.noteBounds(relation), gc.Equals, image.Rect(255, 60, 335, 80))
+
+	// The note moves below the line to avoid a service above it.
+	canvas.addService(&service{
+		name:  "service-c",
+		point: image.Point{200, -120},
+	})
+	c.Assert(canvas.noteBounds(relation), gc.Equals, image.Rect(255, 108, 335, 128))
+
+	// If every position overlaps a service, the first is used.
+	canvas.addService(&service{
+		name:  "service-d",
+		point: image.Point{200, 110},
+	})
+	c.Assert(canvas.noteBounds(relation), gc.Equals, image.Rect(255, 60, 335, 80))
+
+	// The note of a relation between a service and itself is
+	// shown outside its loop.
+	relation = &serviceRelation{
+		serviceA: serviceA,
+		serviceB: serviceA,
+		note:     "self",
+	}
+	c.Assert(canvas.noteBounds(relation), gc.Equals, image.Rect(229, -66, 261, -46))
+}
+
+func (s *CanvasSuite) TestMarshalCharmLegend(c *gc.C) {
+	canvas := Canvas{
+		charmLegend: true,
+	}
+	// All the services lie on top of one another.
+	for i := 0; i < 5; i++ {
+		canvas.addService(&service{
+			name:      fmt.Sprintf("service-%d", i),
+			charmPath: fmt.Sprintf("precise/charm-%d", i),
+			charmName: "charm",
+			iconUrl:   "a.svg",
+		})
+	}
+	c.Assert(charmLegendSize(canvas.legendCharms()), gc.Equals, image.Point{170, 232})
+	var buf bytes.Buffer
+	canvas.Marshal(&buf)
+	// The panel is taller than the diagram, so the image is
+	// extended to fit it.
+	c.Assert(buf.String(), jc.Contains, `<svg width="359" height="232"`)
+	c.Assert(buf.String(), jc.Contains, `<g id="charmLegend">
+<image x="209" y="20" width="32" height="32" xlink:href="a.svg" />
+<text x="249" y="34" style="font-size:14px;fill:#505050">charm</text>
+<text x="249" y="50" style="font-size:12px;fill:#888888">precise/charm-0</text>
+`)
+}
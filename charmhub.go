@@ -0,0 +1,151 @@
+package jujusvg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/juju/utils/parallel"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+)
+
+// DefaultCharmhubURL holds the URL of the Charmhub API.
+const DefaultCharmhubURL = "https://api.charmhub.io"
+
+// CharmhubFetcher is an IconFetcher which retrieves the icons of charms
+// published on Charmhub, where charms are identified by name alone. The
+// URL of each icon is looked up with the Charmhub API, so that bundles
+// written for Charmhub render without an IconURL function mapping
+// charms to their icons. Charms which are not found on Charmhub, or have
+// no icon, are left out of the results.
+type CharmhubFetcher struct {
+	// URL holds the URL of the Charmhub API. If it is empty,
+	// DefaultCharmhubURL will be used.
+	URL string
+
+	// Channel, if set, holds the channel, for instance
+	// "latest/edge", whose revision of each charm gives its icon.
+	// If it is empty, the default channel of each charm is used.
+	Channel string
+
+	// Client specifies what HTTP client to use; if it is not provided,
+	// the client shared with HTTPFetcher will be used.
+	Client *http.Client
+}
+
+// FetchIcons implements IconFetcher.FetchIcons.
+func (f *CharmhubFetcher) FetchIcons(b *charm.BundleData) (map[string][]byte, error) {
+	icons, err := f.FetchTypedIcons(b)
+	if err != nil {
+		return nil, err
+	}
+	return iconData(icons), nil
+}
+
+// FetchTypedIcons implements TypedIconFetcher.FetchTypedIcons.
+func (f *CharmhubFetcher) FetchTypedIcons(b *charm.BundleData) (map[string]Icon, error) {
+	return f.FetchTypedIconsContext(context.Background(), b)
+}
+
+// FetchTypedIconsContext implements
+// ContextIconFetcher.FetchTypedIconsContext.
+func (f *CharmhubFetcher) FetchTypedIconsContext(ctx context.Context, b *charm.BundleData) (map[string]Icon, error) {
+	charmIds, err := UniqueCharms(b)
+	if err != nil {
+		return nil, err
+	}
+	var mu sync.Mutex // Guards iconURLs.
+	iconURLs := make(map[string]string)
+	run := parallel.NewRun(defaultConcurrency)
+	for _, charmId := range charmIds {
+		charmId := charmId
+		run.Do(func() error {
+			iconURL, err := f.iconURL(ctx, charmId.Name)
+			if err != nil || iconURL == "" {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			iconURLs[charmId.Path()] = iconURL
+			return nil
+		})
+	}
+	if err := run.Wait(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		return nil, err
+	}
+	var found []*charm.URL
+	for _, charmId := range charmIds {
+		if iconURLs[charmId.Path()] != "" {
+			found = append(found, charmId)
+		}
+	}
+	fetcher := &HTTPFetcher{
+		IconURL: func(charmId *charm.URL) string {
+			return iconURLs[charmId.Path()]
+		},
+		Client: f.Client,
+	}
+	return FetchIconsFor(ctx, fetcher, found)
+}
+
+// charmhubInfo holds the parts of the response to a Charmhub info
+// request used to find the icon of a charm.
+type charmhubInfo struct {
+	Result struct {
+		Media []struct {
+			Type string `json:"type"`
+			URL  string `json:"url"`
+		} `json:"media"`
+	} `json:"result"`
+}
+
+// iconURL returns the URL of the icon of the charm with the given name,
+// or the empty string if the charm is not found or has no icon.
+func (f *CharmhubFetcher) iconURL(ctx context.Context, name string) (string, error) {
+	query := url.Values{
+		"fields": {"result.media"},
+	}
+	if f.Channel != "" {
+		query.Set("channel", f.Channel)
+	}
+	u := f.url() + "/v2/charms/info/" + url.PathEscape(name) + "?" + query.Encode()
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot make request for %s", u)
+	}
+	resp, err := sharedClient(f.Client).Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errgo.Notef(err, "cannot get information on charm %q", name)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errgo.Newf("cannot get information on charm %q: %s", name, resp.Status)
+	}
+	var info charmhubInfo
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", errgo.Notef(err, "cannot decode information on charm %q", name)
+	}
+	for _, media := range info.Result.Media {
+		if media.Type == "icon" && media.URL != "" {
+			return media.URL, nil
+		}
+	}
+	return "", nil
+}
+
+func (f *CharmhubFetcher) url() string {
+	if f.URL == "" {
+		return DefaultCharmhubURL
+	}
+	return strings.TrimSuffix(f.URL, "/")
+}
@@ -0,0 +1,139 @@
+package jujusvg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+)
+
+type CharmhubSuite struct{}
+
+var _ = gc.Suite(&CharmhubSuite{})
+
+const charmhubBundle = `
+services:
+  mysql:
+    charm: mysql
+    num_units: 1
+  wordpress:
+    charm: wordpress
+    num_units: 1
+  wordpress-2:
+    charm: wordpress
+    num_units: 1
+  haproxy:
+    charm: haproxy
+    num_units: 1
+  private:
+    charm: private
+    num_units: 1
+`
+
+// newCharmhubServer returns a server acting as the Charmhub API, serving
+// the icons of mysql, as a PNG, and wordpress. The haproxy charm has no
+// icon, and other charms are not found. The channels requested are
+// recorded in channels.
+func newCharmhubServer(channels *[]string) *httptest.Server {
+	var mu sync.Mutex
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/charms/info/mysql", "/v2/charms/info/wordpress":
+			if r.URL.Query().Get("fields") != "result.media" {
+				http.Error(w, "unexpected fields", http.StatusBadRequest)
+				return
+			}
+			mu.Lock()
+			*channels = append(*channels, r.URL.Query().Get("channel"))
+			mu.Unlock()
+			name := strings.TrimPrefix(r.URL.Path, "/v2/charms/info/")
+			fmt.Fprintf(w, `{"result": {"media": [
+				{"type": "screenshot", "url": "%[1]s/media/%[2]s-screenshot.png"},
+				{"type": "icon", "url": "%[1]s/media/%[2]s-icon"}
+			]}}`, ts.URL, name)
+		case "/v2/charms/info/haproxy":
+			fmt.Fprint(w, `{"result": {"media": []}}`)
+		case "/media/mysql-icon":
+			w.Header().Set("Content-Type", "image/png")
+			fmt.Fprint(w, "\x89PNG\r\n\x1a\nmysql")
+		case "/media/wordpress-icon":
+			w.Header().Set("Content-Type", svgContentType)
+			fmt.Fprint(w, "<svg>wordpress</svg>")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return ts
+}
+
+func (s *CharmhubSuite) TestFetchTypedIcons(c *gc.C) {
+	var channels []string
+	ts := newCharmhubServer(&channels)
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(charmhubBundle))
+	c.Assert(err, gc.IsNil)
+	fetcher := &CharmhubFetcher{
+		URL:     ts.URL + "/",
+		Channel: "latest/edge",
+	}
+	icons, err := fetcher.FetchTypedIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.DeepEquals, map[string]Icon{
+		"mysql": {
+			ContentType: "image/png",
+			Data:        []byte("\x89PNG\r\n\x1a\nmysql"),
+		},
+		"wordpress": {
+			ContentType: svgContentType,
+			Data:        []byte("<svg>wordpress</svg>"),
+		},
+	})
+	c.Assert(channels, gc.DeepEquals, []string{"latest/edge", "latest/edge"})
+}
+
+func (s *CharmhubSuite) TestNewFromBundle(c *gc.C) {
+	var channels []string
+	ts := newCharmhubServer(&channels)
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(charmhubBundle))
+	c.Assert(err, gc.IsNil)
+	canvas, err := NewFromBundle(b, iconURL, &CharmhubFetcher{URL: ts.URL})
+	c.Assert(err, gc.IsNil)
+	var buf bytes.Buffer
+	canvas.Marshal(&buf)
+	c.Assert(buf.String(), gc.Matches, `(?s).*>wordpress</svg:svg>.*`)
+	c.Assert(buf.String(), gc.Matches, `(?s).*xlink:href="data:image/png;base64,.*`)
+	c.Assert(channels, gc.DeepEquals, []string{"", ""})
+}
+
+func (s *CharmhubSuite) TestErrors(c *gc.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad-wolf", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(`
+services:
+  mysql:
+    charm: mysql
+    num_units: 1
+`))
+	c.Assert(err, gc.IsNil)
+	fetcher := &CharmhubFetcher{URL: ts.URL}
+	_, err = fetcher.FetchIcons(b)
+	c.Assert(err, gc.ErrorMatches, `cannot get information on charm "mysql": 500 Internal Server Error`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = fetcher.FetchTypedIconsContext(ctx, b)
+	c.Assert(err, gc.Equals, context.Canceled)
+}
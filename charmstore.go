@@ -0,0 +1,139 @@
+package jujusvg
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+)
+
+// DefaultCharmStoreURL holds the URL of the API of the public charm store.
+const DefaultCharmStoreURL = "https://api.jujucharms.com/charmstore/v4"
+
+// DefaultMaxBundleSize holds the largest bundle, in bytes, retrieved by
+// CharmStore when MaxBundleSize is not set.
+const DefaultMaxBundleSize = 1 << 20
+
+var (
+	// ErrBundleFetch is the cause of errors which occur while
+	// retrieving a bundle from the charm store.
+	ErrBundleFetch = errgo.New("cannot fetch bundle")
+
+	// ErrBundleParse is the cause of errors which occur while
+	// parsing a bundle retrieved from the charm store.
+	ErrBundleParse = errgo.New("cannot parse bundle")
+)
+
+// CharmStore renders bundles held in a charm store, using the icons held
+// in the same store.
+type CharmStore struct {
+	// URL holds the URL of the charm store API. If it is empty,
+	// DefaultCharmStoreURL will be used.
+	URL string
+
+	// Client specifies what HTTP client to use; if it is not provided,
+	// the client shared with HTTPFetcher will be used.
+	Client *http.Client
+
+	// MaxBundleSize limits the size in bytes of the bundles
+	// retrieved, so that a misbehaving store cannot exhaust
+	// memory. If it is not positive, DefaultMaxBundleSize is used.
+	MaxBundleSize int64
+}
+
+// IconURL returns the URL of the icon of the given charm in the charm
+// store.
+func (cs *CharmStore) IconURL(id *charm.URL) string {
+	return cs.url() + "/" + id.Path() + "/icon.svg"
+}
+
+// Bundle retrieves and parses the bundle with the given reference, for
+// instance "cs:bundle/wiki-simple", from the charm store. Errors
+// retrieving the bundle, including the bundle being larger than
+// MaxBundleSize, have ErrBundleFetch as their cause, and errors parsing
+// it have ErrBundleParse as their cause.
+func (cs *CharmStore) Bundle(ctx context.Context, ref string) (*charm.BundleData, error) {
+	id, err := charm.ParseURL(ref)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot parse bundle reference %q", ref)
+	}
+	url := cs.url() + "/" + id.Path() + "/archive/bundle.yaml"
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, errgo.WithCausef(err, ErrBundleFetch, "cannot fetch bundle %q", ref)
+	}
+	resp, err := cs.client().Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errgo.WithCausef(err, ErrBundleFetch, "cannot fetch bundle %q", ref)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errgo.WithCausef(nil, ErrBundleFetch, "cannot fetch bundle %q: %s", ref, resp.Status)
+	}
+	maxSize := cs.maxBundleSize()
+	// Read one byte more than allowed to detect oversized
+	// responses without a Content-Length.
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, errgo.WithCausef(err, ErrBundleFetch, "cannot fetch bundle %q", ref)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, errgo.WithCausef(nil, ErrBundleFetch, "cannot fetch bundle %q: bundle exceeds maximum size of %d bytes", ref, maxSize)
+	}
+	b, err := charm.ReadBundleData(bytes.NewReader(data))
+	if err != nil {
+		return nil, errgo.WithCausef(err, ErrBundleParse, "cannot parse bundle %q", ref)
+	}
+	return b, nil
+}
+
+// RenderBundle retrieves the bundle with the given reference from the
+// charm store and writes an SVG representation of it to w. Icons are
+// fetched from the charm store unless the given options specify
+// otherwise. Errors retrieving and parsing the bundle are as for
+// Bundle.
+func (cs *CharmStore) RenderBundle(ctx context.Context, ref string, w io.Writer, opts ...CanvasOption) error {
+	b, err := cs.Bundle(ctx, ref)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(ErrBundleFetch), errgo.Is(ErrBundleParse))
+	}
+	var c Canvas
+	for _, opt := range opts {
+		opt(&c)
+	}
+	iconURL := c.iconURL
+	if iconURL == nil {
+		iconURL = cs.IconURL
+	}
+	fetcher := c.iconFetcher
+	if fetcher == nil {
+		fetcher = &HTTPFetcher{
+			IconURL: iconURL,
+			Client:  cs.Client,
+		}
+	}
+	return render(ctx, b, w, iconURL, fetcher, opts)
+}
+
+func (cs *CharmStore) url() string {
+	if cs.URL == "" {
+		return DefaultCharmStoreURL
+	}
+	return strings.TrimSuffix(cs.URL, "/")
+}
+
+func (cs *CharmStore) maxBundleSize() int64 {
+	if cs.MaxBundleSize <= 0 {
+		return DefaultMaxBundleSize
+	}
+	return cs.MaxBundleSize
+}
+
+func (cs *CharmStore) client() *http.Client {
+	return sharedClient(cs.Client)
+}
@@ -0,0 +1,101 @@
+package jujusvg
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+)
+
+type CharmStoreSuite struct{}
+
+var _ = gc.Suite(&CharmStoreSuite{})
+
+func (s *CharmStoreSuite) TestIconURL(c *gc.C) {
+	id := charm.MustParseURL("cs:trusty/mysql-23")
+	cs := &CharmStore{}
+	c.Assert(cs.IconURL(id), gc.Equals, "https://api.jujucharms.com/charmstore/v4/trusty/mysql-23/icon.svg")
+	cs.URL = "http://0.1.2.3/v4/"
+	c.Assert(cs.IconURL(id), gc.Equals, "http://0.1.2.3/v4/trusty/mysql-23/icon.svg")
+}
+
+func (s *CharmStoreSuite) TestRenderBundle(c *gc.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/bundle/wiki-simple/archive/bundle.yaml":
+			fmt.Fprint(w, bundle)
+		case r.URL.Path == "/bundle/bad-yaml/archive/bundle.yaml":
+			fmt.Fprint(w, "services: [")
+		case strings.HasSuffix(r.URL.Path, "/icon.svg"):
+			fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg">%s</svg>`, r.URL.Path)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+	cs := &CharmStore{
+		URL: ts.URL,
+	}
+
+	b, err := cs.Bundle(context.Background(), "cs:bundle/wiki-simple")
+	c.Assert(err, gc.IsNil)
+	fetcher := &HTTPFetcher{
+		IconURL: cs.IconURL,
+	}
+	canvas, err := NewFromBundle(b, cs.IconURL, fetcher)
+	c.Assert(err, gc.IsNil)
+	var expected bytes.Buffer
+	canvas.Marshal(&expected)
+
+	var buf bytes.Buffer
+	err = cs.RenderBundle(context.Background(), "cs:bundle/wiki-simple", &buf)
+	c.Assert(err, gc.IsNil)
+	assertXMLEqual(c, buf.Bytes(), expected.Bytes())
+	c.Assert(buf.String(), gc.Matches, `(?s).*<svg [^>]*>/precise/mongodb-21/icon.svg</svg>.*`)
+
+	err = cs.RenderBundle(context.Background(), "cs:bundle/missing", &buf)
+	c.Assert(err, gc.ErrorMatches, `cannot fetch bundle "cs:bundle/missing": 404 Not Found`)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrBundleFetch)
+
+	err = cs.RenderBundle(context.Background(), "cs:bundle/bad-yaml", &buf)
+	c.Assert(err, gc.ErrorMatches, `cannot parse bundle "cs:bundle/bad-yaml": .*`)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrBundleParse)
+
+	err = cs.RenderBundle(context.Background(), "cs:bad:wolf", &buf)
+	c.Assert(err, gc.ErrorMatches, `cannot parse bundle reference "cs:bad:wolf": .*`)
+}
+
+func (s *CharmStoreSuite) TestBundleNetworkError(c *gc.C) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+	cs := &CharmStore{
+		URL: ts.URL,
+	}
+	_, err := cs.Bundle(context.Background(), "cs:bundle/wiki-simple")
+	c.Assert(err, gc.ErrorMatches, `cannot fetch bundle "cs:bundle/wiki-simple": .*`)
+	c.Assert(errgo.Cause(err), gc.Equals, ErrBundleFetch)
+}
+
+func (s *CharmStoreSuite) TestBundleTooLarge(c *gc.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, bundle)
+	}))
+	defer ts.Close()
+	cs := &CharmStore{
+		URL:           ts.URL,
+		MaxBundleSize: int64(len(bundle)),
+	}
+	_, err := cs.Bundle(context.Background(), "cs:bundle/wiki-simple")
+	c.Assert(err, gc.IsNil)
+
+	cs.MaxBundleSize--
+	_, err = cs.Bundle(context.Background(), "cs:bundle/wiki-simple")
+	c.Assert(err, gc.ErrorMatches, fmt.Sprintf(`cannot fetch bundle "cs:bundle/wiki-simple": bundle exceeds maximum size of %d bytes`, len(bundle)-1))
+	c.Assert(errgo.Cause(err), gc.Equals, ErrBundleFetch)
+}
@@ -0,0 +1,233 @@
+package jujusvg
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"sort"
+
+	svg "github.com/ajstarks/svgo"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+)
+
+const (
+	diffLineWidth    = 4
+	diffCornerRadius = 30
+	diffLegendHeight = 30
+	diffSwatchSize   = 14
+	diffLegendWidth  = 100
+
+	addedColor   = "#38B44A"
+	removedColor = "#DF382C"
+	changedColor = "#EFB73E"
+
+	// Colors used to highlight differences by WithColorBlindSafe,
+	// taken from ColorBlindPalette.
+	colorBlindAddedColor   = "#0072B2"
+	colorBlindRemovedColor = "#D55E00"
+	colorBlindChangedColor = "#E69F00"
+)
+
+// diffStatus describes how a service or relation differs between two
+// versions of a bundle.
+type diffStatus int
+
+const (
+	diffUnchanged diffStatus = iota
+	diffAdded
+	diffRemoved
+	diffChanged
+)
+
+// color returns the color used to highlight items with the status,
+// chosen from ColorBlindPalette if colorBlindSafe is true.
+func (s diffStatus) color(colorBlindSafe bool) string {
+	switch {
+	case s == diffAdded && colorBlindSafe:
+		return colorBlindAddedColor
+	case s == diffAdded:
+		return addedColor
+	case s == diffRemoved && colorBlindSafe:
+		return colorBlindRemovedColor
+	case s == diffRemoved:
+		return removedColor
+	case s == diffChanged && colorBlindSafe:
+		return colorBlindChangedColor
+	case s == diffChanged:
+		return changedColor
+	}
+	return relationColor
+}
+
+// dash returns the dash pattern used to highlight items with the status
+// without relying on color, as done by WithColorBlindSafe.
+func (s diffStatus) dash() string {
+	switch s {
+	case diffAdded:
+		return "12, 4, 2, 4"
+	case diffRemoved:
+		return "8, 4"
+	case diffChanged:
+		return "2, 4"
+	}
+	return ""
+}
+
+// diffLegendEntries holds the statuses explained by the legend shown
+// below diff diagrams, in order.
+var diffLegendEntries = []struct {
+	status diffStatus
+	text   string
+}{
+	{diffAdded, "added"},
+	{diffRemoved, "removed"},
+	{diffChanged, "changed"},
+}
+
+// drawDiffLegend draws a legend explaining the colors used to highlight
+// differences in a band starting at the given point. If colorBlindSafe
+// is true, the swatches are also drawn with the dash pattern of each
+// status.
+func drawDiffLegend(canvas *svg.SVG, p image.Point, colorBlindSafe bool) {
+	canvas.Gid("diffLegend")
+	defer canvas.Gend()
+	x := p.X + diffLegendHeight/2
+	y := p.Y + (diffLegendHeight-diffSwatchSize)/2
+	for _, entry := range diffLegendEntries {
+		attrs := []string{
+			fmt.Sprintf(`fill="none" stroke=%q stroke-width="%dpx"`, entry.status.color(colorBlindSafe), diffLineWidth/2),
+		}
+		if colorBlindSafe {
+			attrs = append(attrs, fmt.Sprintf(`stroke-dasharray=%q`, entry.status.dash()))
+		}
+		canvas.Roundrect(x, y, diffSwatchSize, diffSwatchSize, 3, 3, attrs...)
+		canvas.Text(x+diffSwatchSize+6, y+diffSwatchSize-2, entry.text,
+			fmt.Sprintf("font-size:14px;fill:%s", fontColor))
+		x += diffLegendWidth
+	}
+}
+
+// NewFromBundleDiff returns a new Canvas showing the differences between
+// two versions of a bundle on a single diagram. Services and relations
+// only found in newBundle are highlighted in green, those only found in
+// oldBundle in red, and services whose charm or position changed in amber.
+// Removed services are drawn at their old position, and a legend
+// explaining the colors is shown below the diagram unless the
+// WithoutDiffLegend option is given. The remaining arguments are used as
+// for NewFromBundle.
+func NewFromBundleDiff(oldBundle, newBundle *charm.BundleData, iconURL func(*charm.URL) string, fetcher IconFetcher, opts ...CanvasOption) (*Canvas, error) {
+	canvas := Canvas{
+		series:      newBundle.Series,
+		description: newBundle.Description,
+		tags:        newBundle.Tags,
+		diffLegend:  true,
+	}
+	for _, opt := range opts {
+		opt(&canvas)
+	}
+	oldBundle = canvas.withoutDuplicateRelations(oldBundle)
+	newBundle = canvas.withoutDuplicateRelations(newBundle)
+
+	if fetcher == nil {
+		fetcher = canvas.defaultFetcher(iconURL)
+	}
+	icons, err := fetchIcons(context.Background(), fetcher, oldBundle)
+	if err != nil {
+		return nil, err
+	}
+	newIcons, err := fetchIcons(context.Background(), fetcher, newBundle)
+	if err != nil {
+		return nil, err
+	}
+	for path, icon := range newIcons {
+		icons[path] = icon
+	}
+
+	if err := oldBundle.Verify(nil, nil); err != nil {
+		return nil, errgo.Notef(err, "cannot verify old bundle")
+	}
+	if err := newBundle.Verify(nil, nil); err != nil {
+		return nil, errgo.Notef(err, "cannot verify new bundle")
+	}
+	oldServices, oldNeedingPlacement, err := canvas.newServices(oldBundle, iconURL, icons)
+	if err != nil {
+		return nil, err
+	}
+	services, servicesNeedingPlacement, err := canvas.newServices(newBundle, iconURL, icons)
+	if err != nil {
+		return nil, err
+	}
+	for name, svc := range services {
+		old, ok := oldServices[name]
+		switch {
+		case !ok:
+			svc.status = diffAdded
+		case old.charmPath != svc.charmPath || old.point != svc.point:
+			svc.status = diffChanged
+		}
+	}
+	for name, svc := range oldServices {
+		if _, ok := services[name]; !ok {
+			svc.status = diffRemoved
+			services[name] = svc
+			servicesNeedingPlacement[name] = oldNeedingPlacement[name]
+		}
+	}
+	canvas.placeServices(services, servicesNeedingPlacement)
+	for _, name := range sortedServiceNames(services) {
+		canvas.addService(services[name])
+	}
+
+	oldRelations := relationSet(oldBundle)
+	newRelations := relationSet(newBundle)
+	for _, relation := range newBundle.Relations {
+		status := diffUnchanged
+		if !oldRelations[relationKey(relation)] {
+			status = diffAdded
+		}
+		r, err := canvas.newRelation(relation, services)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			r.status = status
+			canvas.addRelation(r)
+		}
+	}
+	for _, relation := range oldBundle.Relations {
+		if newRelations[relationKey(relation)] {
+			continue
+		}
+		r, err := canvas.newRelation(relation, services)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			r.status = diffRemoved
+			canvas.addRelation(r)
+		}
+	}
+	canvas.weighRelations()
+	if err := canvas.dimUnfocused(); err != nil {
+		return nil, err
+	}
+	return &canvas, nil
+}
+
+// relationSet returns the set of keys of the relations in the bundle.
+func relationSet(b *charm.BundleData) map[string]bool {
+	relations := make(map[string]bool)
+	for _, relation := range b.Relations {
+		relations[relationKey(relation)] = true
+	}
+	return relations
+}
+
+// relationKey returns a key identifying the relation between the given
+// endpoints regardless of the order in which they are specified.
+func relationKey(endpoints []string) string {
+	eps := append([]string(nil), endpoints...)
+	sort.Strings(eps)
+	return eps[0] + " " + eps[1]
+}
@@ -0,0 +1,198 @@
+package jujusvg
+
+import (
+	"bytes"
+	"image"
+	"strings"
+
+	"github.com/ajstarks/svgo"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+)
+
+type DiffSuite struct{}
+
+var _ = gc.Suite(&DiffSuite{})
+
+func (s *DiffSuite) TestNewFromBundleDiff(c *gc.C) {
+	oldBundle, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	newBundle, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	// Remove elasticsearch, add haproxy and move mongodb.
+	delete(newBundle.Services, "elasticsearch")
+	newBundle.Services["haproxy"] = &charm.ServiceSpec{
+		Charm:    "cs:precise/haproxy-35",
+		NumUnits: 1,
+		Annotations: map[string]string{
+			"gui-x": "0",
+			"gui-y": "0",
+		},
+	}
+	newBundle.Services["mongodb"].Annotations["gui-x"] = "1000"
+	newBundle.Relations = [][]string{
+		{"mongodb:database", "charmworld:database"},
+		{"haproxy:reverseproxy", "charmworld:website"},
+	}
+
+	cvs, err := NewFromBundleDiff(oldBundle, newBundle, iconURL, nil)
+	c.Assert(err, gc.IsNil)
+	statuses := make(map[string]diffStatus)
+	for _, svc := range cvs.services {
+		statuses[svc.name] = svc.status
+	}
+	c.Assert(statuses, gc.DeepEquals, map[string]diffStatus{
+		"charmworld":    diffUnchanged,
+		"elasticsearch": diffRemoved,
+		"haproxy":       diffAdded,
+		"mongodb":       diffChanged,
+	})
+	relations := make(map[string]diffStatus)
+	for _, rel := range cvs.relations {
+		relations[rel.serviceA.name+" "+rel.serviceB.name] = rel.status
+	}
+	c.Assert(relations, gc.DeepEquals, map[string]diffStatus{
+		"mongodb charmworld":       diffUnchanged,
+		"haproxy charmworld":       diffAdded,
+		"charmworld elasticsearch": diffRemoved,
+	})
+}
+
+func (s *DiffSuite) TestNewFromBundleDiffBadBundle(c *gc.C) {
+	oldBundle, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	newBundle, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	newBundle.Relations[0][0] = "evil-unknown-service"
+
+	cvs, err := NewFromBundleDiff(oldBundle, newBundle, iconURL, nil)
+	c.Assert(err, gc.ErrorMatches, "cannot verify new bundle: .*")
+	c.Assert(cvs, gc.IsNil)
+}
+
+func (s *DiffSuite) TestDiffRender(c *gc.C) {
+	var buf bytes.Buffer
+	svg := svg.New(&buf)
+	svc := &service{
+		name:    "foo",
+		iconUrl: "foo",
+		status:  diffAdded,
+	}
+	svc.usage(svg, nil)
+	relation := serviceRelation{
+		serviceA: svc,
+		serviceB: &service{
+			point: image.Point{
+				X: 100,
+				Y: 100,
+			},
+		},
+		status: diffRemoved,
+	}
+	relation.usage(svg)
+	c.Assert(buf.String(), gc.Equals,
+		`<use x="0" y="0" xlink:href="#serviceBlock" id="foo" />
+<rect x="0" y="0" width="189" height="189" rx="30" ry="30" fill="none" stroke="#38B44A" stroke-width="4px" />
+<image x="46" y="46" width="96" height="96" xlink:href="foo" />
+<g style="font-size:18px;fill:#505050;text-anchor:middle">
+<text x="94" y="31" >foo</text>
+</g>
+<line x1="94" y1="189" x2="100" y2="194" stroke="#DF382C" stroke-width="2px" stroke-dasharray="-6.09, 20" />
+<circle cx="97" cy="191" r="10" style="stroke:#DF382C;fill:none;stroke-width:2px"/>
+<circle cx="97" cy="191" r="5" style="fill:#DF382C"/>
+`)
+}
+
+func (s *DiffSuite) TestDiffLegend(c *gc.C) {
+	oldBundle, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	newBundle, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	cvs, err := NewFromBundleDiff(oldBundle, newBundle, iconURL, nil)
+	c.Assert(err, gc.IsNil)
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	// The legend adds to the height of the diagram.
+	c.Assert(buf.String(), jc.Contains, `<svg width="639" height="495"`)
+	c.Assert(buf.String(), jc.Contains, `<g id="diffLegend">
+<rect x="15" y="473" width="14" height="14" rx="3" ry="3" fill="none" stroke="#38B44A" stroke-width="2px" />
+<text x="35" y="485" style="font-size:14px;fill:#505050">added</text>
+<rect x="115" y="473" width="14" height="14" rx="3" ry="3" fill="none" stroke="#DF382C" stroke-width="2px" />
+<text x="135" y="485" style="font-size:14px;fill:#505050">removed</text>
+<rect x="215" y="473" width="14" height="14" rx="3" ry="3" fill="none" stroke="#EFB73E" stroke-width="2px" />
+<text x="235" y="485" style="font-size:14px;fill:#505050">changed</text>
+</g>`)
+
+	cvs, err = NewFromBundleDiff(oldBundle, newBundle, iconURL, nil, WithoutDiffLegend())
+	c.Assert(err, gc.IsNil)
+	buf.Reset()
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), jc.Contains, `<svg width="639" height="465"`)
+	c.Assert(buf.String(), gc.Not(jc.Contains), "diffLegend")
+
+	// Diagrams of a single bundle have no legend.
+	cvs, err = NewFromBundle(newBundle, iconURL, nil)
+	c.Assert(err, gc.IsNil)
+	buf.Reset()
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), gc.Not(jc.Contains), "diffLegend")
+}
+
+func (s *DiffSuite) TestColorBlindSafeDiff(c *gc.C) {
+	oldBundle, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	newBundle, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	// Remove elasticsearch and move mongodb.
+	delete(newBundle.Services, "elasticsearch")
+	newBundle.Services["mongodb"].Annotations["gui-x"] = "1000"
+	newBundle.Relations = [][]string{
+		{"mongodb:database", "charmworld:database"},
+	}
+
+	cvs, err := NewFromBundleDiff(oldBundle, newBundle, iconURL, nil,
+		WithColorBlindSafe(),
+		WithInterfaceColors(PaletteColors(ColorBlindPalette)),
+	)
+	c.Assert(err, gc.IsNil)
+	for _, svc := range cvs.services {
+		switch svc.name {
+		case "elasticsearch":
+			c.Assert(svc.diffAttrs(), jc.DeepEquals, []string{
+				`fill="none" stroke="#D55E00" stroke-width="4px"`,
+				`stroke-dasharray="8, 4"`,
+			})
+		case "mongodb":
+			c.Assert(svc.diffAttrs(), jc.DeepEquals, []string{
+				`fill="none" stroke="#E69F00" stroke-width="4px"`,
+				`stroke-dasharray="2, 4"`,
+			})
+		}
+	}
+	for _, rel := range cvs.relations {
+		if rel.status == diffRemoved {
+			// The status takes precedence over the interface.
+			c.Check(rel.lineColor(), gc.Equals, colorBlindRemovedColor)
+			c.Check(rel.lineDash(), gc.Equals, "8, 4")
+			continue
+		}
+		// Unchanged relations are drawn according to their interface.
+		c.Check(rel.lineColor(), gc.Equals, PaletteColors(ColorBlindPalette)("database"))
+		c.Check(rel.lineDash(), gc.Equals, colorBlindInterfaceDashes[paletteIndex("database", len(colorBlindInterfaceDashes))])
+	}
+
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), jc.Contains, `<g id="diffLegend">
+<rect x="15" y="567" width="14" height="14" rx="3" ry="3" fill="none" stroke="#0072B2" stroke-width="2px" stroke-dasharray="12, 4, 2, 4" />
+<text x="35" y="579" style="font-size:14px;fill:#505050">added</text>
+<rect x="115" y="567" width="14" height="14" rx="3" ry="3" fill="none" stroke="#D55E00" stroke-width="2px" stroke-dasharray="8, 4" />
+<text x="135" y="579" style="font-size:14px;fill:#505050">removed</text>
+<rect x="215" y="567" width="14" height="14" rx="3" ry="3" fill="none" stroke="#E69F00" stroke-width="2px" stroke-dasharray="2, 4" />
+<text x="235" y="579" style="font-size:14px;fill:#505050">changed</text>
+</g>`)
+}
@@ -0,0 +1,57 @@
+package jujusvg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// MarshalDOT writes the services and relations of the canvas to w as a
+// Graphviz DOT graph. Each service is a node labelled with its name and
+// charm, and pinned to the position of its center in the diagram so that
+// Graphviz layout engines which honour positions, such as neato, keep the
+// layout. Each relation is an undirected edge labelled with its interface
+// name, if known.
+func (c *Canvas) MarshalDOT(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.layout()
+	bw := bufio.NewWriter(w)
+	bw.WriteString("digraph bundle {\n")
+	bw.WriteString("\tnode [shape=box];\n")
+	bw.WriteString("\tedge [dir=none];\n")
+	for _, s := range c.services {
+		label := s.name
+		if s.charmPath != "" {
+			label += "\n" + s.charmPath
+		}
+		// Graphviz measures positions in points with the y
+		// axis pointing up.
+		center := s.center()
+		fmt.Fprintf(bw, "\t%s [label=%s, pos=\"%d,%d!\"];\n",
+			dotQuote(s.name), dotQuote(label), center.X, -center.Y)
+	}
+	for _, r := range c.relations {
+		fmt.Fprintf(bw, "\t%s -> %s", dotQuote(r.serviceA.name), dotQuote(r.serviceB.name))
+		if r.interfaceName != "" {
+			fmt.Fprintf(bw, " [label=%s]", dotQuote(r.interfaceName))
+		}
+		bw.WriteString(";\n")
+	}
+	bw.WriteString("}\n")
+	return bw.Flush()
+}
+
+// dotQuote returns s as a quoted DOT string. Newlines in s are written as
+// the \n escape sequence, which centers the line in labels.
+func dotQuote(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
+
+var dotEscaper = strings.NewReplacer(
+	`\`, `\\`,
+	`"`, `\"`,
+	"\n", `\n`,
+)
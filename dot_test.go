@@ -0,0 +1,62 @@
+package jujusvg
+
+import (
+	"bytes"
+	"image"
+
+	gc "gopkg.in/check.v1"
+)
+
+type DOTSuite struct{}
+
+var _ = gc.Suite(&DOTSuite{})
+
+func (s *DOTSuite) TestMarshalDOT(c *gc.C) {
+	serviceA := &service{
+		name:      "service-a",
+		charmPath: "trusty/mysql-23",
+		point: image.Point{
+			X: 100,
+			Y: 50,
+		},
+	}
+	serviceB := &service{
+		name:      `service "b"`,
+		charmPath: "trusty/wordpress-5",
+		point: image.Point{
+			X: 400,
+			Y: 250,
+		},
+	}
+	canvas := Canvas{}
+	canvas.addService(serviceA)
+	canvas.addService(serviceB)
+	canvas.addRelation(&serviceRelation{
+		serviceA:      serviceA,
+		serviceB:      serviceB,
+		interfaceName: "mysql",
+	})
+	canvas.addRelation(&serviceRelation{
+		serviceA: serviceB,
+		serviceB: serviceA,
+	})
+	var buf bytes.Buffer
+	err := canvas.MarshalDOT(&buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(buf.String(), gc.Equals, `digraph bundle {
+	node [shape=box];
+	edge [dir=none];
+	"service-a" [label="service-a\ntrusty/mysql-23", pos="94,-94!"];
+	"service \"b\"" [label="service \"b\"\ntrusty/wordpress-5", pos="394,-294!"];
+	"service-a" -> "service \"b\"" [label="mysql"];
+	"service \"b\"" -> "service-a";
+}
+`)
+}
+
+func (s *DOTSuite) TestMarshalDOTEmpty(c *gc.C) {
+	var buf bytes.Buffer
+	err := (&Canvas{}).MarshalDOT(&buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(buf.String(), gc.Equals, "digraph bundle {\n\tnode [shape=box];\n\tedge [dir=none];\n}\n")
+}
@@ -0,0 +1,56 @@
+package jujusvg
+
+import "sync"
+
+// CachedIcon holds an icon fetched over HTTP along with the validators
+// returned with it, which allow later requests for the icon to be made
+// conditional on it having changed.
+type CachedIcon struct {
+	Icon
+
+	// ETag holds the value of the ETag header returned with the
+	// icon, if any.
+	ETag string
+
+	// LastModified holds the value of the Last-Modified header
+	// returned with the icon, if any.
+	LastModified string
+}
+
+// An IconCache holds icons fetched by an HTTPFetcher, keyed by the URL
+// from which they were fetched. Its methods may be called concurrently.
+type IconCache interface {
+	// Get returns the icon cached for the given URL, and whether
+	// there is one.
+	Get(url string) (CachedIcon, bool)
+
+	// Put stores the icon fetched from the given URL, replacing
+	// any icon already cached for it.
+	Put(url string, icon CachedIcon)
+}
+
+// MemoryIconCache is an IconCache which holds icons in memory. The zero
+// value is an empty cache ready to use. Icons are never discarded, so
+// a MemoryIconCache grows with the number of distinct icons fetched.
+type MemoryIconCache struct {
+	mu    sync.Mutex
+	icons map[string]CachedIcon
+}
+
+// Get implements IconCache.Get.
+func (c *MemoryIconCache) Get(url string) (CachedIcon, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	icon, ok := c.icons[url]
+	return icon, ok
+}
+
+// Put implements IconCache.Put.
+func (c *MemoryIconCache) Put(url string, icon CachedIcon) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.icons == nil {
+		c.icons = make(map[string]CachedIcon)
+	}
+	c.icons[url] = icon
+}
@@ -0,0 +1,35 @@
+package jujusvg
+
+import (
+	gc "gopkg.in/check.v1"
+)
+
+type IconCacheSuite struct{}
+
+var _ = gc.Suite(&IconCacheSuite{})
+
+func (s *IconCacheSuite) TestMemoryIconCache(c *gc.C) {
+	var cache MemoryIconCache
+	_, ok := cache.Get("http://0.1.2.3/icon.svg")
+	c.Assert(ok, gc.Equals, false)
+
+	icon := CachedIcon{
+		Icon: Icon{
+			ContentType: svgContentType,
+			Data:        []byte("<svg>icon</svg>"),
+		},
+		ETag: `"v1"`,
+	}
+	cache.Put("http://0.1.2.3/icon.svg", icon)
+	cached, ok := cache.Get("http://0.1.2.3/icon.svg")
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(cached, gc.DeepEquals, icon)
+
+	icon.ETag = `"v2"`
+	cache.Put("http://0.1.2.3/icon.svg", icon)
+	cached, ok = cache.Get("http://0.1.2.3/icon.svg")
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(cached.ETag, gc.Equals, `"v2"`)
+	_, ok = cache.Get("http://0.1.2.3/other.svg")
+	c.Assert(ok, gc.Equals, false)
+}
@@ -2,10 +2,20 @@ package jujusvg
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"mime"
 	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/juju/utils/parallel"
 	"github.com/juju/xml"
@@ -20,35 +30,397 @@ type IconFetcher interface {
 	FetchIcons(*charm.BundleData) (map[string][]byte, error)
 }
 
+// svgContentType holds the media type of SVG icons.
+const svgContentType = "image/svg+xml"
+
+// Icon holds the contents of a charm icon along with its content type.
+type Icon struct {
+	// ContentType holds the media type of the icon, for instance
+	// "image/svg+xml" or "image/png".
+	ContentType string
+
+	// Data holds the icon contents.
+	Data []byte
+
+	// Substitute reports whether the icon stands in for one which
+	// could not be fetched, such as the Fallback or placeholder
+	// icon of an HTTPFetcher. Substitute icons are not cached by
+	// CachingFetcher.
+	Substitute bool
+}
+
+// isSVG reports whether the icon should be treated as an SVG document.
+// Servers often report SVG icons as generic XML or text, so only other
+// image types are excluded.
+func (i Icon) isSVG() bool {
+	mediaType, _, err := mime.ParseMediaType(i.ContentType)
+	if err != nil {
+		return true
+	}
+	return mediaType == svgContentType || !strings.HasPrefix(mediaType, "image/")
+}
+
+// hasSVGRoot reports whether the icon contents are an XML document whose
+// root element is an svg element, whatever its declared content type.
+func (i Icon) hasSVGRoot() bool {
+	dec := xml.NewDecoder(bytes.NewReader(i.Data))
+	dec.Strict = false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return false
+		}
+		if tag, ok := tok.(xml.StartElement); ok {
+			return tag.Name.Local == "svg"
+		}
+	}
+}
+
+// rasterType returns the media type of the icon if its contents are a
+// PNG, JPEG or GIF image, whatever its declared content type, and the
+// empty string otherwise.
+func (i Icon) rasterType() string {
+	switch t := http.DetectContentType(i.Data); t {
+	case "image/png", "image/jpeg", "image/gif":
+		return t
+	}
+	return ""
+}
+
+// dataURI returns a data URI holding the icon. Raster images are given
+// the media type detected from their contents, and other icons are
+// assumed to be SVG documents.
+func (i Icon) dataURI() string {
+	mediaType := i.rasterType()
+	if mediaType == "" {
+		mediaType = svgContentType
+	}
+	return "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(i.Data)
+}
+
+// A TypedIconFetcher is an IconFetcher which also records the content type
+// of each icon it fetches, allowing icons in formats other than SVG to be
+// embedded appropriately.
+type TypedIconFetcher interface {
+	IconFetcher
+
+	// FetchTypedIcons is like FetchIcons, but returns a map from charm
+	// paths to icons holding both the data and its content type.
+	FetchTypedIcons(*charm.BundleData) (map[string]Icon, error)
+}
+
+// A ContextIconFetcher is a TypedIconFetcher which can abandon fetching
+// icons when a context is done.
+type ContextIconFetcher interface {
+	TypedIconFetcher
+
+	// FetchTypedIconsContext is like FetchTypedIcons, but returns
+	// ctx.Err() if ctx is done before the icons have been fetched.
+	FetchTypedIconsContext(ctx context.Context, b *charm.BundleData) (map[string]Icon, error)
+}
+
+// fetchIcons fetches the icons for the charms in the given bundle,
+// returning ctx.Err() if ctx is done first. Fetchers which are not
+// ContextIconFetchers cannot be interrupted, so they are left to finish
+// in the background. The content type of icons retrieved by fetchers
+// which are not TypedIconFetchers is assumed to be SVG.
+func fetchIcons(ctx context.Context, fetcher IconFetcher, b *charm.BundleData) (map[string]Icon, error) {
+	if f, ok := fetcher.(ContextIconFetcher); ok {
+		return f.FetchTypedIconsContext(ctx, b)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type result struct {
+		icons map[string]Icon
+		err   error
+	}
+	// The channel is buffered so that the fetch can finish
+	// even if its result is no longer wanted.
+	c := make(chan result, 1)
+	go func() {
+		icons, err := fetchTypedIcons(fetcher, b)
+		c <- result{icons, err}
+	}()
+	select {
+	case r := <-c:
+		return r.icons, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fetchTypedIcons fetches the icons for the charms in the given bundle
+// using the given fetcher.
+func fetchTypedIcons(fetcher IconFetcher, b *charm.BundleData) (map[string]Icon, error) {
+	if f, ok := fetcher.(TypedIconFetcher); ok {
+		return f.FetchTypedIcons(b)
+	}
+	iconMap, err := fetcher.FetchIcons(b)
+	if err != nil {
+		return nil, err
+	}
+	icons := make(map[string]Icon, len(iconMap))
+	for path, data := range iconMap {
+		icons[path] = Icon{
+			ContentType: svgContentType,
+			Data:        data,
+		}
+	}
+	return icons, nil
+}
+
+// UniqueCharms returns the distinct charms used by the services in the
+// given bundle, ordered by path. Charms are distinguished by their paths,
+// as are the icons returned by an IconFetcher.
+func UniqueCharms(b *charm.BundleData) ([]*charm.URL, error) {
+	alreadySeen := make(map[string]bool)
+	var charmIds []*charm.URL
+	for _, serviceData := range b.Services {
+		charmId, err := charm.ParseURL(serviceData.Charm)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot parse charm %q", serviceData.Charm)
+		}
+		path := charmId.Path()
+		if alreadySeen[path] {
+			continue
+		}
+		alreadySeen[path] = true
+		charmIds = append(charmIds, charmId)
+	}
+	sort.Sort(charmsByPath(charmIds))
+	return charmIds, nil
+}
+
+// FetchIconsFor fetches the icons of the given charms using the given
+// fetcher, so that icons can be fetched for diagrams which are not drawn
+// from a bundle, such as that of a single application. The icons are
+// returned keyed by charm path; icons from fetchers which do not report
+// content types are assumed to be SVG documents.
+func FetchIconsFor(ctx context.Context, fetcher IconFetcher, charmIds []*charm.URL) (map[string]Icon, error) {
+	return fetchIcons(ctx, fetcher, charmsBundle(charmIds))
+}
+
+// charmsBundle returns a bundle holding a service for each of the given
+// charms, as fetchers find the charms whose icons to fetch from bundles.
+func charmsBundle(charmIds []*charm.URL) *charm.BundleData {
+	b := &charm.BundleData{
+		Services: make(map[string]*charm.ServiceSpec),
+	}
+	for i, charmId := range charmIds {
+		b.Services[fmt.Sprintf("service-%d", i)] = &charm.ServiceSpec{
+			Charm:    charmId.String(),
+			NumUnits: 1,
+		}
+	}
+	return b
+}
+
+// charmsByPath implements sort.Interface to order charm URLs by path.
+type charmsByPath []*charm.URL
+
+func (c charmsByPath) Len() int           { return len(c) }
+func (c charmsByPath) Less(i, j int) bool { return c[i].Path() < c[j].Path() }
+func (c charmsByPath) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// iconData returns the data of each of the given icons.
+func iconData(icons map[string]Icon) map[string][]byte {
+	iconMap := make(map[string][]byte, len(icons))
+	for path, icon := range icons {
+		iconMap[path] = icon.Data
+	}
+	return iconMap
+}
+
+// ChainFetcher is an IconFetcher which combines several fetchers, such as
+// one reading icons from local disk followed by one fetching them over
+// the network. The icon of each charm is taken from the first fetcher
+// which provides it: each fetcher is asked only for the icons which the
+// fetchers before it did not provide, and a fetcher which fails is
+// treated as providing none. The charms whose icons the last fetcher
+// fails to provide are left out; FetchTypedIconsPartial reports why.
+type ChainFetcher []IconFetcher
+
+// FetchIcons implements IconFetcher.FetchIcons.
+func (f ChainFetcher) FetchIcons(b *charm.BundleData) (map[string][]byte, error) {
+	icons, err := f.FetchTypedIcons(b)
+	if err != nil {
+		return nil, err
+	}
+	return iconData(icons), nil
+}
+
+// FetchTypedIcons implements TypedIconFetcher.FetchTypedIcons.
+func (f ChainFetcher) FetchTypedIcons(b *charm.BundleData) (map[string]Icon, error) {
+	return f.FetchTypedIconsContext(context.Background(), b)
+}
+
+// FetchTypedIconsContext implements
+// ContextIconFetcher.FetchTypedIconsContext. No more fetchers are tried
+// once ctx is done.
+func (f ChainFetcher) FetchTypedIconsContext(ctx context.Context, b *charm.BundleData) (map[string]Icon, error) {
+	icons, _, err := f.FetchTypedIconsPartial(ctx, b)
+	return icons, err
+}
+
+// FetchTypedIconsPartial is like FetchTypedIconsContext, but also returns
+// the errors from the last fetcher for the icons which no fetcher
+// provided, keyed by charm path. If the last fetcher has a
+// FetchTypedIconsPartial method, as HTTPFetcher does, it is used to
+// find the error for each icon; otherwise an error from the last fetcher
+// is recorded for every icon it was asked for. It fails only if the
+// bundle is invalid or ctx is done.
+func (f ChainFetcher) FetchTypedIconsPartial(ctx context.Context, b *charm.BundleData) (map[string]Icon, map[string]error, error) {
+	icons := make(map[string]Icon)
+	failed := make(map[string]error)
+	for i, fetcher := range f {
+		remaining, err := withoutIcons(b, icons)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(remaining.Services) == 0 {
+			break
+		}
+		last := i == len(f)-1
+		var fetched map[string]Icon
+		if pf, ok := fetcher.(partialIconFetcher); ok && last {
+			var fetchFailed map[string]error
+			fetched, fetchFailed, err = pf.FetchTypedIconsPartial(ctx, remaining)
+			for path, fetchErr := range fetchFailed {
+				failed[path] = fetchErr
+			}
+		} else {
+			fetched, err = fetchIcons(ctx, fetcher, remaining)
+		}
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, nil, ctxErr
+		}
+		if err != nil {
+			if last {
+				if err := recordFailed(failed, remaining, errgo.Mask(err, errgo.Any)); err != nil {
+					return nil, nil, err
+				}
+			}
+			continue
+		}
+		for path, icon := range fetched {
+			if _, ok := icons[path]; !ok && len(icon.Data) > 0 {
+				icons[path] = icon
+			}
+		}
+	}
+	return icons, failed, nil
+}
+
+// partialIconFetcher is implemented by fetchers which can report why
+// each icon they fail to provide is missing.
+type partialIconFetcher interface {
+	FetchTypedIconsPartial(ctx context.Context, b *charm.BundleData) (map[string]Icon, map[string]error, error)
+}
+
+// recordFailed records the given error in failed for each charm used in
+// the given bundle.
+func recordFailed(failed map[string]error, b *charm.BundleData, err error) error {
+	charmIds, idErr := UniqueCharms(b)
+	if idErr != nil {
+		return idErr
+	}
+	for _, charmId := range charmIds {
+		failed[charmId.Path()] = err
+	}
+	return nil
+}
+
+// withoutIcons returns a bundle holding the services in b whose charms
+// have no icon in the given map.
+func withoutIcons(b *charm.BundleData, icons map[string]Icon) (*charm.BundleData, error) {
+	remaining := &charm.BundleData{
+		Services: make(map[string]*charm.ServiceSpec),
+		Series:   b.Series,
+	}
+	for name, serviceData := range b.Services {
+		charmId, err := charm.ParseURL(serviceData.Charm)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot parse charm %q", serviceData.Charm)
+		}
+		if _, ok := icons[charmId.Path()]; !ok {
+			remaining.Services[name] = serviceData
+		}
+	}
+	return remaining, nil
+}
+
 // LinkFetcher fetches icons as links so that they are included within the SVG
 // as remote resources using SVG <image> tags.
 type LinkFetcher struct {
 	// IconURL returns the URL of the entity for embedding
 	IconURL func(*charm.URL) string
+
+	// Inline specifies that each icon is downloaded from its URL
+	// and linked to as a data URI rather than by its URL, so that
+	// diagrams do not depend on remote resources, for instance
+	// when viewed offline. Icons which cannot be downloaded are
+	// linked to by their URLs instead.
+	Inline bool
+
+	// Client specifies what HTTP client to use to download icons
+	// when Inline is set; if it is not provided, the client shared
+	// with HTTPFetcher will be used.
+	Client *http.Client
 }
 
 // FetchIcons generates the svg image tags given an appropriate URL, generating
 // tags only for unique icons.
 func (l *LinkFetcher) FetchIcons(b *charm.BundleData) (map[string][]byte, error) {
-	// Maintain a list of icons that have already been fetched.
-	alreadyFetched := make(map[string]bool)
+	icons, err := l.FetchTypedIcons(b)
+	if err != nil {
+		return nil, err
+	}
+	return iconData(icons), nil
+}
 
-	// Build the map of icons.
-	icons := make(map[string][]byte)
-	for _, serviceData := range b.Services {
-		charmId, err := charm.ParseURL(serviceData.Charm)
+// FetchTypedIcons implements TypedIconFetcher.FetchTypedIcons. The
+// generated icons are always SVG documents.
+func (l *LinkFetcher) FetchTypedIcons(b *charm.BundleData) (map[string]Icon, error) {
+	return l.FetchTypedIconsContext(context.Background(), b)
+}
+
+// FetchTypedIconsContext implements
+// ContextIconFetcher.FetchTypedIconsContext. The context is only used
+// when icons are downloaded because Inline is set.
+func (l *LinkFetcher) FetchTypedIconsContext(ctx context.Context, b *charm.BundleData) (map[string]Icon, error) {
+	charmIds, err := UniqueCharms(b)
+	if err != nil {
+		return nil, err
+	}
+	var downloaded map[string]Icon
+	var failed map[string]error
+	if l.Inline {
+		f := &HTTPFetcher{
+			IconURL: l.IconURL,
+			Client:  l.Client,
+		}
+		downloaded, failed, err = f.FetchTypedIconsPartial(ctx, b)
 		if err != nil {
-			return nil, errgo.Notef(err, "cannot parse charm %q", serviceData.Charm)
+			return nil, errgo.Mask(err, errgo.Any)
 		}
-		path := charmId.Path()
-
-		// Don't duplicate icons in the map.
-		if !alreadyFetched[path] {
-			alreadyFetched[path] = true
-			icons[path] = []byte(fmt.Sprintf(`
+	}
+	icons := make(map[string]Icon)
+	for _, charmId := range charmIds {
+		href := l.IconURL(charmId)
+		if _, ok := failed[charmId.Path()]; l.Inline && !ok {
+			icon := downloaded[charmId.Path()]
+			if len(icon.Data) == 0 {
+				continue
+			}
+			href = icon.dataURI()
+		}
+		icons[charmId.Path()] = Icon{
+			ContentType: svgContentType,
+			Data: []byte(fmt.Sprintf(`
 				<svg xmlns:xlink="http://www.w3.org/1999/xlink">
 					<image width="96" height="96" xlink:href="%s" />
-				</svg>`, escapeString(l.IconURL(charmId))))
+				</svg>`, escapeString(href))),
 		}
 	}
 	return icons, nil
@@ -71,69 +443,679 @@ type HTTPFetcher struct {
 	// makes this method nominally synchronous.
 	Concurrency int
 
+	// HostConcurrency, if positive, limits the number of icons
+	// fetched at once from any one host, so that fetching icons
+	// held on several hosts does not overload any of them. The
+	// total number of icons fetched at once remains limited by
+	// Concurrency.
+	HostConcurrency int
+
+	// RateLimiter, if non-nil, limits the rate at which requests
+	// are made, including retries. It may be shared with other
+	// fetchers using the same server.
+	RateLimiter *RateLimiter
+
 	// IconURL returns the URL from which to fetch the given entity's icon SVG.
 	IconURL func(*charm.URL) string
 
 	// Client specifies what HTTP client to use; if it is not provided,
-	// http.DefaultClient will be used.
+	// a client shared by all fetchers will be used, so that
+	// connections to the icon host are reused between renders.
+	// Fetchers created with separate clients can also share
+	// connections by using the same Transport.
 	Client *http.Client
+
+	// ModifyRequest, if non-nil, is called with each request made
+	// to fetch an icon, and the charm whose icon it fetches,
+	// before the request is sent, so that it can add headers such
+	// as authorization, tracing IDs or a User-Agent. If it
+	// returns an error, the fetch fails. It may be called
+	// concurrently, and is called again for each retry. Changes
+	// to be made to every request regardless of the charm may
+	// also be made by the Transport of Client.
+	ModifyRequest func(req *http.Request, charmId *charm.URL) error
+
+	// IconTimeout, if positive, limits the time taken to fetch each
+	// icon. An icon which cannot be fetched in time is left out of
+	// the results, so that diagrams link to it rather than embedding
+	// it, instead of failing the whole fetch. The context passed to
+	// FetchTypedIconsContext limits the time taken to fetch all the
+	// icons: when it is done, the fetch fails however long each
+	// icon has been given.
+	IconTimeout time.Duration
+
+	// Retries holds the number of times fetching an icon is
+	// retried after a failure which may be transient: a 5xx or
+	// 429 Too Many Requests response, or an error sending the
+	// request. If it is zero, failures are not retried.
+	// IconTimeout limits the time taken by all the attempts to
+	// fetch an icon together.
+	Retries int
+
+	// RetryDelay holds the longest time waited before retrying a
+	// failed fetch for the first time. The delay doubles before
+	// each subsequent retry. The time actually waited is chosen at
+	// random up to the delay, so that clients which fail together
+	// do not all retry together. If it is not positive, 100ms is
+	// used.
+	RetryDelay time.Duration
+
+	// Rand, if non-nil, is used to choose the times waited before
+	// retries, allowing them to be reproduced. It may be shared by
+	// several fetchers. If it is nil, the default source of the
+	// math/rand package is used.
+	Rand *rand.Rand
+
+	// MaxIconSize, if positive, limits the size in bytes of the
+	// icons fetched. Reading a response stops once it exceeds the
+	// limit, and fails the fetch.
+	MaxIconSize int64
+
+	// Fallback, if non-nil, holds an SVG icon used in place of any
+	// icon whose fetch would otherwise fail the whole fetch: when
+	// a request fails, after any retries, when the server responds
+	// with an error status or an icon larger than MaxIconSize, or
+	// when a policy of IconFail applies.
+	// Icons which cannot be fetched within IconTimeout are still
+	// left out of the results.
+	Fallback []byte
+
+	// Cache, if non-nil, holds the icons fetched previously along
+	// with the ETag and Last-Modified headers returned with them.
+	// Requests for cached icons are made conditional on them having
+	// changed, and the cached icon is used if the server responds
+	// with 304 Not Modified.
+	Cache IconCache
+
+	// AllowErrors specifies that icons which cannot be fetched are
+	// left out of the results, so that diagrams link to them rather
+	// than embedding them, instead of failing the whole fetch. Use
+	// FetchTypedIconsPartial to find why each icon was left out.
+	AllowErrors bool
+
+	// Progress, if non-nil, is called each time fetching an icon
+	// finishes, successfully or not, with the number of icons
+	// finished so far and the total number of icons to fetch.
+	// Calls are never made concurrently.
+	Progress func(completed, total int)
+
+	// OnFetchStart and OnFetchDone, if non-nil, are called when
+	// fetching the icon of each charm starts and finishes, so that
+	// the latency and outcome of fetches can be monitored.
+	// OnFetchDone is given the time taken, including any retries,
+	// the size of the icon fetched and the error fetching it,
+	// before any Fallback is used in its place. Unlike Progress,
+	// they may be called concurrently.
+	OnFetchStart func(charmId *charm.URL)
+	OnFetchDone  func(charmId *charm.URL, d time.Duration, size int, err error)
+
+	// RevisionFallback specifies that when the icon of a specific
+	// revision of a charm is not found, the icon of the charm
+	// without a revision, usually that of its latest revision, is
+	// fetched in its place, as icons rarely change between
+	// revisions. The NotFound policy applies only if that is not
+	// found either. ModifyRequest is called with the charm without
+	// a revision for the second request.
+	RevisionFallback bool
+
+	// NotFound, EmptyIcon and DefaultIcon specify how responses
+	// showing that a charm has no icon are treated, as servers
+	// differ in how they report it:
+	//
+	//	Response                     Policy       Default
+	//	404 Not Found                NotFound     IconFail
+	//	200 OK with an empty body    EmptyIcon    IconUseResponse
+	//	200 OK with the default icon DefaultIcon  IconUseResponse
+	//
+	// A policy of IconUseResponse uses the body of the response as
+	// the icon, IconUsePlaceholder uses an icon marking the charm as
+	// having no icon, and IconFail fails the whole fetch. Any other
+	// response but 200 OK always fails the fetch.
+	NotFound    IconPolicy
+	EmptyIcon   IconPolicy
+	DefaultIcon IconPolicy
+
+	// InvalidIcon specifies how a 200 OK response holding neither
+	// an SVG document nor a PNG, JPEG or GIF image, such as an
+	// HTML error page, is treated. By default, the fetch fails
+	// with an *InvalidIconError.
+	InvalidIcon IconPolicy
+
+	// IsDefaultIcon, if non-nil, reports whether the given icon,
+	// returned with 200 OK, is the icon the server returns for
+	// charms without one of their own. If it is nil, no icon is
+	// treated as the default icon.
+	IsDefaultIcon func(Icon) bool
+}
+
+// An IconPolicy specifies how HTTPFetcher treats a response showing that
+// a charm has no icon.
+type IconPolicy int
+
+const (
+	// IconPolicyDefault applies the default policy for the
+	// response, as documented on HTTPFetcher.
+	IconPolicyDefault IconPolicy = iota
+
+	// IconUseResponse uses the body of the response as the icon.
+	IconUseResponse
+
+	// IconUsePlaceholder uses a placeholder icon in place of the
+	// response.
+	IconUsePlaceholder
+
+	// IconFail fails the fetch.
+	IconFail
+)
+
+// apply returns the icon to use for a response holding the given icon
+// according to the policy, or def if the policy is IconPolicyDefault.
+// The given error is returned if the fetch fails.
+func (p IconPolicy) apply(def IconPolicy, icon Icon, failure error) (Icon, error) {
+	if p == IconPolicyDefault {
+		p = def
+	}
+	switch p {
+	case IconUsePlaceholder:
+		return Icon{
+			ContentType: svgContentType,
+			Data:        []byte(placeholderIcon),
+			Substitute:  true,
+		}, nil
+	case IconFail:
+		return Icon{}, failure
+	}
+	return icon, nil
+}
+
+// defaultConcurrency holds the number of icons fetched at once when
+// HTTPFetcher.Concurrency is not set.
+const defaultConcurrency = 10
+
+// defaultRetryDelay holds the time waited before first retrying a failed
+// fetch when HTTPFetcher.RetryDelay is not set.
+const defaultRetryDelay = 100 * time.Millisecond
+
+// defaultClient holds the HTTP client used when none is specified. It
+// keeps enough idle connections to each host to serve a whole batch of
+// concurrent fetches.
+var defaultClient = &http.Client{
+	Transport: newDefaultTransport(),
+}
+
+// newDefaultTransport returns the transport used by defaultClient. It
+// is based on http.DefaultTransport, but always keeps connections alive,
+// as some packages (github.com/juju/utils among them) disable keep-alives
+// on http.DefaultTransport when they are initialized.
+func newDefaultTransport() http.RoundTripper {
+	t, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		t = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+		}
+	}
+	t = t.Clone()
+	t.DisableKeepAlives = false
+	t.MaxIdleConnsPerHost = defaultConcurrency
+	return t
+}
+
+// sharedClient returns client, or defaultClient if it is nil.
+func sharedClient(client *http.Client) *http.Client {
+	if client == nil {
+		return defaultClient
+	}
+	return client
 }
 
 // FetchIcons retrieves icon SVGs over HTTP.  If specified in the struct, icons
 // will be fetched concurrently.
 func (h *HTTPFetcher) FetchIcons(b *charm.BundleData) (map[string][]byte, error) {
-	client := http.DefaultClient
-	if h.Client != nil {
-		client = h.Client
+	icons, err := h.FetchTypedIcons(b)
+	if err != nil {
+		return nil, err
+	}
+	return iconData(icons), nil
+}
+
+// FetchIconsContext is like FetchIcons, but returns ctx.Err() if ctx is
+// done before the icons have been fetched, cancelling outstanding
+// requests.
+func (h *HTTPFetcher) FetchIconsContext(ctx context.Context, b *charm.BundleData) (map[string][]byte, error) {
+	icons, err := h.FetchTypedIconsContext(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	return iconData(icons), nil
+}
+
+// FetchTypedIcons implements TypedIconFetcher.FetchTypedIcons. The content
+// type of each icon is taken from the Content-Type header of the response;
+// SVG is assumed if the header is missing.
+func (h *HTTPFetcher) FetchTypedIcons(b *charm.BundleData) (map[string]Icon, error) {
+	return h.FetchTypedIconsContext(context.Background(), b)
+}
+
+// FetchTypedIconsContext implements
+// ContextIconFetcher.FetchTypedIconsContext. Outstanding requests are
+// cancelled when ctx is done.
+func (h *HTTPFetcher) FetchTypedIconsContext(ctx context.Context, b *charm.BundleData) (map[string]Icon, error) {
+	if h.AllowErrors {
+		icons, _, err := h.FetchTypedIconsPartial(ctx, b)
+		return icons, err
+	}
+	return h.fetchTypedIcons(ctx, b, nil)
+}
+
+// FetchTypedIconsPartial is like FetchTypedIconsContext, but does not
+// fail when some icons cannot be fetched: it returns the icons which were
+// fetched along with the errors for those which were not, including
+// those which could not be fetched within IconTimeout, keyed by charm
+// path. It fails only if the bundle is invalid or ctx is done.
+func (h *HTTPFetcher) FetchTypedIconsPartial(ctx context.Context, b *charm.BundleData) (map[string]Icon, map[string]error, error) {
+	failed := make(map[string]error)
+	icons, err := h.fetchTypedIcons(ctx, b, failed)
+	if err != nil {
+		return nil, nil, err
 	}
+	return icons, failed, nil
+}
+
+// fetchTypedIcons fetches the icons for the charms in the given bundle.
+// If failed is non-nil, the errors for icons which cannot be fetched are
+// recorded in it, keyed by charm path, rather than failing the fetch.
+func (h *HTTPFetcher) fetchTypedIcons(ctx context.Context, b *charm.BundleData, failed map[string]error) (map[string]Icon, error) {
+	client := sharedClient(h.Client)
 	concurrency := h.Concurrency
 	if concurrency <= 0 {
-		concurrency = 10
+		concurrency = defaultConcurrency
 	}
-	var iconsMu sync.Mutex // Guards icons.
-	icons := make(map[string][]byte)
-	alreadyFetched := make(map[string]bool)
-	run := parallel.NewRun(concurrency)
-	for _, serviceData := range b.Services {
-		charmId, err := charm.ParseURL(serviceData.Charm)
-		if err != nil {
-			return nil, errgo.Notef(err, "cannot parse charm %q", serviceData.Charm)
+	charmIds, err := UniqueCharms(b)
+	if err != nil {
+		return nil, err
+	}
+	var iconsMu sync.Mutex // Guards icons, failed and completed.
+	icons := make(map[string]Icon)
+	completed := 0
+	fetch := func(charmId *charm.URL, url string) error {
+		if h.OnFetchStart != nil {
+			h.OnFetchStart(charmId)
 		}
-		path := charmId.Path()
-		if alreadyFetched[path] {
-			continue
+		start := time.Now()
+		icon, err := h.fetchIconWithTimeout(ctx, charmId, url, client)
+		if h.OnFetchDone != nil {
+			h.OnFetchDone(charmId, time.Since(start), len(icon.Data), err)
+		}
+		iconsMu.Lock()
+		defer iconsMu.Unlock()
+		completed++
+		if h.Progress != nil {
+			h.Progress(completed, len(charmIds))
 		}
-		alreadyFetched[path] = true
-		run.Do(func() error {
-			icon, err := h.fetchIcon(h.IconURL(charmId), client)
-			if err != nil {
-				return err
+		if errgo.Cause(err) == errIconTimeout {
+			if failed != nil {
+				failed[charmId.Path()] = err
 			}
-			iconsMu.Lock()
-			defer iconsMu.Unlock()
-			icons[path] = icon
 			return nil
-		})
+		}
+		if err != nil && h.Fallback != nil && ctx.Err() == nil {
+			icon, err = Icon{
+				ContentType: svgContentType,
+				Data:        h.Fallback,
+				Substitute:  true,
+			}, nil
+		}
+		if err != nil && failed != nil && ctx.Err() == nil {
+			failed[charmId.Path()] = err
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		icons[charmId.Path()] = icon
+		return nil
+	}
+	if h.HostConcurrency > 0 {
+		err = h.fetchByHost(ctx, charmIds, concurrency, fetch)
+	} else {
+		run := parallel.NewRun(concurrency)
+		for _, charmId := range charmIds {
+			charmId := charmId
+			run.Do(func() error {
+				return fetch(charmId, h.IconURL(charmId))
+			})
+		}
+		err = run.Wait()
 	}
-	if err := run.Wait(); err != nil {
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			// Report why the fetches failed rather
+			// than each individual failure.
+			return nil, ctxErr
+		}
+		if isThrottled(err) {
+			return nil, errgo.WithCausef(err, ErrThrottled, "")
+		}
 		return nil, err
 	}
 	return icons, nil
 }
 
-// fetchIcon retrieves a single icon svg over HTTP.
-func (h *HTTPFetcher) fetchIcon(url string, client *http.Client) ([]byte, error) {
-	resp, err := client.Get(url)
+// fetchByHost calls fetch for each of the given charms and the URL of its
+// icon, running at most h.HostConcurrency fetches from each host and at
+// most concurrency fetches in all at once.
+func (h *HTTPFetcher) fetchByHost(ctx context.Context, charmIds []*charm.URL, concurrency int, fetch func(*charm.URL, string) error) error {
+	// Group the charms by the host holding their icons, keeping
+	// the hosts in the order in which they are first used.
+	var hosts []string
+	byHost := make(map[string][]*charm.URL)
+	for _, charmId := range charmIds {
+		host := ""
+		if u, err := url.Parse(h.IconURL(charmId)); err == nil {
+			host = u.Host
+		}
+		if _, ok := byHost[host]; !ok {
+			hosts = append(hosts, host)
+		}
+		byHost[host] = append(byHost[host], charmId)
+	}
+	// slots limits the number of fetches in progress across all
+	// hosts, while each host has a run of its own.
+	slots := make(chan struct{}, concurrency)
+	errs := make([]error, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		i, host := i, host
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run := parallel.NewRun(h.HostConcurrency)
+			for _, charmId := range byHost[host] {
+				charmId := charmId
+				run.Do(func() error {
+					select {
+					case slots <- struct{}{}:
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+					defer func() {
+						<-slots
+					}()
+					return fetch(charmId, h.IconURL(charmId))
+				})
+			}
+			errs[i] = run.Wait()
+		}()
+	}
+	wg.Wait()
+	var all parallel.Errors
+	for _, err := range errs {
+		if err != nil {
+			all = append(all, err.(parallel.Errors)...)
+		}
+	}
+	if len(all) > 0 {
+		return all
+	}
+	return nil
+}
+
+// errIconTimeout is the cause of errors returned by fetchIconWithTimeout
+// when the icon could not be fetched within h.IconTimeout.
+var errIconTimeout = errgo.New("icon fetch timed out")
+
+// fetchIconWithTimeout is like fetchIcon, but gives up when
+// h.IconTimeout has passed.
+func (h *HTTPFetcher) fetchIconWithTimeout(ctx context.Context, charmId *charm.URL, url string, client *http.Client) (Icon, error) {
+	if h.IconTimeout <= 0 {
+		return h.fetchIconWithRetries(ctx, charmId, url, client)
+	}
+	iconCtx, cancel := context.WithTimeout(ctx, h.IconTimeout)
+	defer cancel()
+	icon, err := h.fetchIconWithRetries(iconCtx, charmId, url, client)
+	if err != nil && ctx.Err() == nil && iconCtx.Err() == context.DeadlineExceeded {
+		return Icon{}, errgo.WithCausef(err, errIconTimeout, "cannot fetch %s within %v", url, h.IconTimeout)
+	}
+	return icon, err
+}
+
+// iconTooLarge returns the error returned when the icon at the given URL
+// is larger than h.MaxIconSize.
+func (h *HTTPFetcher) iconTooLarge(url string) error {
+	return errgo.Newf("icon at %s exceeds maximum size of %d bytes", url, h.MaxIconSize)
+}
+
+// errTransient is the cause of errors returned by fetchIcon for failures
+// which may not recur if the fetch is retried.
+var errTransient = errgo.New("transient icon fetch failure")
+
+// ErrThrottled is the cause of errors returned by HTTPFetcher when the
+// server responds to any request with 429 Too Many Requests, after any
+// retries.
+var ErrThrottled = errgo.New("icon fetch throttled")
+
+// isThrottled reports whether any of the fetches whose failures are
+// reported by the given error failed because the server throttled them.
+func isThrottled(err error) bool {
+	errs, ok := err.(parallel.Errors)
+	if !ok {
+		return errgo.Cause(err) == ErrThrottled
+	}
+	for _, err := range errs {
+		if errgo.Cause(err) == ErrThrottled {
+			return true
+		}
+	}
+	return false
+}
+
+// isRetryable reports whether the given error returned by fetchIcon is
+// for a failure which may not recur if the fetch is retried.
+func isRetryable(err error) bool {
+	cause := errgo.Cause(err)
+	return cause == errTransient || cause == ErrThrottled
+}
+
+// fetchIconWithRetries is like fetchIcon, but retries transient failures
+// up to h.Retries times, backing off exponentially between attempts.
+func (h *HTTPFetcher) fetchIconWithRetries(ctx context.Context, charmId *charm.URL, url string, client *http.Client) (Icon, error) {
+	delay := h.RetryDelay
+	if delay <= 0 {
+		delay = defaultRetryDelay
+	}
+	for attempt := 0; ; attempt++ {
+		icon, err := h.fetchIcon(ctx, charmId, url, client)
+		if err == nil || !isRetryable(err) || attempt >= h.Retries || ctx.Err() != nil {
+			return icon, err
+		}
+		t := time.NewTimer(h.jitter(delay))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return Icon{}, err
+		}
+		if delay*2 > delay {
+			delay *= 2
+		}
+	}
+}
+
+// randMu guards the use of HTTPFetcher.Rand, as a rand.Rand may not be
+// used from several goroutines at once.
+var randMu sync.Mutex
+
+// jitter returns a random duration in [0, delay), chosen with h.Rand if
+// it is set.
+func (h *HTTPFetcher) jitter(delay time.Duration) time.Duration {
+	if h.Rand == nil {
+		return time.Duration(rand.Int63n(int64(delay)))
+	}
+	randMu.Lock()
+	defer randMu.Unlock()
+	return time.Duration(h.Rand.Int63n(int64(delay)))
+}
+
+// fetchIcon retrieves the icon of the given charm from the given URL over
+// HTTP, applying the policies given for responses showing that the charm
+// has no icon. If h.Cache holds the icon, the request is made conditional
+// on it having changed.
+func (h *HTTPFetcher) fetchIcon(ctx context.Context, charmId *charm.URL, url string, client *http.Client) (Icon, error) {
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return nil, errgo.Notef(err, "HTTP error fetching %s: %v", url, err)
+		return Icon{}, errgo.Notef(err, "cannot make request for %s", url)
+	}
+	var cached CachedIcon
+	haveCached := false
+	if h.Cache != nil {
+		cached, haveCached = h.Cache.Get(url)
+		if haveCached && cached.ETag != "" {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+		if haveCached && cached.LastModified != "" {
+			req.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	if h.ModifyRequest != nil {
+		if err := h.ModifyRequest(req, charmId); err != nil {
+			return Icon{}, errgo.Notef(err, "cannot make request for %s", url)
+		}
+	}
+	if h.RateLimiter != nil {
+		if err := h.RateLimiter.Wait(ctx); err != nil {
+			return Icon{}, errgo.Notef(err, "cannot fetch %s", url)
+		}
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return Icon{}, errgo.WithCausef(err, errTransient, "HTTP error fetching %s: %v", url, err)
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, errgo.Newf("cannot retrieve icon from %s: %s", url, resp.Status)
+	if resp.StatusCode >= 500 {
+		return Icon{}, errgo.WithCausef(nil, errTransient, "cannot retrieve icon from %s: %s", url, resp.Status)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return Icon{}, errgo.WithCausef(nil, ErrThrottled, "cannot retrieve icon from %s: %s", url, resp.Status)
+	}
+	notModified := haveCached && resp.StatusCode == http.StatusNotModified
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound && !notModified {
+		return Icon{}, errgo.Newf("cannot retrieve icon from %s: %s", url, resp.Status)
+	}
+	icon := cached.Icon
+	if !notModified {
+		icon, err = h.readIcon(url, resp)
+		if err != nil {
+			return Icon{}, err
+		}
+		if h.Cache != nil && resp.StatusCode == http.StatusOK {
+			h.cacheIcon(url, resp.Header, icon)
+		}
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound && h.RevisionFallback && charmId.Revision >= 0:
+		latest := charmId.WithRevision(-1)
+		return h.fetchIcon(ctx, latest, h.IconURL(latest), client)
+	case resp.StatusCode == http.StatusNotFound:
+		return h.NotFound.apply(IconFail, icon, errgo.Newf("cannot retrieve icon from %s: %s", url, resp.Status))
+	case len(icon.Data) == 0:
+		return h.EmptyIcon.apply(IconUseResponse, icon, errgo.Newf("no icon data at %s", url))
+	case h.IsDefaultIcon != nil && h.IsDefaultIcon(icon):
+		return h.DefaultIcon.apply(IconUseResponse, icon, errgo.Newf("%s holds the default icon", url))
+	case icon.rasterType() == "" && !icon.hasSVGRoot():
+		return h.InvalidIcon.apply(IconFail, icon, &InvalidIconError{
+			CharmId:     charmId,
+			URL:         url,
+			ContentType: icon.ContentType,
+		})
+	}
+	return icon, nil
+}
+
+// InvalidIconError is the error returned by HTTPFetcher when a server
+// responds with data which is neither an SVG document nor a PNG, JPEG or
+// GIF image, such as an HTML error page, and the InvalidIcon policy is
+// IconFail.
+type InvalidIconError struct {
+	// CharmId holds the charm whose icon was fetched.
+	CharmId *charm.URL
+
+	// URL holds the URL from which the icon was fetched.
+	URL string
+
+	// ContentType holds the content type of the response.
+	ContentType string
+}
+
+// Error implements error.Error.
+func (e *InvalidIconError) Error() string {
+	return fmt.Sprintf("invalid icon for %s at %s: %s is not an SVG document or image", e.CharmId, e.URL, e.ContentType)
+}
+
+// readIcon reads the icon held in the body of the given response to a
+// request for the given URL.
+func (h *HTTPFetcher) readIcon(url string, resp *http.Response) (Icon, error) {
+	if h.MaxIconSize > 0 && resp.ContentLength > h.MaxIconSize {
+		return Icon{}, h.iconTooLarge(url)
 	}
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := h.readIconData(url, resp.Body)
+	if err != nil {
+		return Icon{}, err
+	}
+	// Icons may be compressed, either because the server ignores the
+	// encodings accepted by the client or because they are stored
+	// compressed, as .svgz files are.
+	if bytes.HasPrefix(body, gzipMagic) {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return Icon{}, errgo.Notef(err, "cannot decompress icon data from url %s", url)
+		}
+		body, err = h.readIconData(url, zr)
+		if err != nil {
+			return Icon{}, err
+		}
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = svgContentType
+	}
+	return Icon{
+		ContentType: contentType,
+		Data:        body,
+	}, nil
+}
+
+// gzipMagic holds the bytes with which gzip data starts.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// readIconData reads icon data from r, which reads the response to a
+// request for the given URL, failing if it exceeds h.MaxIconSize.
+func (h *HTTPFetcher) readIconData(url string, r io.Reader) ([]byte, error) {
+	if h.MaxIconSize > 0 {
+		// Read one byte more than allowed to detect oversized
+		// responses without a Content-Length.
+		r = io.LimitReader(r, h.MaxIconSize+1)
+	}
+	data, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, errgo.Notef(err, "could not read icon data from url %s", url)
 	}
-	return body, nil
+	if h.MaxIconSize > 0 && int64(len(data)) > h.MaxIconSize {
+		return nil, h.iconTooLarge(url)
+	}
+	return data, nil
+}
+
+// cacheIcon stores the given icon, fetched from the given URL with a
+// response holding the given header, in h.Cache. Icons are only stored
+// if the response gave a validator with which to make later requests
+// conditional.
+func (h *HTTPFetcher) cacheIcon(url string, header http.Header, icon Icon) {
+	cached := CachedIcon{
+		Icon:         icon,
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+	}
+	if cached.ETag != "" || cached.LastModified != "" {
+		h.Cache.Put(url, cached)
+	}
 }
@@ -1,12 +1,22 @@
 package jujusvg
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
 	"fmt"
+	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/charm.v6-unstable"
 )
 
@@ -46,6 +56,151 @@ func (s *IconFetcherSuite) TestLinkFetchIcons(c *gc.C) {
 	}
 }
 
+func (s *IconFetcherSuite) TestLinkFetchIconsInline(c *gc.C) {
+	const png = "\x89PNG\r\n\x1a\nicon"
+	var mu sync.Mutex
+	fetched := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched[r.URL.Path]++
+		mu.Unlock()
+		switch {
+		case strings.Contains(r.URL.Path, "mongodb"):
+			fmt.Fprint(w, "<svg>mongodb</svg>")
+		case strings.Contains(r.URL.Path, "elasticsearch"):
+			w.Header().Set("Content-Type", "image/png")
+			fmt.Fprint(w, png)
+		}
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	b.Services["duplicateService"] = &charm.ServiceSpec{
+		Charm:    "cs:precise/mongodb-21",
+		NumUnits: 1,
+	}
+	fetcher := LinkFetcher{
+		IconURL: func(ref *charm.URL) string {
+			return ts.URL + "/" + ref.Path() + ".svg"
+		},
+		Inline: true,
+	}
+	iconMap, err := fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(iconMap, gc.HasLen, 2)
+	assertXMLEqual(c, iconMap["precise/mongodb-21"], []byte(`
+		<svg xmlns:xlink="http://www.w3.org/1999/xlink">
+			<image width="96" height="96" xlink:href="data:image/svg+xml;base64,`+base64.StdEncoding.EncodeToString([]byte("<svg>mongodb</svg>"))+`" />
+		</svg>`))
+	assertXMLEqual(c, iconMap["~charming-devs/precise/elasticsearch-2"], []byte(`
+		<svg xmlns:xlink="http://www.w3.org/1999/xlink">
+			<image width="96" height="96" xlink:href="data:image/png;base64,`+base64.StdEncoding.EncodeToString([]byte(png))+`" />
+		</svg>`))
+	// Each icon is downloaded once.
+	c.Assert(fetched, gc.DeepEquals, map[string]int{
+		"/precise/mongodb-21.svg":                     1,
+		"/~charming-devs/precise/elasticsearch-2.svg": 1,
+		"/~juju-jitsu/precise/charmworld-58.svg":      1,
+	})
+
+	// Icons which cannot be downloaded are linked to by their URLs.
+	ts.Close()
+	iconMap, err = fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(iconMap, gc.HasLen, 3)
+	assertXMLEqual(c, iconMap["precise/mongodb-21"], []byte(`
+		<svg xmlns:xlink="http://www.w3.org/1999/xlink">
+			<image width="96" height="96" xlink:href="`+ts.URL+`/precise/mongodb-21.svg" />
+		</svg>`))
+}
+
+func (s *IconFetcherSuite) TestLinkFetchIconsInlineFailure(c *gc.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "mongodb") {
+			http.Error(w, "bad-wolf", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "<svg>icon</svg>")
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	fetcher := LinkFetcher{
+		IconURL: func(ref *charm.URL) string {
+			return ts.URL + "/" + ref.Path() + ".svg"
+		},
+		Inline: true,
+	}
+	iconMap, err := fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(iconMap, gc.HasLen, 3)
+	// The icon which failed is linked to by its URL.
+	assertXMLEqual(c, iconMap["precise/mongodb-21"], []byte(`
+		<svg xmlns:xlink="http://www.w3.org/1999/xlink">
+			<image width="96" height="96" xlink:href="`+ts.URL+`/precise/mongodb-21.svg" />
+		</svg>`))
+	// The others are inlined.
+	assertXMLEqual(c, iconMap["~juju-jitsu/precise/charmworld-58"], []byte(`
+		<svg xmlns:xlink="http://www.w3.org/1999/xlink">
+			<image width="96" height="96" xlink:href="data:image/svg+xml;base64,`+base64.StdEncoding.EncodeToString([]byte("<svg>icon</svg>"))+`" />
+		</svg>`))
+}
+
+func (s *IconFetcherSuite) TestFetchIconsFor(c *gc.C) {
+	var mu sync.Mutex
+	var fetched []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.URL.Path)
+		mu.Unlock()
+		fmt.Fprintf(w, "<svg>%s</svg>", r.URL.Path)
+	}))
+	defer ts.Close()
+
+	charmIds := []*charm.URL{
+		charm.MustParseURL("cs:trusty/mysql-23"),
+		charm.MustParseURL("cs:~bob/xenial/wordpress"),
+		charm.MustParseURL("cs:trusty/mysql-23"),
+	}
+	fetcher := &HTTPFetcher{
+		IconURL: func(ref *charm.URL) string {
+			return ts.URL + "/" + ref.Path()
+		},
+	}
+	icons, err := FetchIconsFor(context.Background(), fetcher, charmIds)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.DeepEquals, map[string]Icon{
+		"trusty/mysql-23": {
+			ContentType: "text/plain; charset=utf-8",
+			Data:        []byte("<svg>/trusty/mysql-23</svg>"),
+		},
+		"~bob/xenial/wordpress": {
+			ContentType: "text/plain; charset=utf-8",
+			Data:        []byte("<svg>/~bob/xenial/wordpress</svg>"),
+		},
+	})
+	sort.Strings(fetched)
+	c.Assert(fetched, gc.DeepEquals, []string{"/trusty/mysql-23", "/~bob/xenial/wordpress"})
+
+	// Fetchers without content types give SVG icons.
+	icons, err = FetchIconsFor(context.Background(), mapFetcher{
+		"trusty/mysql-23": []byte("<svg>mysql</svg>"),
+	}, charmIds[:1])
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.DeepEquals, map[string]Icon{
+		"trusty/mysql-23": {
+			ContentType: svgContentType,
+			Data:        []byte("<svg>mysql</svg>"),
+		},
+	})
+
+	icons, err = FetchIconsFor(context.Background(), fetcher, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.HasLen, 0)
+}
+
 func (s *IconFetcherSuite) TestHTTPFetchIcons(c *gc.C) {
 	fetchCount := 0
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -89,6 +244,108 @@ func (s *IconFetcherSuite) TestHTTPFetchIcons(c *gc.C) {
 	c.Assert(fetchCount, gc.Equals, 6)
 }
 
+func (s *IconFetcherSuite) TestHTTPFetchIconsReusesConnections(c *gc.C) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "<svg></svg>")
+	}))
+	var connsMu sync.Mutex
+	conns := 0
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connsMu.Lock()
+			defer connsMu.Unlock()
+			conns++
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	// Each render uses a new fetcher without a client.
+	for i := 0; i < 3; i++ {
+		fetcher := HTTPFetcher{
+			Concurrency: 1,
+			IconURL: func(ref *charm.URL) string {
+				return ts.URL + "/" + ref.Path() + ".svg"
+			},
+		}
+		_, err := fetcher.FetchIcons(b)
+		c.Assert(err, gc.IsNil)
+	}
+	connsMu.Lock()
+	defer connsMu.Unlock()
+	c.Assert(conns, gc.Equals, 1)
+}
+
+func (s *IconFetcherSuite) TestHTTPFetchIconsHostConcurrency(c *gc.C) {
+	var mu sync.Mutex
+	inFlight := make(map[string]int)
+	maxInFlight := make(map[string]int)
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			inFlight[name]++
+			inFlight["total"]++
+			for _, key := range []string{name, "total"} {
+				if inFlight[key] > maxInFlight[key] {
+					maxInFlight[key] = inFlight[key]
+				}
+			}
+			mu.Unlock()
+			time.Sleep(50 * time.Millisecond)
+			mu.Lock()
+			inFlight[name]--
+			inFlight["total"]--
+			mu.Unlock()
+			fmt.Fprintln(w, "<svg></svg>")
+		}
+	}
+	ts1 := httptest.NewServer(handler("ts1"))
+	defer ts1.Close()
+	ts2 := httptest.NewServer(handler("ts2"))
+	defer ts2.Close()
+
+	b := &charm.BundleData{
+		Services: make(map[string]*charm.ServiceSpec),
+	}
+	for i := 0; i < 8; i++ {
+		b.Services[fmt.Sprintf("service-%d", i)] = &charm.ServiceSpec{
+			Charm: fmt.Sprintf("cs:precise/service-%d", i),
+		}
+	}
+	fetcher := HTTPFetcher{
+		Concurrency:     3,
+		HostConcurrency: 2,
+		IconURL: func(ref *charm.URL) string {
+			if ref.Revision%2 == 0 {
+				return ts1.URL + "/" + ref.Path() + ".svg"
+			}
+			return ts2.URL + "/" + ref.Path() + ".svg"
+		},
+	}
+	icons, err := fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.HasLen, 8)
+	c.Assert(maxInFlight, gc.DeepEquals, map[string]int{
+		"ts1":   2,
+		"ts2":   2,
+		"total": 3,
+	})
+
+	// Errors from any host are reported.
+	ts2.Close()
+	_, err = fetcher.FetchIcons(b)
+	c.Assert(err, gc.ErrorMatches, `HTTP error fetching http://.*/precise/service-[1357].svg: .* \(and 3 more\)`)
+}
+
+func (s *IconFetcherSuite) TestSharedClient(c *gc.C) {
+	c.Assert(sharedClient(nil), gc.Equals, defaultClient)
+	c.Assert(defaultClient.Transport, gc.Not(gc.Equals), http.DefaultTransport)
+	client := &http.Client{}
+	c.Assert(sharedClient(client), gc.Equals, client)
+}
+
 func (s *IconFetcherSuite) TestHTTPBadIconURL(c *gc.C) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "bad-wolf", http.StatusForbidden)
@@ -117,3 +374,1148 @@ func (s *IconFetcherSuite) TestHTTPBadIconURL(c *gc.C) {
 	c.Assert(err, gc.ErrorMatches, fmt.Sprintf("cannot retrieve icon from %s.+\\.svg: 403 Forbidden.*", ts.URL))
 	c.Assert(iconMap, gc.IsNil)
 }
+
+func (s *IconFetcherSuite) TestHTTPFetchTypedIcons(c *gc.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "mongodb-21.svg") {
+			w.Header().Set("Content-Type", "image/png")
+			fmt.Fprint(w, "\x89PNG\r\n\x1a\n"+r.URL.Path)
+		} else {
+			w.Header().Set("Content-Type", "image/svg+xml")
+			fmt.Fprintf(w, "<svg>%s</svg>", r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	tsIconURL := func(ref *charm.URL) string {
+		return ts.URL + "/" + ref.Path() + ".svg"
+	}
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	err = b.Verify(nil, nil)
+	c.Assert(err, gc.IsNil)
+	fetcher := HTTPFetcher{
+		IconURL: tsIconURL,
+	}
+	icons, err := fetcher.FetchTypedIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.DeepEquals, map[string]Icon{
+		"~charming-devs/precise/elasticsearch-2": {
+			ContentType: "image/svg+xml",
+			Data:        []byte("<svg>/~charming-devs/precise/elasticsearch-2.svg</svg>"),
+		},
+		"~juju-jitsu/precise/charmworld-58": {
+			ContentType: "image/svg+xml",
+			Data:        []byte("<svg>/~juju-jitsu/precise/charmworld-58.svg</svg>"),
+		},
+		"precise/mongodb-21": {
+			ContentType: "image/png",
+			Data:        []byte("\x89PNG\r\n\x1a\n/precise/mongodb-21.svg"),
+		},
+	})
+}
+
+func (s *IconFetcherSuite) TestIconIsSVG(c *gc.C) {
+	tests := []struct {
+		contentType string
+		expected    bool
+	}{
+		{"image/svg+xml", true},
+		{"image/svg+xml; charset=utf-8", true},
+		{"text/xml; charset=utf-8", true},
+		{"", true},
+		{"image/png", false},
+		{"image/jpeg", false},
+	}
+	for _, test := range tests {
+		c.Logf("content type %q", test.contentType)
+		icon := Icon{ContentType: test.contentType}
+		c.Assert(icon.isSVG(), gc.Equals, test.expected)
+	}
+}
+
+func (s *IconFetcherSuite) TestHTTPFetchIconsProgress(c *gc.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "mongodb-21.svg") {
+			http.Error(w, "bad-wolf", http.StatusNotFound)
+			return
+		}
+		fmt.Fprintln(w, "<svg></svg>")
+	}))
+	defer ts.Close()
+
+	tsIconURL := func(ref *charm.URL) string {
+		return ts.URL + "/" + ref.Path() + ".svg"
+	}
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	// Only one copy of precise/mongodb-21
+	b.Services["duplicateService"] = &charm.ServiceSpec{
+		Charm:    "cs:precise/mongodb-21",
+		NumUnits: 1,
+	}
+	var calls [][2]int
+	fetcher := HTTPFetcher{
+		IconURL: tsIconURL,
+		Progress: func(completed, total int) {
+			calls = append(calls, [2]int{completed, total})
+		},
+	}
+	_, err = fetcher.FetchIcons(b)
+	c.Assert(err, gc.ErrorMatches, "cannot retrieve icon from .*: 404 Not Found")
+	// Failed fetches are reported as completed too.
+	c.Assert(calls, gc.DeepEquals, [][2]int{{1, 3}, {2, 3}, {3, 3}})
+}
+
+func (s *IconFetcherSuite) TestHTTPFetchIconPolicies(c *gc.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			http.Error(w, "bad-wolf", http.StatusNotFound)
+		case "/empty":
+		case "/default":
+			fmt.Fprint(w, "<svg>default</svg>")
+		default:
+			fmt.Fprint(w, "<svg>icon</svg>")
+		}
+	}))
+	defer ts.Close()
+
+	placeholder := Icon{
+		ContentType: svgContentType,
+		Data:        []byte(placeholderIcon),
+		Substitute:  true,
+	}
+	isDefaultIcon := func(icon Icon) bool {
+		return string(icon.Data) == "<svg>default</svg>"
+	}
+	tests := []struct {
+		about       string
+		path        string
+		fetcher     HTTPFetcher
+		expectIcon  Icon
+		expectError string
+	}{{
+		about:       "not found fails by default",
+		path:        "/missing",
+		expectError: "cannot retrieve icon from .*: 404 Not Found",
+	}, {
+		about: "not found uses response",
+		path:  "/missing",
+		fetcher: HTTPFetcher{
+			NotFound: IconUseResponse,
+		},
+		expectIcon: Icon{
+			ContentType: "text/plain; charset=utf-8",
+			Data:        []byte("bad-wolf\n"),
+		},
+	}, {
+		about: "not found uses placeholder",
+		path:  "/missing",
+		fetcher: HTTPFetcher{
+			NotFound: IconUsePlaceholder,
+		},
+		expectIcon: placeholder,
+	}, {
+		about: "empty body uses response by default",
+		path:  "/empty",
+		expectIcon: Icon{
+			ContentType: svgContentType,
+			Data:        []byte{},
+		},
+	}, {
+		about: "empty body uses placeholder",
+		path:  "/empty",
+		fetcher: HTTPFetcher{
+			EmptyIcon: IconUsePlaceholder,
+		},
+		expectIcon: placeholder,
+	}, {
+		about: "empty body fails",
+		path:  "/empty",
+		fetcher: HTTPFetcher{
+			EmptyIcon: IconFail,
+		},
+		expectError: "no icon data at .*/empty",
+	}, {
+		about: "default icon uses response by default",
+		path:  "/default",
+		fetcher: HTTPFetcher{
+			IsDefaultIcon: isDefaultIcon,
+		},
+		expectIcon: Icon{
+			ContentType: "text/plain; charset=utf-8",
+			Data:        []byte("<svg>default</svg>"),
+		},
+	}, {
+		about: "default icon uses placeholder",
+		path:  "/default",
+		fetcher: HTTPFetcher{
+			DefaultIcon:   IconUsePlaceholder,
+			IsDefaultIcon: isDefaultIcon,
+		},
+		expectIcon: placeholder,
+	}, {
+		about: "default icon fails",
+		path:  "/default",
+		fetcher: HTTPFetcher{
+			DefaultIcon:   IconFail,
+			IsDefaultIcon: isDefaultIcon,
+		},
+		expectError: ".*/default holds the default icon",
+	}, {
+		about: "default icon is not recognized without IsDefaultIcon",
+		path:  "/default",
+		fetcher: HTTPFetcher{
+			DefaultIcon: IconFail,
+		},
+		expectIcon: Icon{
+			ContentType: "text/plain; charset=utf-8",
+			Data:        []byte("<svg>default</svg>"),
+		},
+	}, {
+		about: "icons are unaffected by policies",
+		path:  "/icon",
+		fetcher: HTTPFetcher{
+			NotFound:      IconFail,
+			EmptyIcon:     IconFail,
+			DefaultIcon:   IconFail,
+			IsDefaultIcon: isDefaultIcon,
+		},
+		expectIcon: Icon{
+			ContentType: "text/plain; charset=utf-8",
+			Data:        []byte("<svg>icon</svg>"),
+		},
+	}}
+	b, err := charm.ReadBundleData(strings.NewReader(`
+services:
+  mongodb:
+    charm: "cs:precise/mongodb-21"
+    num_units: 1
+`))
+	c.Assert(err, gc.IsNil)
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		fetcher := test.fetcher
+		fetcher.IconURL = func(*charm.URL) string {
+			return ts.URL + test.path
+		}
+		icons, err := fetcher.FetchTypedIcons(b)
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+			continue
+		}
+		c.Assert(err, gc.IsNil)
+		c.Assert(icons, gc.DeepEquals, map[string]Icon{
+			"precise/mongodb-21": test.expectIcon,
+		})
+	}
+}
+
+func (s *IconFetcherSuite) TestHTTPFetchIconsRetries(c *gc.C) {
+	var mu sync.Mutex
+	failures := 0
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		if failures > 0 {
+			failures--
+			http.Error(w, "bad-wolf", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "<svg></svg>")
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(`
+services:
+  mongodb:
+    charm: "cs:precise/mongodb-21"
+    num_units: 1
+`))
+	c.Assert(err, gc.IsNil)
+	tests := []struct {
+		about          string
+		path           string
+		failures       int
+		retries        int
+		expectRequests int
+		expectError    string
+	}{{
+		about:          "no retries",
+		failures:       1,
+		expectRequests: 1,
+		expectError:    "cannot retrieve icon from .*: 503 Service Unavailable",
+	}, {
+		about:          "retries succeed",
+		failures:       2,
+		retries:        2,
+		expectRequests: 3,
+	}, {
+		about:          "retries exhausted",
+		failures:       3,
+		retries:        2,
+		expectRequests: 3,
+		expectError:    "cannot retrieve icon from .*: 503 Service Unavailable",
+	}, {
+		about:          "other failures are not retried",
+		path:           "/missing",
+		retries:        2,
+		expectRequests: 1,
+		expectError:    "cannot retrieve icon from .*: 404 Not Found",
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		mu.Lock()
+		failures = test.failures
+		requests = 0
+		mu.Unlock()
+		path := test.path
+		if path == "" {
+			path = "/icon"
+		}
+		fetcher := HTTPFetcher{
+			IconURL: func(*charm.URL) string {
+				return ts.URL + path
+			},
+			Retries:    test.retries,
+			RetryDelay: time.Millisecond,
+		}
+		icons, err := fetcher.FetchIcons(b)
+		mu.Lock()
+		c.Assert(requests, gc.Equals, test.expectRequests)
+		mu.Unlock()
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+			continue
+		}
+		c.Assert(err, gc.IsNil)
+		c.Assert(icons, gc.DeepEquals, map[string][]byte{
+			"precise/mongodb-21": []byte("<svg></svg>"),
+		})
+	}
+}
+
+func (s *IconFetcherSuite) TestHTTPFetchIconsRetryBackoff(c *gc.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad-wolf", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	fetcher := HTTPFetcher{
+		IconURL: func(ref *charm.URL) string {
+			return ts.URL + "/" + ref.Path()
+		},
+		Retries:    10,
+		RetryDelay: time.Hour,
+	}
+	// Waiting to retry gives up when the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = fetcher.FetchTypedIconsContext(ctx, b)
+	c.Assert(err, gc.Equals, context.DeadlineExceeded)
+}
+
+func (s *IconFetcherSuite) TestHTTPFetchIconsRetryJitter(c *gc.C) {
+	var mu sync.Mutex
+	var times []time.Time
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		times = append(times, time.Now())
+		http.Error(w, "bad-wolf", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(`
+services:
+  mongodb:
+    charm: "cs:precise/mongodb-21"
+    num_units: 1
+`))
+	c.Assert(err, gc.IsNil)
+	fetcher := HTTPFetcher{
+		IconURL: func(*charm.URL) string {
+			return ts.URL + "/icon"
+		},
+		Retries:    3,
+		RetryDelay: 20 * time.Millisecond,
+		Rand:       rand.New(rand.NewSource(1)),
+	}
+	// Each delay is chosen at random up to twice the one before,
+	// reproducibly with the same seed.
+	r := rand.New(rand.NewSource(1))
+	var expect []time.Duration
+	for _, delay := range []time.Duration{20, 40, 80} {
+		expect = append(expect, time.Duration(r.Int63n(int64(delay*time.Millisecond))))
+	}
+	_, err = fetcher.FetchIcons(b)
+	c.Assert(err, gc.ErrorMatches, "cannot retrieve icon from .*: 503 Service Unavailable")
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(times, gc.HasLen, 4)
+	for i, delay := range expect {
+		c.Logf("retry %d: expect delay %v", i, delay)
+		c.Assert(times[i+1].Sub(times[i]) >= delay, gc.Equals, true)
+	}
+
+	fetcher.Rand = rand.New(rand.NewSource(1))
+	for i, delay := range []time.Duration{20, 40, 80} {
+		c.Assert(fetcher.jitter(delay*time.Millisecond), gc.Equals, expect[i])
+	}
+}
+
+func (s *IconFetcherSuite) TestHTTPFetchIconsFallback(c *gc.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "mongodb"):
+			http.NotFound(w, r)
+		case strings.Contains(r.URL.Path, "elasticsearch"):
+			http.Error(w, "bad-wolf", http.StatusInternalServerError)
+		case strings.Contains(r.URL.Path, "haproxy"):
+			// An empty icon.
+		default:
+			fmt.Fprint(w, "<svg>icon</svg>")
+		}
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	b.Services["haproxy"] = &charm.ServiceSpec{
+		Charm:    "cs:precise/haproxy-35",
+		NumUnits: 1,
+	}
+	fetcher := HTTPFetcher{
+		IconURL: func(ref *charm.URL) string {
+			return ts.URL + "/" + ref.Path()
+		},
+		Fallback:  []byte("<svg>fallback</svg>"),
+		EmptyIcon: IconFail,
+	}
+	icons, err := fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.DeepEquals, map[string][]byte{
+		"precise/haproxy-35":                     []byte("<svg>fallback</svg>"),
+		"precise/mongodb-21":                     []byte("<svg>fallback</svg>"),
+		"~charming-devs/precise/elasticsearch-2": []byte("<svg>fallback</svg>"),
+		"~juju-jitsu/precise/charmworld-58":      []byte("<svg>icon</svg>"),
+	})
+
+	// Without a fallback, the fetch fails.
+	fetcher.Fallback = nil
+	_, err = fetcher.FetchIcons(b)
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *IconFetcherSuite) TestHTTPFetchIconsMaxIconSize(c *gc.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "mongodb"):
+			fmt.Fprint(w, "<svg>too large</svg>")
+		case strings.Contains(r.URL.Path, "elasticsearch"):
+			// Flushing before writing the icon means the
+			// response has no Content-Length.
+			w.(http.Flusher).Flush()
+			fmt.Fprint(w, "<svg>too large</svg>")
+		default:
+			fmt.Fprint(w, "<svg>icon</svg>")
+		}
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	fetcher := HTTPFetcher{
+		IconURL: func(ref *charm.URL) string {
+			return ts.URL + "/" + ref.Path()
+		},
+		MaxIconSize: int64(len("<svg>icon</svg>")),
+		Fallback:    []byte("<svg>fallback</svg>"),
+	}
+	icons, err := fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.DeepEquals, map[string][]byte{
+		"precise/mongodb-21":                     []byte("<svg>fallback</svg>"),
+		"~charming-devs/precise/elasticsearch-2": []byte("<svg>fallback</svg>"),
+		"~juju-jitsu/precise/charmworld-58":      []byte("<svg>icon</svg>"),
+	})
+
+	fetcher.Fallback = nil
+	_, err = fetcher.FetchIcons(b)
+	c.Assert(err, gc.ErrorMatches, `icon at .* exceeds maximum size of 15 bytes( \(and 1 more\))?`)
+
+	// Without a limit, any size is accepted.
+	fetcher.MaxIconSize = 0
+	icons, err = fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(icons["precise/mongodb-21"]), gc.Equals, "<svg>too large</svg>")
+}
+
+func (s *IconFetcherSuite) TestHTTPFetchIconsModifyRequest(c *gc.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+strings.TrimPrefix(r.URL.Path, "/") {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, "<svg>%s</svg>", r.UserAgent())
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	fetcher := HTTPFetcher{
+		IconURL: func(ref *charm.URL) string {
+			return ts.URL + "/" + ref.Path()
+		},
+		ModifyRequest: func(req *http.Request, charmId *charm.URL) error {
+			req.Header.Set("Authorization", "Bearer "+charmId.Path())
+			req.Header.Set("User-Agent", "jujusvg-test")
+			return nil
+		},
+	}
+	icons, err := fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.DeepEquals, map[string][]byte{
+		"precise/mongodb-21":                     []byte("<svg>jujusvg-test</svg>"),
+		"~charming-devs/precise/elasticsearch-2": []byte("<svg>jujusvg-test</svg>"),
+		"~juju-jitsu/precise/charmworld-58":      []byte("<svg>jujusvg-test</svg>"),
+	})
+
+	fetcher.ModifyRequest = func(req *http.Request, charmId *charm.URL) error {
+		return errgo.New("bad-wolf")
+	}
+	_, err = fetcher.FetchIcons(b)
+	c.Assert(err, gc.ErrorMatches, `cannot make request for .*: bad-wolf \(and 2 more\)`)
+}
+
+func (s *IconFetcherSuite) TestHTTPFetchIconsCache(c *gc.C) {
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	var mu sync.Mutex
+	mongodbETag := `"v1"`
+	var fullResponses []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case strings.Contains(r.URL.Path, "mongodb"):
+			w.Header().Set("ETag", mongodbETag)
+			if r.Header.Get("If-None-Match") == mongodbETag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case strings.Contains(r.URL.Path, "elasticsearch"):
+			w.Header().Set("Last-Modified", lastModified)
+			if r.Header.Get("If-Modified-Since") == lastModified {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		fullResponses = append(fullResponses, r.URL.Path)
+		fmt.Fprintf(w, "<svg>%s</svg>", mongodbETag)
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	fetcher := HTTPFetcher{
+		IconURL: func(ref *charm.URL) string {
+			return ts.URL + "/" + ref.Path()
+		},
+		Cache: new(MemoryIconCache),
+	}
+	expected := map[string][]byte{
+		"precise/mongodb-21":                     []byte(`<svg>"v1"</svg>`),
+		"~charming-devs/precise/elasticsearch-2": []byte(`<svg>"v1"</svg>`),
+		"~juju-jitsu/precise/charmworld-58":      []byte(`<svg>"v1"</svg>`),
+	}
+	icons, err := fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.DeepEquals, expected)
+	c.Assert(fullResponses, gc.HasLen, 3)
+
+	// Icons with validators are taken from the cache.
+	mu.Lock()
+	fullResponses = nil
+	mu.Unlock()
+	icons, err = fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.DeepEquals, expected)
+	c.Assert(fullResponses, gc.DeepEquals, []string{"/~juju-jitsu/precise/charmworld-58"})
+
+	// Changed icons are fetched again.
+	mu.Lock()
+	fullResponses = nil
+	mongodbETag = `"v2"`
+	mu.Unlock()
+	icons, err = fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(icons["precise/mongodb-21"]), gc.Equals, `<svg>"v2"</svg>`)
+	c.Assert(string(icons["~charming-devs/precise/elasticsearch-2"]), gc.Equals, `<svg>"v1"</svg>`)
+	sort.Strings(fullResponses)
+	c.Assert(fullResponses, gc.DeepEquals, []string{
+		"/precise/mongodb-21",
+		"/~juju-jitsu/precise/charmworld-58",
+	})
+	cached, ok := fetcher.Cache.Get(ts.URL + "/precise/mongodb-21")
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(cached.ETag, gc.Equals, `"v2"`)
+}
+
+func (s *IconFetcherSuite) TestHTTPFetchIconsThrottled(c *gc.C) {
+	var mu sync.Mutex
+	throttled := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if throttled > 0 {
+			throttled--
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, "<svg></svg>")
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	fetcher := HTTPFetcher{
+		Concurrency: 1,
+		IconURL: func(ref *charm.URL) string {
+			return ts.URL + "/" + ref.Path()
+		},
+		RetryDelay: time.Millisecond,
+	}
+	throttled = 1
+	_, err = fetcher.FetchIcons(b)
+	c.Assert(err, gc.ErrorMatches, "icon fetch throttled: cannot retrieve icon from .*: 429 Too Many Requests")
+	c.Assert(errgo.Cause(err), gc.Equals, ErrThrottled)
+
+	// Throttled requests are retried.
+	throttled = 2
+	fetcher.Retries = 2
+	icons, err := fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.HasLen, 3)
+}
+
+func (s *IconFetcherSuite) TestHTTPFetchIconsRateLimiter(c *gc.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<svg></svg>")
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	fetcher := HTTPFetcher{
+		IconURL: func(ref *charm.URL) string {
+			return ts.URL + "/" + ref.Path()
+		},
+		RateLimiter: NewRateLimiter(50, 1),
+	}
+	start := time.Now()
+	icons, err := fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.HasLen, 3)
+	// The second and third requests wait for 20ms each.
+	c.Assert(time.Since(start) >= 40*time.Millisecond, gc.Equals, true)
+
+	// Waiting for the limiter is bounded by the context.
+	fetcher.RateLimiter = NewRateLimiter(0.1, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = fetcher.FetchTypedIconsContext(ctx, b)
+	c.Assert(err, gc.ErrorMatches, ".*context deadline exceeded.*")
+}
+
+func (s *IconFetcherSuite) TestHTTPFetchIconsAllowErrors(c *gc.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "mongodb"):
+			http.NotFound(w, r)
+		case strings.Contains(r.URL.Path, "elasticsearch"):
+			http.Error(w, "bad-wolf", http.StatusInternalServerError)
+		default:
+			fmt.Fprint(w, "<svg>icon</svg>")
+		}
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	fetcher := HTTPFetcher{
+		IconURL: func(ref *charm.URL) string {
+			return ts.URL + "/" + ref.Path()
+		},
+	}
+	icons, failed, err := fetcher.FetchTypedIconsPartial(context.Background(), b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(iconData(icons), gc.DeepEquals, map[string][]byte{
+		"~juju-jitsu/precise/charmworld-58": []byte("<svg>icon</svg>"),
+	})
+	c.Assert(failed, gc.HasLen, 2)
+	c.Assert(failed["precise/mongodb-21"], gc.ErrorMatches, "cannot retrieve icon from .*: 404 Not Found")
+	c.Assert(failed["~charming-devs/precise/elasticsearch-2"], gc.ErrorMatches, "cannot retrieve icon from .*: 500 Internal Server Error")
+
+	// Without AllowErrors, the fetch fails.
+	_, err = fetcher.FetchIcons(b)
+	c.Assert(err, gc.NotNil)
+
+	fetcher.AllowErrors = true
+	iconMap, err := fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(iconMap, gc.DeepEquals, map[string][]byte{
+		"~juju-jitsu/precise/charmworld-58": []byte("<svg>icon</svg>"),
+	})
+
+	// The context still limits the whole fetch.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = fetcher.FetchTypedIconsPartial(ctx, b)
+	c.Assert(err, gc.Equals, context.Canceled)
+}
+
+func (s *IconFetcherSuite) TestHTTPFetchIconsInvalid(c *gc.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "mongodb"):
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, "<!DOCTYPE html><html><body>Sign in</body></html>")
+		case strings.Contains(r.URL.Path, "elasticsearch"):
+			// Servers often report SVG icons as plain text.
+			w.Header().Set("Content-Type", "text/plain")
+			fmt.Fprint(w, `<?xml version="1.0"?><!-- icon --><svg>icon</svg>`)
+		default:
+			fmt.Fprint(w, "<svg>icon</svg>")
+		}
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	fetcher := HTTPFetcher{
+		IconURL: func(ref *charm.URL) string {
+			return ts.URL + "/" + ref.Path()
+		},
+	}
+	icons, failed, err := fetcher.FetchTypedIconsPartial(context.Background(), b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.HasLen, 2)
+	c.Assert(failed, gc.HasLen, 1)
+	invalidErr, ok := failed["precise/mongodb-21"].(*InvalidIconError)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(invalidErr.CharmId.String(), gc.Equals, "cs:precise/mongodb-21")
+	c.Assert(invalidErr.URL, gc.Equals, ts.URL+"/precise/mongodb-21")
+	c.Assert(invalidErr.ContentType, gc.Equals, "text/html")
+	c.Assert(invalidErr, gc.ErrorMatches, `invalid icon for cs:precise/mongodb-21 at .*: text/html is not an SVG document or image`)
+
+	fetcher.InvalidIcon = IconUsePlaceholder
+	iconMap, err := fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(iconMap["precise/mongodb-21"]), gc.Equals, placeholderIcon)
+
+	fetcher.InvalidIcon = IconUseResponse
+	iconMap, err = fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(iconMap["precise/mongodb-21"]), gc.Equals, "<!DOCTYPE html><html><body>Sign in</body></html>")
+}
+
+func (s *IconFetcherSuite) TestHTTPFetchIconsCompressed(c *gc.C) {
+	gzipped := func(data string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		fmt.Fprint(zw, data)
+		zw.Close()
+		return buf.Bytes()
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.Contains(r.URL.Path, "mongodb"):
+			// A compressed icon, as held in .svgz files.
+			w.Header().Set("Content-Type", svgContentType)
+			w.Write(gzipped("<svg>mongodb</svg>"))
+		case strings.Contains(r.URL.Path, "elasticsearch"):
+			// A response compressed although the client did
+			// not ask for it.
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gzipped("<svg>elasticsearch</svg>"))
+		default:
+			w.Write(gzipped("<svg>" + strings.Repeat("x", 1000) + "</svg>"))
+		}
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	fetcher := HTTPFetcher{
+		IconURL: func(ref *charm.URL) string {
+			return ts.URL + "/" + ref.Path()
+		},
+		ModifyRequest: func(req *http.Request, charmId *charm.URL) error {
+			req.Header.Set("Accept-Encoding", "identity")
+			return nil
+		},
+		MaxIconSize: 500,
+	}
+	icons, failed, err := fetcher.FetchTypedIconsPartial(context.Background(), b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(iconData(icons), gc.DeepEquals, map[string][]byte{
+		"precise/mongodb-21":                     []byte("<svg>mongodb</svg>"),
+		"~charming-devs/precise/elasticsearch-2": []byte("<svg>elasticsearch</svg>"),
+	})
+	// The size limit applies to the decompressed icon.
+	c.Assert(failed, gc.HasLen, 1)
+	c.Assert(failed["~juju-jitsu/precise/charmworld-58"], gc.ErrorMatches, "icon at .* exceeds maximum size of 500 bytes")
+}
+
+func (s *IconFetcherSuite) TestHTTPFetchIconsHooks(c *gc.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "elasticsearch") {
+			http.Error(w, "bad-wolf", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "<svg>icon</svg>")
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	var mu sync.Mutex
+	var started []string
+	done := make(map[string]string)
+	fetcher := HTTPFetcher{
+		IconURL: func(ref *charm.URL) string {
+			return ts.URL + "/" + ref.Path()
+		},
+		Fallback: []byte("<svg>fallback</svg>"),
+		OnFetchStart: func(charmId *charm.URL) {
+			mu.Lock()
+			defer mu.Unlock()
+			started = append(started, charmId.Path())
+		},
+		OnFetchDone: func(charmId *charm.URL, d time.Duration, size int, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			c.Check(d >= 0, gc.Equals, true)
+			done[charmId.Path()] = fmt.Sprintf("%d %v", size, err)
+		},
+	}
+	_, err = fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	sort.Strings(started)
+	c.Assert(started, gc.DeepEquals, []string{
+		"precise/mongodb-21",
+		"~charming-devs/precise/elasticsearch-2",
+		"~juju-jitsu/precise/charmworld-58",
+	})
+	// Failures are reported even though the fallback is used.
+	c.Assert(done, gc.HasLen, 3)
+	c.Assert(done["precise/mongodb-21"], gc.Equals, "15 <nil>")
+	c.Assert(done["~juju-jitsu/precise/charmworld-58"], gc.Equals, "15 <nil>")
+	c.Assert(done["~charming-devs/precise/elasticsearch-2"], gc.Matches, "0 cannot retrieve icon from .*: 500 Internal Server Error")
+}
+
+func (s *IconFetcherSuite) TestHTTPFetchIconsRevisionFallback(c *gc.C) {
+	var mu sync.Mutex
+	var requested []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/precise/mongodb", "/~juju-jitsu/precise/charmworld-58":
+			fmt.Fprintf(w, "<svg>%s</svg>", r.URL.Path)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	fetcher := HTTPFetcher{
+		IconURL: func(ref *charm.URL) string {
+			return ts.URL + "/" + ref.Path()
+		},
+		RevisionFallback: true,
+		NotFound:         IconUsePlaceholder,
+	}
+	icons, err := fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.DeepEquals, map[string][]byte{
+		"precise/mongodb-21":                     []byte("<svg>/precise/mongodb</svg>"),
+		"~charming-devs/precise/elasticsearch-2": []byte(placeholderIcon),
+		"~juju-jitsu/precise/charmworld-58":      []byte("<svg>/~juju-jitsu/precise/charmworld-58</svg>"),
+	})
+	sort.Strings(requested)
+	c.Assert(requested, gc.DeepEquals, []string{
+		"/precise/mongodb",
+		"/precise/mongodb-21",
+		"/~charming-devs/precise/elasticsearch",
+		"/~charming-devs/precise/elasticsearch-2",
+		"/~juju-jitsu/precise/charmworld-58",
+	})
+
+	// Without the option, missing revisions are not looked up.
+	fetcher.RevisionFallback = false
+	icons, err = fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(icons["precise/mongodb-21"]), gc.Equals, placeholderIcon)
+}
+
+func (s *IconFetcherSuite) TestHTTPFetchTypedIconsContext(c *gc.C) {
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		fmt.Fprintln(w, "<svg></svg>")
+	}))
+	defer ts.Close()
+	defer close(unblock)
+
+	tsIconURL := func(ref *charm.URL) string {
+		return ts.URL + "/" + ref.Path() + ".svg"
+	}
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	fetcher := HTTPFetcher{
+		IconURL: tsIconURL,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = fetcher.FetchTypedIconsContext(ctx, b)
+	c.Assert(err, gc.Equals, context.DeadlineExceeded)
+}
+
+func (s *IconFetcherSuite) TestHTTPFetchIconsContext(c *gc.C) {
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "mongodb") {
+			select {
+			case <-unblock:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		fmt.Fprintf(w, "<svg>%s</svg>", r.URL.Path)
+	}))
+	defer ts.Close()
+	defer close(unblock)
+
+	tsIconURL := func(ref *charm.URL) string {
+		return ts.URL + "/" + ref.Path() + ".svg"
+	}
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	fetcher := HTTPFetcher{
+		IconURL: tsIconURL,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = fetcher.FetchIconsContext(ctx, b)
+	c.Assert(err, gc.Equals, context.DeadlineExceeded)
+
+	delete(b.Services, "mongodb")
+	icons, err := fetcher.FetchIconsContext(context.Background(), b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.DeepEquals, map[string][]byte{
+		"~charming-devs/precise/elasticsearch-2": []byte("<svg>/~charming-devs/precise/elasticsearch-2.svg</svg>"),
+		"~juju-jitsu/precise/charmworld-58":      []byte("<svg>/~juju-jitsu/precise/charmworld-58.svg</svg>"),
+	})
+}
+
+func (s *IconFetcherSuite) TestHTTPFetchTypedIconsIconTimeout(c *gc.C) {
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "mongodb") {
+			<-unblock
+		}
+		fmt.Fprintf(w, "<svg>%s</svg>", r.URL.Path)
+	}))
+	defer ts.Close()
+	defer close(unblock)
+
+	tsIconURL := func(ref *charm.URL) string {
+		return ts.URL + "/" + ref.Path() + ".svg"
+	}
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	fetcher := HTTPFetcher{
+		IconURL:     tsIconURL,
+		IconTimeout: 50 * time.Millisecond,
+	}
+	// The slow icon is left out.
+	icons, err := fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.DeepEquals, map[string][]byte{
+		"~charming-devs/precise/elasticsearch-2": []byte("<svg>/~charming-devs/precise/elasticsearch-2.svg</svg>"),
+		"~juju-jitsu/precise/charmworld-58":      []byte("<svg>/~juju-jitsu/precise/charmworld-58.svg</svg>"),
+	})
+
+	// The context limits the time taken by the whole fetch.
+	fetcher.IconTimeout = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = fetcher.FetchTypedIconsContext(ctx, b)
+	c.Assert(err, gc.Equals, context.DeadlineExceeded)
+}
+
+// recordingFetcher is an IconFetcher which records the services in each
+// bundle it is asked for icons for.
+type recordingFetcher struct {
+	IconFetcher
+	services [][]string
+}
+
+func (f *recordingFetcher) FetchIcons(b *charm.BundleData) (map[string][]byte, error) {
+	var names []string
+	for name := range b.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	f.services = append(f.services, names)
+	return f.IconFetcher.FetchIcons(b)
+}
+
+func (s *IconFetcherSuite) TestChainFetcher(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	local := &recordingFetcher{
+		IconFetcher: mapFetcher{
+			"precise/mongodb-21": []byte("<svg>local</svg>"),
+		},
+	}
+	ef := errFetcher("unavailable")
+	failing := &recordingFetcher{
+		IconFetcher: &ef,
+	}
+	network := &recordingFetcher{
+		IconFetcher: mapFetcher{
+			"precise/mongodb-21":                     []byte("<svg>network</svg>"),
+			"~juju-jitsu/precise/charmworld-58":      []byte("<svg>network</svg>"),
+			"~charming-devs/precise/elasticsearch-2": []byte(""),
+		},
+	}
+	defaults := &recordingFetcher{
+		IconFetcher: mapFetcher{
+			"~charming-devs/precise/elasticsearch-2": []byte("<svg>default</svg>"),
+		},
+	}
+	icons, err := ChainFetcher{local, failing, network, defaults}.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.DeepEquals, map[string][]byte{
+		"precise/mongodb-21":                     []byte("<svg>local</svg>"),
+		"~juju-jitsu/precise/charmworld-58":      []byte("<svg>network</svg>"),
+		"~charming-devs/precise/elasticsearch-2": []byte("<svg>default</svg>"),
+	})
+	// Each fetcher is only asked for the icons not yet found.
+	c.Assert(local.services, gc.DeepEquals, [][]string{{"charmworld", "elasticsearch", "mongodb"}})
+	c.Assert(failing.services, gc.DeepEquals, [][]string{{"charmworld", "elasticsearch"}})
+	c.Assert(network.services, gc.DeepEquals, [][]string{{"charmworld", "elasticsearch"}})
+	c.Assert(defaults.services, gc.DeepEquals, [][]string{{"elasticsearch"}})
+}
+
+func (s *IconFetcherSuite) TestChainFetcherErrors(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	ef := errFetcher("unavailable")
+	local := mapFetcher{
+		"precise/mongodb-21": []byte("<svg>local</svg>"),
+	}
+	// When the last fetcher fails, the icons found before it are
+	// kept and the others are left out.
+	icons, err := ChainFetcher{local, &ef}.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.DeepEquals, map[string][]byte{
+		"precise/mongodb-21": []byte("<svg>local</svg>"),
+	})
+
+	// The error from the last fetcher is reported for each icon
+	// left out.
+	typedIcons, failed, err := ChainFetcher{local, &ef}.FetchTypedIconsPartial(context.Background(), b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(typedIcons, gc.HasLen, 1)
+	c.Assert(typedIcons["precise/mongodb-21"].Data, gc.DeepEquals, []byte("<svg>local</svg>"))
+	c.Assert(failed, gc.HasLen, 2)
+	c.Assert(failed["~juju-jitsu/precise/charmworld-58"], gc.ErrorMatches, "unavailable")
+	c.Assert(failed["~charming-devs/precise/elasticsearch-2"], gc.ErrorMatches, "unavailable")
+
+	// The last fetcher is not used if it is not needed.
+	icons, err = ChainFetcher{local, mapFetcher{
+		"~juju-jitsu/precise/charmworld-58":      []byte("<svg></svg>"),
+		"~charming-devs/precise/elasticsearch-2": []byte("<svg></svg>"),
+	}, &ef}.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.HasLen, 3)
+
+	// No fetchers are tried once the context is done.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ChainFetcher{local}.FetchTypedIconsContext(ctx, b)
+	c.Assert(err, gc.Equals, context.Canceled)
+}
+
+func (s *IconFetcherSuite) TestChainFetcherPartialLastFetcher(c *gc.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "elasticsearch") {
+			http.Error(w, "bad-wolf", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "<svg>network</svg>")
+	}))
+	defer ts.Close()
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	local := mapFetcher{
+		"precise/mongodb-21": []byte("<svg>local</svg>"),
+	}
+	network := &HTTPFetcher{
+		IconURL: func(ref *charm.URL) string {
+			return ts.URL + "/" + ref.Path()
+		},
+	}
+	// The last fetcher reports which of the icons it was asked for
+	// could not be fetched.
+	icons, failed, err := ChainFetcher{local, network}.FetchTypedIconsPartial(context.Background(), b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(iconData(icons), gc.DeepEquals, map[string][]byte{
+		"precise/mongodb-21":                []byte("<svg>local</svg>"),
+		"~juju-jitsu/precise/charmworld-58": []byte("<svg>network</svg>"),
+	})
+	c.Assert(failed, gc.HasLen, 1)
+	c.Assert(failed["~charming-devs/precise/elasticsearch-2"], gc.ErrorMatches, "cannot retrieve icon from .*: 500 Internal Server Error")
+}
+
+func (s *IconFetcherSuite) TestUniqueCharms(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	b.Services["duplicateService"] = &charm.ServiceSpec{
+		Charm:    "cs:precise/mongodb-21",
+		NumUnits: 1,
+	}
+	charmIds, err := UniqueCharms(b)
+	c.Assert(err, gc.IsNil)
+	var paths []string
+	for _, id := range charmIds {
+		paths = append(paths, id.Path())
+	}
+	c.Assert(paths, gc.DeepEquals, []string{
+		"precise/mongodb-21",
+		"~charming-devs/precise/elasticsearch-2",
+		"~juju-jitsu/precise/charmworld-58",
+	})
+
+	b.Services["bad"] = &charm.ServiceSpec{
+		Charm: "bad:wolf",
+	}
+	_, err = UniqueCharms(b)
+	c.Assert(err, gc.ErrorMatches, `cannot parse charm "bad:wolf": .*`)
+}
@@ -1,16 +1,26 @@
 package jujusvg // import "gopkg.in/juju/jujusvg.v1"
 
 import (
+	"bytes"
+	"context"
 	"image"
+	"io"
+	"io/ioutil"
 	"math"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/charm.v6-unstable"
 )
 
+// timeNow is the function used to find the current time. It is
+// replaced in tests.
+var timeNow = time.Now
+
 // NewFromBundle returns a new Canvas that can be used
 // to generate a graphical representation of the given bundle
 // data. The iconURL function is used to generate a URL
@@ -19,25 +29,212 @@ import (
 // contents for any icons embedded within the charm,
 // allowing the generated bundle to be self-contained. If fetcher
 // is nil, a default fetcher which refers to icons by their
-// URLs as svg <image> tags will be used.
-func NewFromBundle(b *charm.BundleData, iconURL func(*charm.URL) string, fetcher IconFetcher) (*Canvas, error) {
-	if fetcher == nil {
-		fetcher = &LinkFetcher{
-			IconURL: iconURL,
-		}
+// URLs as svg <image> tags will be used, unless another
+// is chosen with WithIconMode. Any options are
+// applied to the returned Canvas.
+func NewFromBundle(b *charm.BundleData, iconURL func(*charm.URL) string, fetcher IconFetcher, opts ...CanvasOption) (*Canvas, error) {
+	return NewFromBundleContext(context.Background(), b, iconURL, fetcher, opts...)
+}
+
+// NewFromBundleContext is like NewFromBundle, but returns ctx.Err() if ctx
+// is done before the canvas has been created, without doing the
+// remaining work. Icons are fetched with the context if fetcher is a
+// ContextIconFetcher.
+func NewFromBundleContext(ctx context.Context, b *charm.BundleData, iconURL func(*charm.URL) string, fetcher IconFetcher, opts ...CanvasOption) (*Canvas, error) {
+	canvas := Canvas{
+		series:      b.Series,
+		description: b.Description,
+		tags:        b.Tags,
 	}
-	iconMap, err := fetcher.FetchIcons(b)
-	if err != nil {
-		return nil, err
+	for _, opt := range opts {
+		opt(&canvas)
+	}
+	b = canvas.withoutDuplicateRelations(b)
+	var crossModelRelations, selfRelations [][]string
+	if canvas.crossModel {
+		b, crossModelRelations = splitCrossModelRelations(b)
+	}
+	if canvas.selfRelations {
+		b, selfRelations = splitSelfRelations(b)
 	}
 
-	var canvas Canvas
+	if fetcher == nil {
+		fetcher = canvas.defaultFetcher(iconURL)
+	}
+	var icons map[string]Icon
+	if !canvas.topologyOnly {
+		var err error
+		icons, err = fetchIcons(ctx, fetcher, b)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// Verify the bundle to make sure that all the invariants
 	// that we depend on below actually hold true.
 	if err := b.Verify(nil, nil); err != nil {
 		return nil, errgo.Notef(err, "cannot verify bundle")
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	services, servicesNeedingPlacement, err := canvas.newServices(b, iconURL, icons)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	canvas.placeServices(services, servicesNeedingPlacement)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	for _, name := range sortedServiceNames(services) {
+		canvas.addService(services[name])
+	}
+	for _, svc := range canvas.addOfferServices(services, crossModelRelations) {
+		canvas.addService(svc)
+	}
+	for _, relation := range append(append(b.Relations, crossModelRelations...), selfRelations...) {
+		r, err := canvas.newRelation(relation, services)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			if r.dash == "" && (r.serviceA.offer || r.serviceB.offer) {
+				r.dash = offerRelationDash
+			}
+			canvas.addRelation(r)
+		}
+	}
+	canvas.weighRelations()
+	if err := canvas.dimUnfocused(); err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &canvas, nil
+}
+
+// dimUnfocused dims the services and relations not directly connected to
+// the service chosen with WithFocus, if any.
+func (c *Canvas) dimUnfocused() error {
+	if c.focus == "" {
+		return nil
+	}
+	neighbors := make(map[*service]bool)
+	for _, s := range c.services {
+		if s.name == c.focus {
+			neighbors[s] = true
+		}
+	}
+	if len(neighbors) == 0 {
+		return errgo.Newf("focus service %q not found", c.focus)
+	}
+	for _, r := range c.relations {
+		switch {
+		case r.serviceA.name == c.focus:
+			neighbors[r.serviceB] = true
+		case r.serviceB.name == c.focus:
+			neighbors[r.serviceA] = true
+		default:
+			r.dimmed = true
+		}
+	}
+	for _, s := range c.services {
+		s.dimmed = !neighbors[s]
+	}
+	return nil
+}
+
+// defaultFetcher returns the fetcher used when none is specified, as
+// chosen with WithIconMode.
+func (c *Canvas) defaultFetcher(iconURL func(*charm.URL) string) IconFetcher {
+	if c.iconMode == IconsEmbedded {
+		return &HTTPFetcher{
+			IconURL: iconURL,
+		}
+	}
+	return &LinkFetcher{
+		IconURL: iconURL,
+	}
+}
+
+// newRelation creates the relation between the given endpoints of the
+// given services. It returns nil if either service is not shown.
+func (c *Canvas) newRelation(endpoints []string, services map[string]*service) (*serviceRelation, error) {
+	serviceA := services[endpointService(endpoints[0])]
+	serviceB := services[endpointService(endpoints[1])]
+	if serviceA == nil || serviceB == nil {
+		return nil, nil
+	}
+	r := &serviceRelation{
+		serviceA:       serviceA,
+		serviceB:       serviceB,
+		interfaceName:  endpointsInterface(endpoints),
+		perimeter:      c.perimeterRelations,
+		formatLength:   c.formatLength,
+		colorBlindSafe: c.colorBlindSafe,
+	}
+	if c.relationWeight != nil {
+		r.weight, r.weighted = c.relationWeight(endpoints)
+	}
+	if c.relationNote != nil {
+		r.note = c.relationNote(endpoints)
+	}
+	if r.interfaceName == "" {
+		return r, nil
+	}
+	if c.interfaceColor != nil {
+		r.color = c.interfaceColor(r.interfaceName)
+	}
+	if c.interfaceDash != nil {
+		dash, err := parseDashPattern(c.interfaceDash(r.interfaceName))
+		if err != nil {
+			return nil, errgo.Notef(err, "invalid dash pattern for interface %q", r.interfaceName)
+		}
+		r.dash = dash
+	} else if c.colorBlindSafe && c.interfaceColor != nil {
+		r.dash = colorBlindInterfaceDashes[paletteIndex(r.interfaceName, len(colorBlindInterfaceDashes))]
+	}
+	return r, nil
+}
+
+// parseDashPattern checks that the given dash pattern is a list of
+// non-negative numbers separated by commas or spaces, not all of which
+// are zero, and returns it in canonical form.
+func parseDashPattern(pattern string) (string, error) {
+	fields := strings.FieldsFunc(pattern, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	if len(fields) == 0 {
+		return "", nil
+	}
+	total := 0.0
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil || v < 0 || math.IsInf(v, 0) {
+			return "", errgo.Newf("%q is not a non-negative number", f)
+		}
+		total += v
+		fields[i] = strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	if total == 0 {
+		return "", errgo.Newf("%q has no dashes", pattern)
+	}
+	return strings.Join(fields, ", "), nil
+}
+
+// newServices creates a service for each service in the given bundle
+// which is not hidden, returning them keyed by name along with the set of
+// services which have no position and so need to be placed.
+func (c *Canvas) newServices(b *charm.BundleData, iconURL func(*charm.URL) string, icons map[string]Icon) (map[string]*service, map[string]bool, error) {
+	if c.compactIcons {
+		icons = compactIcons(icons)
+	}
+	services := make(map[string]*service)
+	servicesNeedingPlacement := make(map[string]bool)
 	// Go through all services in alphabetical order so that
 	// we get consistent results.
 	serviceNames := make([]string, 0, len(b.Services))
@@ -45,36 +242,304 @@ func NewFromBundle(b *charm.BundleData, iconURL func(*charm.URL) string, fetcher
 		serviceNames = append(serviceNames, name)
 	}
 	sort.Strings(serviceNames)
-	services := make(map[string]*service)
-	servicesNeedingPlacement := make(map[string]bool)
+	var missingIcons []string
+	// iconErrors holds the result of checking each icon
+	// embedded so far, keyed by charm path.
+	iconErrors := make(map[string]error)
 	for _, name := range serviceNames {
 		serviceData := b.Services[name]
-		x, xerr := strconv.ParseFloat(serviceData.Annotations["gui-x"], 64)
-		y, yerr := strconv.ParseFloat(serviceData.Annotations["gui-y"], 64)
-		if xerr != nil || yerr != nil {
-			if serviceData.Annotations["gui-x"] == "" && serviceData.Annotations["gui-y"] == "" {
-				servicesNeedingPlacement[name] = true
-				x = 0
-				y = 0
-			} else {
-				return nil, errgo.Newf("service %q does not have a valid position", name)
+		if isHidden(serviceData) {
+			continue
+		}
+		var x, y float64
+		if !c.topologyOnly {
+			var xerr, yerr error
+			guiX, guiY := positionAnnotations(serviceData.Annotations)
+			x, xerr = strconv.ParseFloat(guiX, 64)
+			y, yerr = strconv.ParseFloat(guiY, 64)
+			if xerr != nil || yerr != nil {
+				if guiX == "" && guiY == "" {
+					servicesNeedingPlacement[name] = true
+					x = 0
+					y = 0
+				} else {
+					return nil, nil, errgo.Newf("service %q does not have a valid position", name)
+				}
 			}
 		}
 		charmID, err := charm.ParseURL(serviceData.Charm)
 		if err != nil {
 			// cannot actually happen, as we've verified it.
-			return nil, errgo.Notef(err, "cannot parse charm %q", serviceData.Charm)
+			return nil, nil, errgo.Notef(err, "cannot parse charm %q", serviceData.Charm)
 		}
-		icon := iconMap[charmID.Path()]
 		svc := &service{
-			name:      name,
-			charmPath: charmID.Path(),
-			point:     image.Point{int(x), int(y)},
-			iconUrl:   iconURL(charmID),
-			iconSrc:   icon,
+			name:           name,
+			charmPath:      charmID.Path(),
+			charmName:      charmID.Name,
+			point:          image.Point{c.roundCoordinate(x), c.roundCoordinate(y)},
+			storageCount:   len(serviceData.Storage),
+			units:          serviceData.NumUnits,
+			hideIcon:       c.topologyOnly,
+			labelPosition:  c.labelPosition,
+			shadow:         c.iconShadow != nil,
+			label:          shortLabel(name, c.maxLabelLength),
+			colorBlindSafe: c.colorBlindSafe,
+		}
+		if !c.topologyOnly {
+			svc.iconUrl = iconURL(charmID)
+			icon := icons[charmID.Path()]
+			if len(icon.Data) == 0 {
+				missingIcons = append(missingIcons, name)
+			}
+			// SVG icons are embedded directly, while raster
+			// icons are embedded as data URIs in place of their URL.
+			if icon.rasterType() != "" {
+				svc.iconUrl = icon.dataURI()
+			} else {
+				svc.iconSrc = c.embeddedIcon(charmID, icon, iconErrors)
+			}
+		}
+		if b.Series != "" && charmID.Series != b.Series {
+			svc.series = charmID.Series
+		}
+		if c.iconTint != nil {
+			svc.tint = c.iconTint(name)
+		}
+		if c.serviceModel != nil {
+			svc.model = c.serviceModel(name)
+		}
+		if c.showConstraints {
+			svc.constraints = strings.Join(strings.Fields(serviceData.Constraints), " ")
+		}
+		if c.shape != nil {
+			svc.shape = c.shape(charmID)
+		}
+		if c.serviceAttrs != nil {
+			svc.attrs = c.serviceAttrs(name, serviceData)
 		}
 		services[name] = svc
 	}
+	if c.maxUnitScale > 0 {
+		c.scaleByUnits(b, services)
+	}
+	if c.requireIcons && len(missingIcons) > 0 {
+		return nil, nil, errgo.Newf("no icons found for services %s", strings.Join(missingIcons, ", "))
+	}
+	return services, servicesNeedingPlacement, nil
+}
+
+// positionKeys holds the pairs of annotations under which the Juju GUI
+// has stored the position of services over time, in the order in which
+// they are checked.
+var positionKeys = [][2]string{
+	{"gui-x", "gui-y"},
+	{"gui.x", "gui.y"},
+}
+
+// positionAnnotations returns the x and y coordinates held in the first
+// pair of position annotations found in the given annotations. It returns
+// empty strings if the service has no position.
+func positionAnnotations(annotations map[string]string) (x, y string) {
+	for _, keys := range positionKeys {
+		x, y = annotations[keys[0]], annotations[keys[1]]
+		if x != "" || y != "" {
+			return x, y
+		}
+	}
+	return "", ""
+}
+
+// roundCoordinate converts a coordinate given in a bundle annotation to
+// pixels. By default, the fractional part is discarded.
+func (c *Canvas) roundCoordinate(x float64) int {
+	if c.round != nil {
+		return c.round(x)
+	}
+	return int(x)
+}
+
+// hideAnnotation holds the annotation used by the Juju GUI to mark
+// services which should not be shown.
+const hideAnnotation = "hide"
+
+// isHidden reports whether the given service is marked as hidden.
+func isHidden(serviceData *charm.ServiceSpec) bool {
+	hide, _ := strconv.ParseBool(serviceData.Annotations[hideAnnotation])
+	return hide
+}
+
+// embeddedIcon returns the data to embed for the given SVG icon of the
+// given charm. Icons which are not well-formed SVG documents would corrupt
+// the whole diagram, so they are replaced by a placeholder and reported to
+// the function given to WithIconErrors, as are icons in other formats
+// which cannot be embedded. Missing icons are replaced by a placeholder
+// only when WithPlaceholderIcons is used. The given map records which
+// icons have been checked, so that each is reported once.
+func (c *Canvas) embeddedIcon(charmID *charm.URL, icon Icon, iconErrors map[string]error) []byte {
+	charmPath := charmID.Path()
+	if len(icon.Data) == 0 {
+		if c.placeholderIcon != nil {
+			return c.placeholder(charmID.Name)
+		}
+		return icon.Data
+	}
+	err, ok := iconErrors[charmPath]
+	if !ok {
+		if icon.isSVG() {
+			err = processIcon(bytes.NewReader(icon.Data), ioutil.Discard, "")
+		} else {
+			err = errgo.Newf("unsupported icon type %q", icon.ContentType)
+		}
+		iconErrors[charmPath] = err
+		if err != nil && c.iconError != nil {
+			c.iconError(charmPath, err)
+		}
+	}
+	if err != nil {
+		if c.placeholderIcon != nil {
+			return c.placeholder(charmID.Name)
+		}
+		return []byte(placeholderIcon)
+	}
+	return icon.Data
+}
+
+// placeholder returns the placeholder icon given by WithPlaceholderIcons
+// for charms with the given name, or the default placeholder if that is
+// not a well-formed SVG document.
+func (c *Canvas) placeholder(charmName string) []byte {
+	data := c.placeholderIcon(charmName)
+	if err := processIcon(bytes.NewReader(data), ioutil.Discard, ""); err != nil {
+		return []byte(placeholderIcon)
+	}
+	return data
+}
+
+// compactIcons returns a copy of the given icons with insignificant
+// whitespace removed from the SVG icons. Icons which cannot be parsed are
+// left as they are.
+func compactIcons(icons map[string]Icon) map[string]Icon {
+	compacted := make(map[string]Icon, len(icons))
+	for path, icon := range icons {
+		if icon.isSVG() {
+			if data, err := compactIcon(icon.Data); err == nil {
+				icon.Data = data
+			}
+		}
+		compacted[path] = icon
+	}
+	return compacted
+}
+
+// placeServices positions the services needing placement, or all of
+// the services when only the topology of the bundle is shown.
+func (c *Canvas) placeServices(services map[string]*service, servicesNeedingPlacement map[string]bool) {
+	if c.topologyOnly {
+		placeServicesInCircle(services)
+	} else {
+		placeServices(services, servicesNeedingPlacement)
+	}
+	if c.maxUnitScale > 1 {
+		spreadServices(services, c.maxUnitScale)
+	}
+}
+
+// scaleByUnits sets the scale of each of the given services, which are
+// found in b, according to its number of units. The service with the
+// fewest units is drawn at c.minUnitScale and the service with the most
+// at c.maxUnitScale, with the others scaled linearly between them.
+func (c *Canvas) scaleByUnits(b *charm.BundleData, services map[string]*service) {
+	minUnits, maxUnits := maxInt, minInt
+	for name := range services {
+		n := b.Services[name].NumUnits
+		if n < minUnits {
+			minUnits = n
+		}
+		if n > maxUnits {
+			maxUnits = n
+		}
+	}
+	for name, svc := range services {
+		svc.scale = c.minUnitScale
+		if maxUnits > minUnits {
+			svc.scale += (c.maxUnitScale - c.minUnitScale) *
+				float64(b.Services[name].NumUnits-minUnits) / float64(maxUnits-minUnits)
+		}
+	}
+}
+
+// weighRelations sets the width of each weighted relation. The relation
+// with the least weight is drawn c.minRelationWidth wide and that with the
+// most c.maxRelationWidth wide, with the others in between according to
+// c.weightScale.
+func (c *Canvas) weighRelations() {
+	if c.relationWeight == nil {
+		return
+	}
+	scaled := func(r *serviceRelation) float64 {
+		if c.weightScale == LogWeights {
+			return math.Log1p(math.Max(r.weight, 0))
+		}
+		return r.weight
+	}
+	minWeight, maxWeight := math.Inf(1), math.Inf(-1)
+	for _, r := range c.relations {
+		if r.weighted {
+			minWeight = math.Min(minWeight, scaled(r))
+			maxWeight = math.Max(maxWeight, scaled(r))
+		}
+	}
+	for _, r := range c.relations {
+		if !r.weighted {
+			continue
+		}
+		r.width = c.minRelationWidth
+		if maxWeight > minWeight {
+			r.width += (c.maxRelationWidth - c.minRelationWidth) *
+				(scaled(r) - minWeight) / (maxWeight - minWeight)
+		}
+	}
+}
+
+// spreadServices moves the centers of the given services away from the
+// origin by the given factor, so that services scaled up by no more than
+// that factor do not overlap if they did not before.
+func spreadServices(services map[string]*service, factor float64) {
+	for _, svc := range services {
+		center := svc.center()
+		spread := point(
+			int(math.Floor(float64(center.X)*factor+0.5)),
+			int(math.Floor(float64(center.Y)*factor+0.5)),
+		)
+		svc.point = svc.point.Add(spread.Sub(center))
+	}
+}
+
+// placeServicesInCircle positions the services evenly around a circle in
+// alphabetical order, far enough apart that they do not overlap.
+func placeServicesInCircle(services map[string]*service) {
+	names := sortedServiceNames(services)
+	if len(names) < 2 {
+		for _, name := range names {
+			services[name].point = image.ZP
+		}
+		return
+	}
+	// Leave half a block between adjacent services.
+	circumference := float64(len(names)) * serviceBlockSize * 1.5
+	radius := math.Max(circumference/(2*math.Pi), serviceBlockSize)
+	for i, name := range names {
+		angle := 2 * math.Pi * float64(i) / float64(len(names))
+		services[name].point = image.Point{
+			RoundNearest(radius * math.Sin(angle)),
+			RoundNearest(-radius * math.Cos(angle)),
+		}
+	}
+}
+
+// placeServices positions each of the services needing placement
+// outside of the area occupied by the services already placed.
+func placeServices(services map[string]*service, servicesNeedingPlacement map[string]bool) {
 	padding := image.Point{int(math.Floor(serviceBlockSize * 1.5)), int(math.Floor(serviceBlockSize * 0.5))}
 	for name := range servicesNeedingPlacement {
 		vertices := []image.Point{}
@@ -86,14 +551,236 @@ func NewFromBundle(b *charm.BundleData, iconURL func(*charm.URL) string, fetcher
 		services[name].point = getPointOutside(vertices, padding)
 		servicesNeedingPlacement[name] = false
 	}
-	for _, name := range serviceNames {
-		canvas.addService(services[name])
+}
+
+// withoutDuplicateRelations returns b, or a copy of it if it lists any
+// relation more than once, in which case the copy lists each relation
+// once. Such duplicates would otherwise fail verification. Each duplicate
+// is reported to the function given to WithDuplicateRelations.
+func (c *Canvas) withoutDuplicateRelations(b *charm.BundleData) *charm.BundleData {
+	relations := make([][]string, 0, len(b.Relations))
+	seen := make(map[string]bool)
+	for _, relation := range b.Relations {
+		// Invalid relations are left for Verify to report.
+		if len(relation) == 2 {
+			key := relationKey(relation)
+			if seen[key] {
+				if c.duplicateRelation != nil {
+					c.duplicateRelation(relation)
+				}
+				continue
+			}
+			seen[key] = true
+		}
+		relations = append(relations, relation)
+	}
+	if len(relations) == len(b.Relations) {
+		return b
+	}
+	unique := *b
+	unique.Relations = relations
+	return &unique
+}
+
+// sortedServiceNames returns the names of the given services in
+// alphabetical order.
+func sortedServiceNames(services map[string]*service) []string {
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
+}
+
+// endpointsInterface returns the name identifying what is carried by the
+// relation between the given endpoints. Bundles do not record relation
+// interfaces, so the relation name given in the first endpoint which has
+// one is used.
+func endpointsInterface(endpoints []string) string {
+	for _, ep := range endpoints {
+		if parts := strings.SplitN(ep, ":", 2); len(parts) == 2 {
+			return parts[1]
+		}
+	}
+	return ""
+}
+
+// isOfferEndpoint reports whether the given relation endpoint refers to
+// an application offered by another model, in which case it is of the
+// form "[user/]model.application[:relation]". Application names cannot
+// contain dots, so such endpoints cannot refer to services in the bundle.
+func isOfferEndpoint(endpoint string) bool {
+	return strings.Contains(endpointService(endpoint), ".")
+}
+
+// splitCrossModelRelations returns b without the relations between its
+// services and applications offered by other models, and those relations,
+// which would otherwise fail verification. If there are no such
+// relations, b itself is returned.
+func splitCrossModelRelations(b *charm.BundleData) (*charm.BundleData, [][]string) {
+	var relations, crossModel [][]string
 	for _, relation := range b.Relations {
-		canvas.addRelation(&serviceRelation{
-			serviceA: services[strings.Split(relation[0], ":")[0]],
-			serviceB: services[strings.Split(relation[1], ":")[0]],
-		})
+		if len(relation) == 2 && isOfferEndpoint(relation[0]) != isOfferEndpoint(relation[1]) {
+			crossModel = append(crossModel, relation)
+		} else {
+			relations = append(relations, relation)
+		}
 	}
-	return &canvas, nil
+	if len(crossModel) == 0 {
+		return b, nil
+	}
+	local := *b
+	local.Relations = relations
+	return &local, crossModel
+}
+
+// splitSelfRelations returns b without the relations between a service
+// and itself, such as peer relations, and those relations, which would
+// otherwise fail verification. Relations to unknown services are left for
+// verification to report. If there are no such relations, b itself is
+// returned.
+func splitSelfRelations(b *charm.BundleData) (*charm.BundleData, [][]string) {
+	var relations, self [][]string
+	for _, relation := range b.Relations {
+		if len(relation) == 2 && endpointService(relation[0]) == endpointService(relation[1]) && b.Services[endpointService(relation[0])] != nil {
+			self = append(self, relation)
+		} else {
+			relations = append(relations, relation)
+		}
+	}
+	if len(self) == 0 {
+		return b, nil
+	}
+	rest := *b
+	rest.Relations = relations
+	return &rest, self
+}
+
+// addOfferServices adds a service to the given services for each offered
+// application related to one of them by the given cross-model relations,
+// and returns the added services in name order. They are placed in a
+// column to the right of the other services.
+func (c *Canvas) addOfferServices(services map[string]*service, relations [][]string) []*service {
+	if len(relations) == 0 {
+		return nil
+	}
+	offers := make(map[string]bool)
+	for _, relation := range relations {
+		offer, local := relation[0], relation[1]
+		if isOfferEndpoint(local) {
+			offer, local = local, offer
+		}
+		if services[endpointService(local)] != nil {
+			offers[endpointService(offer)] = true
+		}
+	}
+	if len(offers) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(offers))
+	for name := range offers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// Start the column level with the topmost service.
+	top, right := maxInt, minInt
+	for _, svc := range services {
+		b := svc.bounds()
+		if b.Min.Y < top {
+			top = b.Min.Y
+		}
+		if b.Max.X > right {
+			right = b.Max.X
+		}
+	}
+	added := make([]*service, len(names))
+	for i, name := range names {
+		svc := &service{
+			name:  name,
+			offer: true,
+			label: shortLabel(name, c.maxLabelLength),
+			point: point(right+serviceBlockSize/2, top+i*serviceBlockSize*3/2),
+		}
+		services[name] = svc
+		added[i] = svc
+	}
+	return added
+}
+
+// endpointService returns the name of the service in the given relation
+// endpoint, which is of the form "service" or "service:relation".
+func endpointService(endpoint string) string {
+	return strings.Split(endpoint, ":")[0]
+}
+
+// Render writes an SVG representation of the given bundle to w. It is
+// shorthand for NewFromBundle followed by Canvas.Marshal, taking the icon
+// URL function and fetcher from the WithIconURL and WithIconFetcher options.
+// The WithIconURL option must be provided.
+func Render(b *charm.BundleData, w io.Writer, opts ...CanvasOption) error {
+	return RenderContext(context.Background(), b, w, opts...)
+}
+
+// RenderContext is like Render, but returns ctx.Err() if ctx is done
+// before rendering has finished, covering the time taken to verify
+// the bundle, fetch its icons and generate the SVG. Nothing is written
+// to w unless rendering succeeds.
+func RenderContext(ctx context.Context, b *charm.BundleData, w io.Writer, opts ...CanvasOption) error {
+	var c Canvas
+	for _, opt := range opts {
+		opt(&c)
+	}
+	if c.iconURL == nil {
+		return errgo.New("no icon URL specified")
+	}
+	return render(ctx, b, w, c.iconURL, c.iconFetcher, opts)
+}
+
+// render writes an SVG representation of the given bundle to w once it
+// has been generated in full.
+func render(ctx context.Context, b *charm.BundleData, w io.Writer, iconURL func(*charm.URL) string, fetcher IconFetcher, opts []CanvasOption) error {
+	canvas, err := NewFromBundleContext(ctx, b, iconURL, fetcher, opts...)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := canvas.MarshalContext(ctx, &buf); err != nil {
+		return err
+	}
+	_, err = buf.WriteTo(w)
+	return err
+}
+
+// Renderer renders bundles as SVG using a shared configuration. Reusing a
+// Renderer for many bundles allows state held by its IconFetcher, such as
+// cached icons or HTTP connections, to be shared between renders. A
+// Renderer may be used concurrently as long as its IconFetcher may.
+type Renderer struct {
+	// IconURL returns the URL of the icon for the given charm. It
+	// must be set.
+	IconURL func(*charm.URL) string
+
+	// IconFetcher holds the fetcher used to retrieve icons. If it is
+	// nil, icons are included as links to IconURL.
+	IconFetcher IconFetcher
+
+	// Options holds options applied to the canvas of every bundle
+	// rendered.
+	Options []CanvasOption
+}
+
+// Render writes an SVG representation of the given bundle to w.
+func (r *Renderer) Render(b *charm.BundleData, w io.Writer) error {
+	return r.RenderContext(context.Background(), b, w)
+}
+
+// RenderContext is like Render, but returns ctx.Err() if ctx is done
+// before rendering has finished. Nothing is written to w unless
+// rendering succeeds.
+func (r *Renderer) RenderContext(ctx context.Context, b *charm.BundleData, w io.Writer) error {
+	if r.IconURL == nil {
+		return errgo.New("no icon URL specified")
+	}
+	return render(ctx, b, w, r.IconURL, r.IconFetcher, r.Options)
 }
@@ -2,16 +2,22 @@ package jujusvg
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"fmt"
+	"image"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
 	"gopkg.in/juju/charm.v6-unstable"
 
 	"gopkg.in/juju/jujusvg.v1/assets"
+	"gopkg.in/juju/jujusvg.v1/jujusvgtest"
 )
 
 func Test(t *testing.T) { gc.TestingT(t) }
@@ -97,13 +103,13 @@ func (s *newSuite) TestNewFromBundle(c *gc.C) {
 <circle cx="10" cy="10" r="10" style="stroke:#38B44A;fill:none;stroke-width:2px"/>
 <circle cx="10" cy="10" r="5" style="fill:#38B44A"/>
 </g>
-<svg:svg xmlns:svg="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" id="icon-1">
+<svg:svg xmlns:svg="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" id="icon-1" viewBox="0 0 96 96" preserveAspectRatio="xMidYMid meet">
 &#x9;&#x9;&#x9;&#x9;&#x9;<svg:image width="96" height="96" xlink:href="http://0.1.2.3/~juju-jitsu/precise/charmworld-58.svg"></svg:image>
 &#x9;&#x9;&#x9;&#x9;</svg:svg>
-<svg:svg xmlns:svg="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" id="icon-2">
+<svg:svg xmlns:svg="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" id="icon-2" viewBox="0 0 96 96" preserveAspectRatio="xMidYMid meet">
 &#x9;&#x9;&#x9;&#x9;&#x9;<svg:image width="96" height="96" xlink:href="http://0.1.2.3/~charming-devs/precise/elasticsearch-2.svg"></svg:image>
 &#x9;&#x9;&#x9;&#x9;</svg:svg>
-<svg:svg xmlns:svg="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" id="icon-3">
+<svg:svg xmlns:svg="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" id="icon-3" viewBox="0 0 96 96" preserveAspectRatio="xMidYMid meet">
 &#x9;&#x9;&#x9;&#x9;&#x9;<svg:image width="96" height="96" xlink:href="http://0.1.2.3/precise/mongodb-21.svg"></svg:image>
 &#x9;&#x9;&#x9;&#x9;</svg:svg>
 </defs>
@@ -201,11 +207,11 @@ func (s *newSuite) TestNewFromBundleWithUnplacedService(c *gc.C) {
 <circle cx="10" cy="10" r="10" style="stroke:#38B44A;fill:none;stroke-width:2px"/>
 <circle cx="10" cy="10" r="5" style="fill:#38B44A"/>
 </g>
-<svg:svg xmlns:svg="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" id="icon-1">
+<svg:svg xmlns:svg="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" id="icon-1" viewBox="0 0 96 96" preserveAspectRatio="xMidYMid meet">
 &#x9;&#x9;&#x9;&#x9;&#x9;<svg:image width="96" height="96" xlink:href="http://0.1.2.3/~juju-jitsu/precise/charmworld-58.svg"></svg:image>
-&#x9;&#x9;&#x9;&#x9;</svg:svg><svg:svg xmlns:svg="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" id="icon-2">
+&#x9;&#x9;&#x9;&#x9;</svg:svg><svg:svg xmlns:svg="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" id="icon-2" viewBox="0 0 96 96" preserveAspectRatio="xMidYMid meet">
 &#x9;&#x9;&#x9;&#x9;&#x9;<svg:image width="96" height="96" xlink:href="http://0.1.2.3/~charming-devs/precise/elasticsearch-2.svg"></svg:image>
-&#x9;&#x9;&#x9;&#x9;</svg:svg><svg:svg xmlns:svg="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" id="icon-3">
+&#x9;&#x9;&#x9;&#x9;</svg:svg><svg:svg xmlns:svg="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" id="icon-3" viewBox="0 0 96 96" preserveAspectRatio="xMidYMid meet">
 &#x9;&#x9;&#x9;&#x9;&#x9;<svg:image width="96" height="96" xlink:href="http://0.1.2.3/precise/mongodb-21.svg"></svg:image>
 &#x9;&#x9;&#x9;&#x9;</svg:svg></defs>
 <g id="relations">
@@ -324,9 +330,7 @@ func (s *newSuite) TestDefaultHTTPFetcher(c *gc.C) {
 <circle cx="10" cy="10" r="10" style="stroke:#38B44A;fill:none;stroke-width:2px"/>
 <circle cx="10" cy="10" r="5" style="fill:#38B44A"/>
 </g>
-<svg:svg xmlns:svg="http://www.w3.org/2000/svg" id="icon-1"></svg:svg>
-<svg:svg xmlns:svg="http://www.w3.org/2000/svg" id="icon-2"></svg:svg>
-<svg:svg xmlns:svg="http://www.w3.org/2000/svg" id="icon-3"></svg:svg>
+<svg:svg xmlns:svg="http://www.w3.org/2000/svg" id="icon-1" viewBox="0 0 96 96" preserveAspectRatio="xMidYMid meet"></svg:svg>
 </defs>
 <g id="relations">
 <line x1="417" y1="189" x2="189" y2="351" stroke="#38B44A" stroke-width="2px" stroke-dasharray="129.85, 20" />
@@ -341,12 +345,12 @@ func (s *newSuite) TestDefaultHTTPFetcher(c *gc.C) {
 <text x="417" y="31" >charmworld</text>
 </g>
 <use x="0" y="257" xlink:href="#serviceBlock" id="elasticsearch" />
-<use x="46" y="303" xlink:href="#icon-2" width="96" height="96" />
+<use x="46" y="303" xlink:href="#icon-1" width="96" height="96" />
 <g style="font-size:18px;fill:#505050;text-anchor:middle">
 <text x="94" y="288" >elasticsearch</text>
 </g>
 <use x="450" y="276" xlink:href="#serviceBlock" id="mongodb" />
-<use x="496" y="322" xlink:href="#icon-3" width="96" height="96" />
+<use x="496" y="322" xlink:href="#icon-1" width="96" height="96" />
 <g style="font-size:18px;fill:#505050;text-anchor:middle">
 <text x="544" y="307" >mongodb</text>
 </g>
@@ -393,3 +397,1260 @@ func (s *newSuite) TestWithBadPosition(c *gc.C) {
 	c.Assert(err, gc.ErrorMatches, `service "charmworld" does not have a valid position`)
 	c.Assert(cvs, gc.IsNil)
 }
+
+func (s *newSuite) TestPositionAnnotationVariants(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	// Older bundles store positions under dotted keys.
+	elasticsearch := b.Services["elasticsearch"].Annotations
+	elasticsearch["gui.x"] = elasticsearch["gui-x"]
+	elasticsearch["gui.y"] = elasticsearch["gui-y"]
+	delete(elasticsearch, "gui-x")
+	delete(elasticsearch, "gui-y")
+	// Hyphenated keys take precedence over dotted ones.
+	mongodb := b.Services["mongodb"].Annotations
+	mongodb["gui.x"] = "1"
+	mongodb["gui.y"] = "2"
+
+	cvs, err := NewFromBundle(b, iconURL, nil)
+	c.Assert(err, gc.IsNil)
+	points := make(map[string]image.Point)
+	for _, svc := range cvs.services {
+		points[svc.name] = svc.point
+	}
+	c.Assert(points, gc.DeepEquals, map[string]image.Point{
+		"charmworld":    {813, 112},
+		"elasticsearch": {490, 369},
+		"mongodb":       {940, 388},
+	})
+
+	elasticsearch["gui.x"] = "bad"
+	_, err = NewFromBundle(b, iconURL, nil)
+	c.Assert(err, gc.ErrorMatches, `service "elasticsearch" does not have a valid position`)
+}
+
+func (s *newSuite) TestWithIconTint(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	err = b.Verify(nil, nil)
+	c.Assert(err, gc.IsNil)
+
+	cvs, err := NewFromBundle(b, iconURL, nil, WithIconTint(func(name string) string {
+		if name == "mongodb" {
+			return "#FF0000"
+		}
+		return ""
+	}))
+	c.Assert(err, gc.IsNil)
+	tints := make(map[string]string)
+	for _, svc := range cvs.services {
+		tints[svc.name] = svc.tint
+	}
+	c.Assert(tints, gc.DeepEquals, map[string]string{
+		"charmworld":    "",
+		"elasticsearch": "",
+		"mongodb":       "#FF0000",
+	})
+}
+
+type pngFetcher struct{}
+
+func (f *pngFetcher) FetchIcons(*charm.BundleData) (map[string][]byte, error) {
+	return nil, fmt.Errorf("unexpected call to FetchIcons")
+}
+
+func (f *pngFetcher) FetchTypedIcons(*charm.BundleData) (map[string]Icon, error) {
+	return map[string]Icon{
+		"precise/mongodb-21": {
+			ContentType: "image/png",
+			Data:        []byte(pngIcon),
+		},
+		"~juju-jitsu/precise/charmworld-58": {
+			ContentType: "image/svg+xml",
+			Data:        []byte("<svg></svg>"),
+		},
+	}, nil
+}
+
+// pngIcon holds the start of a PNG image.
+const pngIcon = "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+
+func (s *newSuite) TestWithTypedFetcher(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	err = b.Verify(nil, nil)
+	c.Assert(err, gc.IsNil)
+
+	cvs, err := NewFromBundle(b, iconURL, new(pngFetcher))
+	c.Assert(err, gc.IsNil)
+	iconSrcs := make(map[string]string)
+	iconURLs := make(map[string]string)
+	for _, svc := range cvs.services {
+		iconSrcs[svc.name] = string(svc.iconSrc)
+		iconURLs[svc.name] = svc.iconUrl
+	}
+	// The SVG icon is embedded and the PNG icon is embedded as a
+	// data URI; the missing icon is linked.
+	c.Assert(iconSrcs, gc.DeepEquals, map[string]string{
+		"charmworld":    "<svg></svg>",
+		"elasticsearch": "",
+		"mongodb":       "",
+	})
+	c.Assert(iconURLs, gc.DeepEquals, map[string]string{
+		"charmworld":    "http://0.1.2.3/~juju-jitsu/precise/charmworld-58.svg",
+		"elasticsearch": "http://0.1.2.3/~charming-devs/precise/elasticsearch-2.svg",
+		"mongodb":       "data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte(pngIcon)),
+	})
+}
+
+type typedMapFetcher map[string]Icon
+
+func (f typedMapFetcher) FetchIcons(*charm.BundleData) (map[string][]byte, error) {
+	return nil, fmt.Errorf("unexpected call to FetchIcons")
+}
+
+func (f typedMapFetcher) FetchTypedIcons(*charm.BundleData) (map[string]Icon, error) {
+	return f, nil
+}
+
+func (s *newSuite) TestUnsupportedIconType(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	fetcher := typedMapFetcher{
+		"precise/mongodb-21": {
+			ContentType: "image/x-unknown",
+			Data:        []byte("not an image"),
+		},
+	}
+	iconErrors := make(map[string]string)
+	cvs, err := NewFromBundle(b, iconURL, fetcher, WithIconErrors(func(charmPath string, err error) {
+		iconErrors[charmPath] = err.Error()
+	}))
+	c.Assert(err, gc.IsNil)
+	for _, svc := range cvs.services {
+		if svc.name == "mongodb" {
+			c.Assert(string(svc.iconSrc), gc.Equals, placeholderIcon)
+		}
+	}
+	c.Assert(iconErrors, gc.DeepEquals, map[string]string{
+		"precise/mongodb-21": `unsupported icon type "image/x-unknown"`,
+	})
+}
+
+func (s *newSuite) TestWithPlaceholderIcons(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	// The mongodb icon is missing and the elasticsearch icon is
+	// not well formed.
+	fetcher := typedMapFetcher{
+		"~juju-jitsu/precise/charmworld-58": {
+			ContentType: svgContentType,
+			Data:        []byte("<svg></svg>"),
+		},
+		"~charming-devs/precise/elasticsearch-2": {
+			ContentType: svgContentType,
+			Data:        []byte("<svg>"),
+		},
+	}
+	placeholder := InitialsPlaceholder(PlaceholderTheme{})
+	tests := []struct {
+		about  string
+		opts   []CanvasOption
+		expect map[string]string
+	}{{
+		about: "no placeholders",
+		expect: map[string]string{
+			"charmworld":    "<svg></svg>",
+			"elasticsearch": placeholderIcon,
+			"mongodb":       "",
+		},
+	}, {
+		about: "generated placeholders",
+		opts:  []CanvasOption{WithPlaceholderIcons(nil)},
+		expect: map[string]string{
+			"charmworld":    "<svg></svg>",
+			"elasticsearch": string(placeholder("elasticsearch")),
+			"mongodb":       string(placeholder("mongodb")),
+		},
+	}, {
+		about: "custom placeholder",
+		opts: []CanvasOption{WithPlaceholderIcons(func(string) []byte {
+			return []byte("<svg>custom</svg>")
+		})},
+		expect: map[string]string{
+			"charmworld":    "<svg></svg>",
+			"elasticsearch": "<svg>custom</svg>",
+			"mongodb":       "<svg>custom</svg>",
+		},
+	}, {
+		about: "bad custom placeholder",
+		opts: []CanvasOption{WithPlaceholderIcons(func(string) []byte {
+			return []byte("<svg>")
+		})},
+		expect: map[string]string{
+			"charmworld":    "<svg></svg>",
+			"elasticsearch": placeholderIcon,
+			"mongodb":       placeholderIcon,
+		},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		cvs, err := NewFromBundle(b, iconURL, fetcher, test.opts...)
+		c.Assert(err, gc.IsNil)
+		icons := make(map[string]string)
+		for _, svc := range cvs.services {
+			icons[svc.name] = string(svc.iconSrc)
+		}
+		c.Assert(icons, jc.DeepEquals, test.expect)
+	}
+
+	// Missing icons are still reported as missing.
+	_, err = NewFromBundle(b, iconURL, fetcher, WithPlaceholderIcons(nil), WithRequiredIcons())
+	c.Assert(err, gc.ErrorMatches, "no icons found for services mongodb")
+}
+
+func (s *newSuite) TestRasterIconDetection(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	// Raster icons are recognized by their contents even when
+	// fetched without a content type.
+	fetcher := mapFetcher{
+		"precise/mongodb-21": []byte(pngIcon),
+	}
+	cvs, err := NewFromBundle(b, iconURL, fetcher)
+	c.Assert(err, gc.IsNil)
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), jc.Contains, `xlink:href="data:image/png;base64,`)
+}
+
+func (s *newSuite) TestRender(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	err = b.Verify(nil, nil)
+	c.Assert(err, gc.IsNil)
+
+	cvs, err := NewFromBundle(b, iconURL, new(emptyFetcher))
+	c.Assert(err, gc.IsNil)
+	var expected bytes.Buffer
+	cvs.Marshal(&expected)
+
+	var buf bytes.Buffer
+	err = Render(b, &buf, WithIconURL(iconURL), WithIconFetcher(new(emptyFetcher)))
+	c.Assert(err, gc.IsNil)
+	assertXMLEqual(c, buf.Bytes(), expected.Bytes())
+}
+
+func (s *newSuite) TestRenderErrors(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	var buf bytes.Buffer
+	err = Render(b, &buf)
+	c.Assert(err, gc.ErrorMatches, "no icon URL specified")
+
+	ef := errFetcher("bad-wolf")
+	err = Render(b, &buf, WithIconURL(iconURL), WithIconFetcher(&ef))
+	c.Assert(err, gc.ErrorMatches, "bad-wolf")
+	c.Assert(buf.Len(), gc.Equals, 0)
+}
+
+func (s *newSuite) TestRenderer(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	err = b.Verify(nil, nil)
+	c.Assert(err, gc.IsNil)
+
+	cvs, err := NewFromBundle(b, iconURL, new(emptyFetcher), WithCompactIcons())
+	c.Assert(err, gc.IsNil)
+	var expected bytes.Buffer
+	cvs.Marshal(&expected)
+
+	r := &Renderer{
+		IconURL:     iconURL,
+		IconFetcher: new(emptyFetcher),
+		Options:     []CanvasOption{WithCompactIcons()},
+	}
+	// The renderer may be reused.
+	for i := 0; i < 2; i++ {
+		var buf bytes.Buffer
+		err = r.Render(b, &buf)
+		c.Assert(err, gc.IsNil)
+		assertXMLEqual(c, buf.Bytes(), expected.Bytes())
+	}
+}
+
+func (s *newSuite) TestRendererErrors(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	var buf bytes.Buffer
+	err = new(Renderer).Render(b, &buf)
+	c.Assert(err, gc.ErrorMatches, "no icon URL specified")
+
+	ef := errFetcher("bad-wolf")
+	r := &Renderer{
+		IconURL:     iconURL,
+		IconFetcher: &ef,
+	}
+	err = r.Render(b, &buf)
+	c.Assert(err, gc.ErrorMatches, "bad-wolf")
+	c.Assert(buf.Len(), gc.Equals, 0)
+}
+
+// blockingFetcher is an IconFetcher which does not return until
+// its channel is closed.
+type blockingFetcher chan struct{}
+
+func (f blockingFetcher) FetchIcons(*charm.BundleData) (map[string][]byte, error) {
+	<-f
+	return nil, nil
+}
+
+func (s *newSuite) TestRenderContext(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	f := make(blockingFetcher)
+	defer close(f)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var buf bytes.Buffer
+	err = RenderContext(ctx, b, &buf, WithIconURL(iconURL), WithIconFetcher(f))
+	c.Assert(err, gc.Equals, context.DeadlineExceeded)
+	c.Assert(buf.Len(), gc.Equals, 0)
+
+	r := &Renderer{
+		IconURL: iconURL,
+	}
+	err = r.RenderContext(ctx, b, &buf)
+	c.Assert(err, gc.Equals, context.DeadlineExceeded)
+	c.Assert(buf.Len(), gc.Equals, 0)
+}
+
+// cancelFetcher is an IconFetcher which cancels a context when it
+// fetches icons.
+type cancelFetcher context.CancelFunc
+
+func (f cancelFetcher) FetchIcons(*charm.BundleData) (map[string][]byte, error) {
+	f()
+	return nil, nil
+}
+
+func (s *newSuite) TestNewFromBundleContextStopsWhenDone(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	// The context is done once the icons have been fetched, so the
+	// missing focus service is never looked for.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	canvas, err := NewFromBundleContext(ctx, b, iconURL, cancelFetcher(cancel), WithFocus("no-such-service"))
+	c.Assert(err, gc.Equals, context.Canceled)
+	c.Assert(canvas, gc.IsNil)
+}
+
+func (s *newSuite) TestWithStorageBadges(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	b.Services["mongodb"].Storage = map[string]string{
+		"data": "ebs,10G",
+		"logs": "ebs,1G",
+	}
+
+	cvs, err := NewFromBundle(b, iconURL, nil, WithStorageBadges(""))
+	c.Assert(err, gc.IsNil)
+	c.Assert(cvs.storageBadgeColor, gc.Equals, storageBadgeColor)
+	counts := make(map[string]int)
+	for _, svc := range cvs.services {
+		counts[svc.name] = svc.storageCount
+	}
+	c.Assert(counts, gc.DeepEquals, map[string]int{
+		"charmworld":    0,
+		"elasticsearch": 0,
+		"mongodb":       2,
+	})
+
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Assert(strings.Count(buf.String(), "<ellipse "), gc.Equals, 1)
+}
+
+func (s *newSuite) TestWithRequiredIcons(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	cvs, err := NewFromBundle(b, iconURL, new(pngFetcher), WithRequiredIcons())
+	c.Assert(err, gc.ErrorMatches, "no icons found for services elasticsearch")
+	c.Assert(cvs, gc.IsNil)
+
+	cvs, err = NewFromBundle(b, iconURL, new(emptyFetcher), WithRequiredIcons())
+	c.Assert(err, gc.ErrorMatches, "no icons found for services charmworld, elasticsearch, mongodb")
+	c.Assert(cvs, gc.IsNil)
+
+	cvs, err = NewFromBundle(b, iconURL, nil, WithRequiredIcons())
+	c.Assert(err, gc.IsNil)
+	c.Assert(cvs, gc.NotNil)
+}
+
+func (s *newSuite) TestWithSeries(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	b.Services["mongodb"].Charm = "cs:trusty/mongodb-21"
+
+	cvs, err := NewFromBundle(b, iconURL, nil, WithSeries(""))
+	c.Assert(err, gc.IsNil)
+	series := make(map[string]string)
+	for _, svc := range cvs.services {
+		series[svc.name] = svc.series
+	}
+	c.Assert(series, gc.DeepEquals, map[string]string{
+		"charmworld":    "",
+		"elasticsearch": "",
+		"mongodb":       "trusty",
+	})
+
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Logf("%s", buf.String())
+	// The banner adds to the height of the diagram.
+	c.Assert(buf.String(), jc.Contains, `<svg width="639" height="495"`)
+	c.Assert(buf.String(), jc.Contains, `<rect x="0" y="0" width="639" height="30" style="fill:#DD4814"/>
+<text x="15" y="21" style="font-size:18px;fill:#FFFFFF">series: precise</text>
+<g transform="translate(0,30)">`)
+	c.Assert(buf.String(), jc.Contains, `<rect x="512" y="435" width="64" height="18" rx="4" ry="4" style="fill:#DD4814"/>
+<text x="544" y="448" style="font-size:12px;fill:#FFFFFF;text-anchor:middle">trusty</text>`)
+}
+
+func (s *newSuite) TestWithSeriesBadges(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	b.Services["mongodb"].Charm = "cs:trusty/mongodb-21"
+
+	cvs, err := NewFromBundle(b, iconURL, nil, WithSeriesBadges("#FFAA00"))
+	c.Assert(err, gc.IsNil)
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	// No banner is drawn.
+	c.Assert(buf.String(), jc.Contains, `<svg width="639" height="465"`)
+	c.Assert(buf.String(), gc.Not(jc.Contains), "series: precise")
+	c.Assert(buf.String(), jc.Contains, `<rect x="512" y="435" width="64" height="18" rx="4" ry="4" style="fill:#FFAA00"/>
+<text x="544" y="448" style="font-size:12px;fill:#FFFFFF;text-anchor:middle">trusty</text>`)
+
+	// The badges can be drawn in a different color to the banner.
+	cvs, err = NewFromBundle(b, iconURL, nil, WithSeries(""), WithSeriesBadges("#FFAA00"))
+	c.Assert(err, gc.IsNil)
+	buf.Reset()
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), jc.Contains, `style="fill:#DD4814"/>
+<text x="15" y="21" style="font-size:18px;fill:#FFFFFF">series: precise</text>`)
+	c.Assert(buf.String(), jc.Contains, `<rect x="512" y="435" width="64" height="18" rx="4" ry="4" style="fill:#FFAA00"/>`)
+}
+
+func (s *newSuite) TestWithCompactIcons(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	cvs, err := NewFromBundle(b, iconURL, nil, WithCompactIcons())
+	c.Assert(err, gc.IsNil)
+	for _, svc := range cvs.services {
+		c.Assert(string(svc.iconSrc), gc.Equals, `<svg xmlns:xlink="http://www.w3.org/1999/xlink"><image width="96" height="96" xlink:href="`+svc.iconUrl+`"></image></svg>`)
+	}
+}
+
+func (s *newSuite) TestWithInterfaceColors(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	cvs, err := NewFromBundle(b, iconURL, nil, WithInterfaceColors(func(interfaceName string) string {
+		if interfaceName == "database" {
+			return "#FF0000"
+		}
+		return ""
+	}))
+	c.Assert(err, gc.IsNil)
+	colors := make(map[string]string)
+	for _, r := range cvs.relations {
+		colors[r.interfaceName] = r.color
+	}
+	c.Assert(colors, gc.DeepEquals, map[string]string{
+		"essearch": "",
+		"database": "#FF0000",
+	})
+}
+
+func (s *newSuite) TestPaletteColors(c *gc.C) {
+	color := PaletteColors(DefaultInterfacePalette)
+	c.Assert(color("mysql"), gc.Equals, color("mysql"))
+	found := false
+	for _, col := range DefaultInterfacePalette {
+		found = found || col == color("http")
+	}
+	c.Assert(found, gc.Equals, true)
+	c.Assert(PaletteColors(nil)("http"), gc.Equals, "")
+}
+
+func (s *newSuite) TestHiddenServices(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	b.Services["elasticsearch"].Annotations["hide"] = "true"
+	b.Services["mongodb"].Annotations["hide"] = "false"
+
+	cvs, err := NewFromBundle(b, iconURL, nil)
+	c.Assert(err, gc.IsNil)
+	var names []string
+	for _, svc := range cvs.services {
+		names = append(names, svc.name)
+	}
+	c.Assert(names, gc.DeepEquals, []string{"charmworld", "mongodb"})
+	c.Assert(cvs.relations, gc.HasLen, 1)
+	c.Assert(cvs.relations[0].serviceA.name, gc.Equals, "charmworld")
+	c.Assert(cvs.relations[0].serviceB.name, gc.Equals, "mongodb")
+
+	// The bounding box includes only the services shown.
+	width, height := cvs.layout()
+	c.Assert(width, gc.Equals, 127+serviceBlockSize)
+	c.Assert(height, gc.Equals, 276+serviceBlockSize)
+}
+
+func (s *newSuite) TestWithPerimeterRelations(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	cvs, err := NewFromBundle(b, iconURL, nil, WithPerimeterRelations())
+	c.Assert(err, gc.IsNil)
+	c.Assert(cvs.relations, gc.HasLen, 2)
+	for _, r := range cvs.relations {
+		c.Assert(r.perimeter, gc.Equals, true)
+	}
+}
+
+func (s *newSuite) TestWithServiceShapes(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	cvs, err := NewFromBundle(b, iconURL, nil, WithServiceShapes(func(id *charm.URL) Shape {
+		if id.Name == "mongodb" {
+			return ShapeCylinder
+		}
+		return ShapeNone
+	}))
+	c.Assert(err, gc.IsNil)
+	shapes := make(map[string]Shape)
+	for _, svc := range cvs.services {
+		shapes[svc.name] = svc.shape
+	}
+	c.Assert(shapes, gc.DeepEquals, map[string]Shape{
+		"charmworld":    ShapeNone,
+		"elasticsearch": ShapeNone,
+		"mongodb":       ShapeCylinder,
+	})
+}
+
+func (s *newSuite) TestWithCoordinateRounding(c *gc.C) {
+	tests := []struct {
+		about    string
+		round    func(float64) int
+		expected map[string]image.Point
+	}{{
+		about: "default",
+		expected: map[string]image.Point{
+			"charmworld":    {323, 0},
+			"elasticsearch": {0, 257},
+			"mongodb":       {450, 276},
+		},
+	}, {
+		about: "nearest",
+		round: RoundNearest,
+		expected: map[string]image.Point{
+			"charmworld":    {323, 0},
+			"elasticsearch": {0, 258},
+			"mongodb":       {450, 277},
+		},
+	}, {
+		about: "down",
+		round: RoundDown,
+		expected: map[string]image.Point{
+			"charmworld":    {323, 0},
+			"elasticsearch": {0, 257},
+			"mongodb":       {450, 276},
+		},
+	}, {
+		about: "grid",
+		round: SnapToGrid(50),
+		expected: map[string]image.Point{
+			"charmworld":    {300, 0},
+			"elasticsearch": {0, 250},
+			"mongodb":       {450, 300},
+		},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		b, err := charm.ReadBundleData(strings.NewReader(bundle))
+		c.Assert(err, gc.IsNil)
+		var opts []CanvasOption
+		if test.round != nil {
+			opts = append(opts, WithCoordinateRounding(test.round))
+		}
+		cvs, err := NewFromBundle(b, iconURL, nil, opts...)
+		c.Assert(err, gc.IsNil)
+		cvs.layout()
+		points := make(map[string]image.Point)
+		for _, svc := range cvs.services {
+			points[svc.name] = svc.point
+		}
+		c.Assert(points, gc.DeepEquals, test.expected)
+	}
+}
+
+func (s *newSuite) TestRounding(c *gc.C) {
+	c.Assert(RoundNearest(1.5), gc.Equals, 2)
+	c.Assert(RoundNearest(-1.5), gc.Equals, -2)
+	c.Assert(RoundNearest(-1.4), gc.Equals, -1)
+	c.Assert(RoundDown(-1.4), gc.Equals, -2)
+	c.Assert(SnapToGrid(10)(-14.9), gc.Equals, -10)
+	c.Assert(SnapToGrid(10)(15), gc.Equals, 20)
+	c.Assert(SnapToGrid(0)(15.5), gc.Equals, 16)
+}
+
+func (s *newSuite) TestWithTopologyOnly(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	// Positions are ignored, even if invalid.
+	b.Services["mongodb"].Annotations["gui-x"] = "bad-wolf"
+
+	ef := errFetcher("icons should not be fetched")
+	cvs, err := NewFromBundle(b, iconURL, &ef, WithTopologyOnly())
+	c.Assert(err, gc.IsNil)
+	points := make(map[string]image.Point)
+	for _, svc := range cvs.services {
+		c.Assert(svc.iconUrl, gc.Equals, "")
+		c.Assert(svc.iconSrc, gc.IsNil)
+		points[svc.name] = svc.point
+	}
+	c.Assert(points, gc.DeepEquals, map[string]image.Point{
+		"charmworld":    {0, -189},
+		"elasticsearch": {164, 94},
+		"mongodb":       {-164, 95},
+	})
+	c.Assert(cvs.relations, gc.HasLen, 2)
+
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), gc.Not(jc.Contains), "<image")
+}
+
+func (s *newSuite) TestWithDescription(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	b.Description = "A search engine."
+	b.Tags = []string{"search"}
+
+	cvs, err := NewFromBundle(b, iconURL, nil)
+	c.Assert(err, gc.IsNil)
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), gc.Not(jc.Contains), "A search engine.")
+
+	cvs, err = NewFromBundle(b, iconURL, nil, WithDescription())
+	c.Assert(err, gc.IsNil)
+	buf.Reset()
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), jc.Contains, ">A search engine.</text>")
+	c.Assert(buf.String(), jc.Contains, ">tags: search</text>")
+}
+
+func (s *newSuite) TestDuplicateRelations(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	b.Relations = append(b.Relations,
+		[]string{"mongodb:database", "charmworld:database"},
+		[]string{"charmworld:essearch", "elasticsearch:essearch"},
+	)
+
+	var duplicates [][]string
+	cvs, err := NewFromBundle(b, iconURL, nil, WithDuplicateRelations(func(endpoints []string) {
+		duplicates = append(duplicates, endpoints)
+	}))
+	c.Assert(err, gc.IsNil)
+	c.Assert(cvs.relations, gc.HasLen, 2)
+	c.Assert(duplicates, gc.DeepEquals, [][]string{
+		{"mongodb:database", "charmworld:database"},
+		{"charmworld:essearch", "elasticsearch:essearch"},
+	})
+	// The bundle itself is left unchanged.
+	c.Assert(b.Relations, gc.HasLen, 4)
+
+	// Duplicates are collapsed without the option too.
+	cvs, err = NewFromBundle(b, iconURL, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(cvs.relations, gc.HasLen, 2)
+}
+
+func (s *newSuite) TestWithUnitScaling(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	b.Services["elasticsearch"].NumUnits = 3
+	b.Services["mongodb"].NumUnits = 5
+
+	cvs, err := NewFromBundle(b, iconURL, nil, WithUnitScaling(1, 2))
+	c.Assert(err, gc.IsNil)
+	scales := make(map[string]float64)
+	points := make(map[string]image.Point)
+	for _, svc := range cvs.services {
+		scales[svc.name] = svc.scale
+		points[svc.name] = svc.point
+	}
+	c.Assert(scales, gc.DeepEquals, map[string]float64{
+		"charmworld":    1,
+		"elasticsearch": 1.5,
+		"mongodb":       2,
+	})
+	// The centers of the services are twice as far apart.
+	c.Assert(points, gc.DeepEquals, map[string]image.Point{
+		"charmworld":    {1720, 318},
+		"elasticsearch": {1074, 832},
+		"mongodb":       {1974, 870},
+	})
+
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), jc.Contains, `<g transform="translate(1042,646) scale(2) translate(-1042,-646)" >
+<use x="948" y="552" xlink:href="#serviceBlock" id="mongodb" />`)
+
+	// Invalid bounds are ignored.
+	cvs, err = NewFromBundle(b, iconURL, nil, WithUnitScaling(2, 1))
+	c.Assert(err, gc.IsNil)
+	for _, svc := range cvs.services {
+		c.Assert(svc.scale, gc.Equals, 0.0)
+	}
+}
+
+func (s *newSuite) TestWithMaxLabelLength(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	labels := func(cvs *Canvas) map[string]string {
+		labels := make(map[string]string)
+		for _, svc := range cvs.services {
+			labels[svc.name] = svc.label
+		}
+		return labels
+	}
+	cvs, err := NewFromBundle(b, iconURL, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(labels(cvs), gc.DeepEquals, map[string]string{
+		"charmworld":    "",
+		"elasticsearch": "",
+		"mongodb":       "",
+	})
+
+	cvs, err = NewFromBundle(b, iconURL, nil, WithMaxLabelLength(8))
+	c.Assert(err, gc.IsNil)
+	c.Assert(labels(cvs), gc.DeepEquals, map[string]string{
+		"charmworld":    "charmwo…",
+		"elasticsearch": "elastic…",
+		"mongodb":       "",
+	})
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), jc.Contains, "<title>elasticsearch</title>\n<text")
+}
+
+func (s *newSuite) TestWithCrossModelRelations(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	b.Relations = append(b.Relations,
+		[]string{"mongodb:database", "admin/production.backup:db"},
+		[]string{"prod.logging", "charmworld"},
+	)
+
+	_, err = NewFromBundle(b, iconURL, nil)
+	c.Assert(err, gc.ErrorMatches, "cannot verify bundle: .*")
+
+	cvs, err := NewFromBundle(b, iconURL, nil, WithCrossModelRelations())
+	c.Assert(err, gc.IsNil)
+	// The bundle itself is left unchanged.
+	c.Assert(b.Relations, gc.HasLen, 4)
+	offers := make(map[string]image.Point)
+	for _, svc := range cvs.services {
+		if svc.offer {
+			offers[svc.name] = svc.point
+		}
+	}
+	c.Assert(offers, gc.DeepEquals, map[string]image.Point{
+		"admin/production.backup": {1223, 112},
+		"prod.logging":            {1223, 395},
+	})
+	c.Assert(cvs.relations, gc.HasLen, 4)
+	dashes := make(map[string]string)
+	for _, r := range cvs.relations {
+		dashes[r.serviceA.name+" "+r.serviceB.name] = r.dash
+	}
+	c.Assert(dashes, gc.DeepEquals, map[string]string{
+		"charmworld elasticsearch":        "",
+		"charmworld mongodb":              "",
+		"mongodb admin/production.backup": "8,4",
+		"prod.logging charmworld":         "8,4",
+	})
+
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), jc.Contains, `<text x="827" y="76" style="font-size:14px;fill:#888888;text-anchor:middle">offer</text>`)
+	c.Assert(buf.String(), jc.Contains, `<title>admin/production.backup</title>`)
+	c.Assert(buf.String(), jc.Contains, `>prod.logging</text>`)
+}
+
+func (s *newSuite) TestWithServiceAttributes(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	cvs, err := NewFromBundle(b, iconURL, nil, WithServiceAttributes(func(name string, spec *charm.ServiceSpec) map[string]string {
+		return map[string]string{
+			"data-charm": spec.Charm,
+			"data-units": fmt.Sprint(spec.NumUnits),
+		}
+	}))
+	c.Assert(err, gc.IsNil)
+	attrs := make(map[string]map[string]string)
+	for _, svc := range cvs.services {
+		attrs[svc.name] = svc.attrs
+	}
+	c.Assert(attrs, gc.DeepEquals, map[string]map[string]string{
+		"charmworld": {
+			"data-charm": "cs:~juju-jitsu/precise/charmworld-58",
+			"data-units": "1",
+		},
+		"elasticsearch": {
+			"data-charm": "cs:~charming-devs/precise/elasticsearch-2",
+			"data-units": "1",
+		},
+		"mongodb": {
+			"data-charm": "cs:precise/mongodb-21",
+			"data-units": "1",
+		},
+	})
+}
+
+// mapFetcher is an IconFetcher which returns the icons it holds.
+type mapFetcher map[string][]byte
+
+func (f mapFetcher) FetchIcons(*charm.BundleData) (map[string][]byte, error) {
+	return f, nil
+}
+
+func (s *newSuite) TestMalformedIcons(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	b.Services["duplicateService"] = &charm.ServiceSpec{
+		Charm:    "cs:precise/mongodb-21",
+		NumUnits: 1,
+	}
+	fetcher := mapFetcher{
+		"precise/mongodb-21":                     []byte("<svg><g></svg>"),
+		"~juju-jitsu/precise/charmworld-58":      []byte("<svg></svg>"),
+		"~charming-devs/precise/elasticsearch-2": []byte("<html></html>"),
+	}
+	reported := make(map[string]string)
+	cvs, err := NewFromBundle(b, iconURL, fetcher, WithIconErrors(func(charmPath string, err error) {
+		_, ok := reported[charmPath]
+		c.Check(ok, gc.Equals, false)
+		reported[charmPath] = err.Error()
+	}))
+	c.Assert(err, gc.IsNil)
+	c.Assert(reported, gc.DeepEquals, map[string]string{
+		"precise/mongodb-21":                     "cannot get token: XML syntax error on line 1: element <g> closed by </svg>",
+		"~charming-devs/precise/elasticsearch-2": "icon does not appear to be a valid SVG",
+	})
+	for _, svc := range cvs.services {
+		if svc.name == "charmworld" {
+			c.Assert(string(svc.iconSrc), gc.Equals, "<svg></svg>")
+		} else {
+			c.Assert(string(svc.iconSrc), gc.Equals, placeholderIcon)
+		}
+	}
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	xmlTokens(c, buf.Bytes())
+}
+
+func (s *newSuite) TestWithInterfaceDashes(c *gc.C) {
+	tests := []struct {
+		about    string
+		pattern  string
+		expected string
+		err      string
+	}{{
+		about: "solid",
+	}, {
+		about:    "commas",
+		pattern:  "5,3",
+		expected: "5, 3",
+	}, {
+		about:    "spaces",
+		pattern:  " 4.50  2 0 ",
+		expected: "4.5, 2, 0",
+	}, {
+		about:   "not a number",
+		pattern: "5, bad-wolf",
+		err:     `invalid dash pattern for interface "database": "bad-wolf" is not a non-negative number`,
+	}, {
+		about:   "negative",
+		pattern: "5 -3",
+		err:     `invalid dash pattern for interface "database": "-3" is not a non-negative number`,
+	}, {
+		about:   "no dashes",
+		pattern: "0, 0",
+		err:     `invalid dash pattern for interface "database": "0, 0" has no dashes`,
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		b, err := charm.ReadBundleData(strings.NewReader(bundle))
+		c.Assert(err, gc.IsNil)
+		cvs, err := NewFromBundle(b, iconURL, nil, WithInterfaceDashes(func(interfaceName string) string {
+			if interfaceName == "database" {
+				return test.pattern
+			}
+			return ""
+		}))
+		if test.err != "" {
+			c.Assert(err, gc.ErrorMatches, test.err)
+			continue
+		}
+		c.Assert(err, gc.IsNil)
+		dashes := make(map[string]string)
+		for _, r := range cvs.relations {
+			dashes[r.interfaceName] = r.dash
+		}
+		c.Assert(dashes, gc.DeepEquals, map[string]string{
+			"essearch": "",
+			"database": test.expected,
+		})
+	}
+}
+
+func (s *newSuite) TestWithIconMode(c *gc.C) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg">%s</svg>`, r.URL.Path)
+	}))
+	defer ts.Close()
+	tsIconURL := func(ref *charm.URL) string {
+		return ts.URL + "/" + ref.Path() + ".svg"
+	}
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	cvs, err := NewFromBundle(b, tsIconURL, nil, WithIconMode(IconsEmbedded))
+	c.Assert(err, gc.IsNil)
+	for _, svc := range cvs.services {
+		c.Assert(string(svc.iconSrc), gc.Equals, `<svg xmlns="http://www.w3.org/2000/svg">/`+svc.charmPath+`.svg</svg>`)
+	}
+
+	cvs, err = NewFromBundle(b, tsIconURL, nil, WithIconMode(IconsLinked))
+	c.Assert(err, gc.IsNil)
+	for _, svc := range cvs.services {
+		c.Assert(string(svc.iconSrc), jc.Contains, `xlink:href="`+svc.iconUrl+`"`)
+	}
+
+	// An explicit fetcher takes precedence.
+	cvs, err = NewFromBundle(b, tsIconURL, new(emptyFetcher), WithIconMode(IconsEmbedded))
+	c.Assert(err, gc.IsNil)
+	for _, svc := range cvs.services {
+		c.Assert(svc.iconSrc, gc.HasLen, 0)
+	}
+
+	old, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	cvs, err = NewFromBundleDiff(old, b, tsIconURL, nil, WithIconMode(IconsEmbedded))
+	c.Assert(err, gc.IsNil)
+	for _, svc := range cvs.services {
+		c.Assert(string(svc.iconSrc), gc.Equals, `<svg xmlns="http://www.w3.org/2000/svg">/`+svc.charmPath+`.svg</svg>`)
+	}
+}
+
+func (s *newSuite) TestWithPrecision(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	cvs, err := NewFromBundle(b, iconURL, nil)
+	c.Assert(err, gc.IsNil)
+	for _, r := range cvs.relations {
+		c.Assert(r.formatLength, gc.IsNil)
+	}
+
+	var tests = []struct {
+		digits int
+		expect string
+	}{{
+		digits: 0,
+		expect: "3",
+	}, {
+		digits: 3,
+		expect: "2.718",
+	}, {
+		digits: -1,
+		expect: "3",
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %d digits", i, test.digits)
+		cvs, err := NewFromBundle(b, iconURL, nil, WithPrecision(test.digits))
+		c.Assert(err, gc.IsNil)
+		c.Assert(cvs.relations, gc.Not(gc.HasLen), 0)
+		for _, r := range cvs.relations {
+			c.Assert(r.formatLength(2.71828), gc.Equals, test.expect)
+		}
+	}
+}
+
+func (s *newSuite) TestWithFocus(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	dimmed := func(cvs *Canvas) map[string]bool {
+		dimmed := make(map[string]bool)
+		for _, svc := range cvs.services {
+			dimmed[svc.name] = svc.dimmed
+		}
+		for _, r := range cvs.relations {
+			dimmed[r.serviceA.name+" "+r.serviceB.name] = r.dimmed
+		}
+		return dimmed
+	}
+	cvs, err := NewFromBundle(b, iconURL, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(dimmed(cvs), gc.DeepEquals, map[string]bool{
+		"charmworld":               false,
+		"elasticsearch":            false,
+		"mongodb":                  false,
+		"charmworld elasticsearch": false,
+		"charmworld mongodb":       false,
+	})
+
+	cvs, err = NewFromBundle(b, iconURL, nil, WithFocus("elasticsearch"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(dimmed(cvs), gc.DeepEquals, map[string]bool{
+		"charmworld":               false,
+		"elasticsearch":            false,
+		"mongodb":                  true,
+		"charmworld elasticsearch": false,
+		"charmworld mongodb":       true,
+	})
+
+	cvs, err = NewFromBundle(b, iconURL, nil, WithFocus("charmworld"))
+	c.Assert(err, gc.IsNil)
+	for name, dimmed := range dimmed(cvs) {
+		c.Assert(dimmed, jc.IsFalse, gc.Commentf("%s", name))
+	}
+
+	_, err = NewFromBundle(b, iconURL, nil, WithFocus("wordpress"))
+	c.Assert(err, gc.ErrorMatches, `focus service "wordpress" not found`)
+}
+
+func (s *newSuite) TestWithSelfRelations(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	b.Relations = append(b.Relations, []string{"mongodb:replica-set", "mongodb:replica-set"})
+
+	_, err = NewFromBundle(b, iconURL, nil)
+	c.Assert(err, gc.ErrorMatches, "cannot verify bundle: .*")
+
+	cvs, err := NewFromBundle(b, iconURL, nil, WithSelfRelations())
+	c.Assert(err, gc.IsNil)
+	// The bundle itself is left unchanged.
+	c.Assert(b.Relations, gc.HasLen, 3)
+	c.Assert(cvs.relations, gc.HasLen, 3)
+	self := cvs.relations[2]
+	c.Assert(self.serviceA.name, gc.Equals, "mongodb")
+	c.Assert(self.serviceB, gc.Equals, self.serviceA)
+
+	// Relations to unknown services still fail verification.
+	b.Relations = append(b.Relations, []string{"wordpress:loadbalancer", "wordpress:loadbalancer"})
+	_, err = NewFromBundle(b, iconURL, nil, WithSelfRelations())
+	c.Assert(err, gc.ErrorMatches, "cannot verify bundle: .*")
+}
+
+func (s *newSuite) TestWithIconShadows(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	cvs, err := NewFromBundle(b, iconURL, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(cvs.iconShadow, gc.IsNil)
+	for _, svc := range cvs.services {
+		c.Assert(svc.shadow, jc.IsFalse)
+	}
+
+	cvs, err = NewFromBundle(b, iconURL, nil, WithIconShadows(IconShadow{Blur: -1}))
+	c.Assert(err, gc.IsNil)
+	c.Assert(cvs.iconShadow, jc.DeepEquals, &IconShadow{Color: "#000000"})
+	for _, svc := range cvs.services {
+		c.Assert(svc.shadow, jc.IsTrue)
+	}
+}
+
+func (s *newSuite) TestWithServiceModels(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	cvs, err := NewFromBundle(b, iconURL, nil, WithServiceModels(func(name string) string {
+		if name == "mongodb" {
+			return ""
+		}
+		return "admin/production"
+	}))
+	c.Assert(err, gc.IsNil)
+	models := make(map[string]string)
+	for _, svc := range cvs.services {
+		models[svc.name] = svc.model
+	}
+	c.Assert(models, gc.DeepEquals, map[string]string{
+		"charmworld":    "admin/production",
+		"elasticsearch": "admin/production",
+		"mongodb":       "",
+	})
+}
+
+func (s *newSuite) TestWithConstraints(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	b.Services["mongodb"].Constraints = "  cpu-cores=2   mem=4G\tarch=amd64 "
+
+	constraints := func(cvs *Canvas) map[string]string {
+		constraints := make(map[string]string)
+		for _, svc := range cvs.services {
+			constraints[svc.name] = svc.constraints
+		}
+		return constraints
+	}
+	cvs, err := NewFromBundle(b, iconURL, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(constraints(cvs), gc.DeepEquals, map[string]string{
+		"charmworld":    "",
+		"elasticsearch": "",
+		"mongodb":       "",
+	})
+
+	cvs, err = NewFromBundle(b, iconURL, nil, WithConstraints())
+	c.Assert(err, gc.IsNil)
+	c.Assert(constraints(cvs), gc.DeepEquals, map[string]string{
+		"charmworld":    "",
+		"elasticsearch": "mem=2G cpu-cores=1",
+		"mongodb":       "cpu-cores=2 mem=4G arch=amd64",
+	})
+
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), jc.Contains, `<g >
+<title>constraints: cpu-cores=2 mem=4G arch=amd64</title>
+<use x="450" y="276" xlink:href="#serviceBlock" id="mongodb" />`)
+	c.Assert(strings.Count(buf.String(), "<title>constraints:"), gc.Equals, 2)
+}
+
+func (s *newSuite) TestWithServiceList(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	b.Services["mongodb"].NumUnits = 3
+
+	cvs, err := NewFromBundle(b, iconURL, nil, WithServiceList())
+	c.Assert(err, gc.IsNil)
+	c.Assert(cvs.serviceListLines(), jc.DeepEquals, []string{
+		"charmworld: ~juju-jitsu/precise/charmworld-58, 1 unit",
+		"elasticsearch: ~charming-devs/precise/elasticsearch-2, 1 unit",
+		"mongodb: precise/mongodb-21, 3 units",
+	})
+}
+
+func (s *newSuite) TestWithRelationWeights(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	cvs, err := NewFromBundle(b, iconURL, nil, WithRelationWeights(func(endpoints []string) (float64, bool) {
+		if endpoints[1] == "mongodb:database" {
+			return 1000, true
+		}
+		return 10, true
+	}, 1, 5, LinearWeights))
+	c.Assert(err, gc.IsNil)
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), jc.Contains, `stroke-width="1px"`)
+	c.Assert(buf.String(), jc.Contains, `stroke-width="5px"`)
+	c.Assert(buf.String(), gc.Not(jc.Contains), `stroke-width="2px" stroke-dasharray`)
+}
+
+func (s *newSuite) TestWithCharmLegend(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	cvs, err := NewFromBundle(b, iconURL, nil, WithCharmLegend())
+	c.Assert(err, gc.IsNil)
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	// The panel is shown to the right of the diagram, which is
+	// 639 pixels wide.
+	c.Assert(buf.String(), jc.Contains, `<svg width="947" height="465"`)
+	c.Assert(buf.String(), jc.Contains, `<g id="charmLegend">
+<use x="659" y="20" xlink:href="#icon-3" width="32" height="32" />
+<text x="699" y="34" style="font-size:14px;fill:#505050">mongodb</text>
+<text x="699" y="50" style="font-size:12px;fill:#888888">precise/mongodb-21</text>
+<use x="659" y="60" xlink:href="#icon-2" width="32" height="32" />
+<text x="699" y="74" style="font-size:14px;fill:#505050">elasticsearch</text>
+<text x="699" y="90" style="font-size:12px;fill:#888888">~charming-devs/precise/elasticsearch-2</text>
+<use x="659" y="100" xlink:href="#icon-1" width="32" height="32" />
+<text x="699" y="114" style="font-size:14px;fill:#505050">charmworld</text>
+<text x="699" y="130" style="font-size:12px;fill:#888888">~juju-jitsu/precise/charmworld-58</text>
+</g>`)
+	c.Assert(buf.Bytes(), jujusvgtest.IsValidSVG)
+
+	// Each charm is listed once.
+	b.Services["mongodb2"] = &charm.ServiceSpec{
+		Charm:    "cs:precise/mongodb-21",
+		NumUnits: 1,
+	}
+	cvs, err = NewFromBundle(b, iconURL, nil, WithCharmLegend())
+	c.Assert(err, gc.IsNil)
+	buf.Reset()
+	cvs.Marshal(&buf)
+	c.Assert(strings.Count(buf.String(), ">precise/mongodb-21</text>"), gc.Equals, 1)
+
+	// The panel is not shown when clipping.
+	cvs, err = NewFromBundle(b, iconURL, nil, WithCharmLegend(), WithClip(image.Rect(0, 0, 100, 100)))
+	c.Assert(err, gc.IsNil)
+	buf.Reset()
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), gc.Not(jc.Contains), "charmLegend")
+}
+
+func (s *newSuite) TestWithRelationNotes(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	cvs, err := NewFromBundle(b, iconURL, nil, WithRelationNotes(func(endpoints []string) string {
+		if relationKey(endpoints) == "charmworld:database mongodb:database" {
+			return "TLS required"
+		}
+		return ""
+	}))
+	c.Assert(err, gc.IsNil)
+	notes := make(map[string]string)
+	for _, r := range cvs.relations {
+		notes[r.serviceA.name+" "+r.serviceB.name] = r.note
+	}
+	c.Assert(notes, jc.DeepEquals, map[string]string{
+		"charmworld elasticsearch": "",
+		"charmworld mongodb":       "TLS required",
+	})
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), jc.Contains, `<g id="relationNotes">
+<rect `)
+	c.Assert(buf.String(), jc.Contains, `style="font-size:12px;fill:#505050;text-anchor:middle">TLS required</text>
+</g>`)
+	c.Assert(buf.Bytes(), jujusvgtest.IsValidSVG)
+
+	cvs, err = NewFromBundle(b, iconURL, nil)
+	c.Assert(err, gc.IsNil)
+	buf.Reset()
+	cvs.Marshal(&buf)
+	c.Assert(buf.String(), gc.Not(jc.Contains), "relationNotes")
+}
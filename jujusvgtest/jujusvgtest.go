@@ -0,0 +1,213 @@
+// Package jujusvgtest provides helpers for testing code which renders
+// bundles with jujusvg.
+package jujusvgtest
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+)
+
+const (
+	svgNamespace   = "http://www.w3.org/2000/svg"
+	xmlNamespace   = "http://www.w3.org/XML/1998/namespace"
+	xlinkNamespace = "http://www.w3.org/1999/xlink"
+)
+
+// urlReference matches references to elements in the document made in
+// attribute values, such as fill="url(#gradient)".
+var urlReference = regexp.MustCompile(`url\(#([^)]+)\)`)
+
+// Validate checks that data holds a well-formed SVG document as written
+// by jujusvg. It checks that the document is well-formed XML with a
+// single svg root element in the SVG namespace, that every namespace
+// prefix used is declared, that no two elements share an id, and that
+// every reference to an element of the document, such as
+// xlink:href="#id" or url(#id), refers to an element which exists. It
+// does not validate the document against the SVG schema.
+func Validate(data []byte) error {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	// elements holds the start of each element which has not yet
+	// ended, along with the namespaces in scope for it.
+	type element struct {
+		name       xml.Name
+		namespaces map[string]string
+	}
+	var elements []element
+	roots := 0
+	ids := make(map[string]bool)
+	var refs []string
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errgo.Notef(err, "invalid XML")
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			namespaces := map[string]string{
+				"xml": xmlNamespace,
+			}
+			if len(elements) > 0 {
+				namespaces = elements[len(elements)-1].namespaces
+			}
+			namespaces = declaredNamespaces(namespaces, tok.Attr)
+			space, err := resolve(namespaces, tok.Name, true)
+			if err != nil {
+				return err
+			}
+			if len(elements) == 0 {
+				roots++
+				if roots > 1 {
+					return errgo.Newf("more than one root element")
+				}
+				if tok.Name.Local != "svg" {
+					return errgo.Newf("root element is %s, not svg", name(tok.Name))
+				}
+				if space != svgNamespace {
+					return errgo.Newf("root element is not in the SVG namespace")
+				}
+			}
+			for _, attr := range tok.Attr {
+				if attr.Name.Space == "xmlns" || attr.Name.Space == "" && attr.Name.Local == "xmlns" {
+					continue
+				}
+				space, err := resolve(namespaces, attr.Name, false)
+				if err != nil {
+					return err
+				}
+				switch {
+				case space == "" && attr.Name.Local == "id":
+					if ids[attr.Value] {
+						return errgo.Newf("duplicate id %q", attr.Value)
+					}
+					ids[attr.Value] = true
+				case attr.Name.Local == "href" && (space == "" || space == xlinkNamespace):
+					if strings.HasPrefix(attr.Value, "#") {
+						refs = append(refs, attr.Value[1:])
+					}
+				}
+				for _, m := range urlReference.FindAllStringSubmatch(attr.Value, -1) {
+					refs = append(refs, m[1])
+				}
+			}
+			elements = append(elements, element{
+				name:       tok.Name,
+				namespaces: namespaces,
+			})
+		case xml.EndElement:
+			if len(elements) == 0 {
+				return errgo.Newf("unexpected end element %s", name(tok.Name))
+			}
+			start := elements[len(elements)-1]
+			if tok.Name != start.name {
+				return errgo.Newf("element %s closed by %s", name(start.name), name(tok.Name))
+			}
+			elements = elements[:len(elements)-1]
+		case xml.CharData:
+			if len(elements) == 0 && len(bytes.TrimSpace(tok)) > 0 {
+				return errgo.Newf("text outside the root element")
+			}
+		}
+	}
+	if len(elements) > 0 {
+		return errgo.Newf("element %s not closed", name(elements[len(elements)-1].name))
+	}
+	if roots == 0 {
+		return errgo.Newf("no root element")
+	}
+	for _, ref := range refs {
+		if !ids[ref] {
+			return errgo.Newf("reference to unknown id %q", ref)
+		}
+	}
+	return nil
+}
+
+// declaredNamespaces returns the namespaces in scope for an element with
+// the given attributes, given those in scope for its parent, which are
+// left unchanged.
+func declaredNamespaces(parent map[string]string, attrs []xml.Attr) map[string]string {
+	var namespaces map[string]string
+	for _, attr := range attrs {
+		var prefix string
+		switch {
+		case attr.Name.Space == "xmlns":
+			prefix = attr.Name.Local
+		case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+		default:
+			continue
+		}
+		if namespaces == nil {
+			namespaces = make(map[string]string)
+			for p, uri := range parent {
+				namespaces[p] = uri
+			}
+		}
+		namespaces[prefix] = attr.Value
+	}
+	if namespaces == nil {
+		return parent
+	}
+	return namespaces
+}
+
+// resolve returns the namespace of the given name. Unprefixed names of
+// elements are in the default namespace, while those of attributes are
+// in no namespace.
+func resolve(namespaces map[string]string, n xml.Name, isElement bool) (string, error) {
+	if n.Space == "" && !isElement {
+		return "", nil
+	}
+	uri, ok := namespaces[n.Space]
+	if !ok && n.Space != "" {
+		return "", errgo.Newf("undeclared namespace prefix %q in %s", n.Space, name(n))
+	}
+	return uri, nil
+}
+
+// name returns the name as written in the document.
+func name(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
+
+// IsValidSVG is a checker which checks that the obtained value, a []byte
+// or string, holds a valid SVG document as checked by Validate. For
+// example:
+//
+//	c.Assert(buf.Bytes(), jujusvgtest.IsValidSVG)
+var IsValidSVG gc.Checker = &validSVGChecker{
+	&gc.CheckerInfo{Name: "IsValidSVG", Params: []string{"obtained"}},
+}
+
+type validSVGChecker struct {
+	*gc.CheckerInfo
+}
+
+// Check implements gc.Checker.Check.
+func (checker *validSVGChecker) Check(params []interface{}, names []string) (result bool, error string) {
+	var data []byte
+	switch obtained := params[0].(type) {
+	case []byte:
+		data = obtained
+	case string:
+		data = []byte(obtained)
+	default:
+		return false, fmt.Sprintf("obtained value must be []byte or string, not %T", params[0])
+	}
+	if err := Validate(data); err != nil {
+		return false, err.Error()
+	}
+	return true, ""
+}
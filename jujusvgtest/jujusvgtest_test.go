@@ -0,0 +1,146 @@
+package jujusvgtest_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+
+	"gopkg.in/juju/jujusvg.v1"
+	"gopkg.in/juju/jujusvg.v1/jujusvgtest"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type ValidateSuite struct{}
+
+var _ = gc.Suite(&ValidateSuite{})
+
+var validateTests = []struct {
+	about       string
+	data        string
+	expectError string
+}{{
+	about: "valid document",
+	data: `<?xml version="1.0"?>
+<svg width="10" height="10" xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink">
+<defs><g id="block"><rect width="1" height="1" fill="url(#fill)"/></g><linearGradient id="fill"/></defs>
+<use xlink:href="#block"/>
+<svg xml:space="preserve" id="icon"><circle r="1"/></svg>
+</svg>`,
+}, {
+	about: "redeclared namespace prefix",
+	data:  `<svg xmlns="http://www.w3.org/2000/svg"><s:g xmlns:s="http://www.w3.org/2000/svg"/></svg>`,
+}, {
+	about:       "malformed XML",
+	data:        `<svg xmlns="http://www.w3.org/2000/svg"><g></svg>`,
+	expectError: `element g closed by svg`,
+}, {
+	about:       "unclosed element",
+	data:        `<svg xmlns="http://www.w3.org/2000/svg">`,
+	expectError: `element svg not closed`,
+}, {
+	about:       "invalid syntax",
+	data:        `<svg xmlns="http://www.w3.org/2000/svg" width=10></svg>`,
+	expectError: `invalid XML: .*`,
+}, {
+	about:       "empty document",
+	data:        `<?xml version="1.0"?>`,
+	expectError: `no root element`,
+}, {
+	about:       "several root elements",
+	data:        `<svg xmlns="http://www.w3.org/2000/svg"/><svg xmlns="http://www.w3.org/2000/svg"/>`,
+	expectError: `more than one root element`,
+}, {
+	about:       "text outside root element",
+	data:        `<svg xmlns="http://www.w3.org/2000/svg"/>text`,
+	expectError: `text outside the root element`,
+}, {
+	about:       "wrong root element",
+	data:        `<html xmlns="http://www.w3.org/2000/svg"/>`,
+	expectError: `root element is html, not svg`,
+}, {
+	about:       "missing SVG namespace",
+	data:        `<svg/>`,
+	expectError: `root element is not in the SVG namespace`,
+}, {
+	about:       "undeclared element prefix",
+	data:        `<svg xmlns="http://www.w3.org/2000/svg"><s:g/></svg>`,
+	expectError: `undeclared namespace prefix "s" in s:g`,
+}, {
+	about:       "undeclared attribute prefix",
+	data:        `<svg xmlns="http://www.w3.org/2000/svg"><use xlink:href="#a" id="a"/></svg>`,
+	expectError: `undeclared namespace prefix "xlink" in xlink:href`,
+}, {
+	about:       "duplicate id",
+	data:        `<svg xmlns="http://www.w3.org/2000/svg"><g id="a"/><g id="a"/></svg>`,
+	expectError: `duplicate id "a"`,
+}, {
+	about:       "unknown href",
+	data:        `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink"><use xlink:href="#a"/></svg>`,
+	expectError: `reference to unknown id "a"`,
+}, {
+	about:       "unknown url",
+	data:        `<svg xmlns="http://www.w3.org/2000/svg"><g style="filter:url(#a)"/></svg>`,
+	expectError: `reference to unknown id "a"`,
+}}
+
+func (s *ValidateSuite) TestValidate(c *gc.C) {
+	for i, test := range validateTests {
+		c.Logf("test %d: %s", i, test.about)
+		err := jujusvgtest.Validate([]byte(test.data))
+		if test.expectError != "" {
+			c.Check(err, gc.ErrorMatches, test.expectError)
+		} else {
+			c.Check(err, gc.IsNil)
+			c.Check(test.data, jujusvgtest.IsValidSVG)
+		}
+	}
+}
+
+func (s *ValidateSuite) TestIsValidSVG(c *gc.C) {
+	ok, msg := jujusvgtest.IsValidSVG.Check([]interface{}{`<svg xmlns="http://www.w3.org/2000/svg"/>`}, nil)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(msg, gc.Equals, "")
+
+	ok, msg = jujusvgtest.IsValidSVG.Check([]interface{}{[]byte(`<svg/>`)}, nil)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(msg, gc.Equals, "root element is not in the SVG namespace")
+
+	ok, msg = jujusvgtest.IsValidSVG.Check([]interface{}{42}, nil)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(msg, gc.Equals, "obtained value must be []byte or string, not int")
+}
+
+const bundle = `
+services:
+  mongodb:
+    charm: "cs:precise/mongodb-21"
+    num_units: 1
+    annotations:
+      "gui-x": "940.5"
+      "gui-y": "388.7698359714502"
+  charmworld:
+    charm: "cs:~juju-jitsu/precise/charmworld-58"
+    num_units: 1
+    annotations:
+      "gui-x": "813.5"
+      "gui-y": "112.23016402854975"
+relations:
+  - - "charmworld:database"
+    - "mongodb:database"
+`
+
+func (s *ValidateSuite) TestMarshalOutput(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	cvs, err := jujusvg.NewFromBundle(b, func(id *charm.URL) string {
+		return "http://0.1.2.3/" + id.Path() + ".svg"
+	}, nil, jujusvg.WithMiniMap(), jujusvg.WithRelationGradients())
+	c.Assert(err, gc.IsNil)
+	var buf bytes.Buffer
+	cvs.Marshal(&buf)
+	c.Assert(buf.Bytes(), jujusvgtest.IsValidSVG)
+}
@@ -0,0 +1,77 @@
+package jujusvg
+
+import (
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+)
+
+// LocalFetcher is an IconFetcher which reads icons from a directory tree
+// on the local filesystem, allowing diagrams to be rendered without
+// network access. Charms whose icon files do not exist are left out of
+// the results, so that a LocalFetcher may be followed by another fetcher
+// in a ChainFetcher.
+type LocalFetcher struct {
+	// Dir holds the directory from which icons are read.
+	Dir string
+
+	// Path returns the path of the icon of the given charm, relative
+	// to Dir and using slashes as separators. If it is nil,
+	// DefaultLocalIconPath is used.
+	Path func(*charm.URL) string
+}
+
+// DefaultLocalIconPath returns the path of the icon of the given charm
+// used by LocalFetcher by default: the file icon.svg in a directory named
+// after the charm path, for instance "precise/mongodb-21/icon.svg".
+func DefaultLocalIconPath(charmId *charm.URL) string {
+	return path.Join(charmId.Path(), "icon.svg")
+}
+
+// FetchIcons implements IconFetcher.FetchIcons.
+func (f *LocalFetcher) FetchIcons(b *charm.BundleData) (map[string][]byte, error) {
+	icons, err := f.FetchTypedIcons(b)
+	if err != nil {
+		return nil, err
+	}
+	return iconData(icons), nil
+}
+
+// FetchTypedIcons implements TypedIconFetcher.FetchTypedIcons. The content
+// type of each icon is taken from the extension of its file; SVG is
+// assumed if the extension is not recognized.
+func (f *LocalFetcher) FetchTypedIcons(b *charm.BundleData) (map[string]Icon, error) {
+	iconPath := f.Path
+	if iconPath == nil {
+		iconPath = DefaultLocalIconPath
+	}
+	charmIds, err := UniqueCharms(b)
+	if err != nil {
+		return nil, err
+	}
+	icons := make(map[string]Icon)
+	for _, charmId := range charmIds {
+		file := filepath.Join(f.Dir, filepath.FromSlash(iconPath(charmId)))
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot read icon for %s", charmId.Path())
+		}
+		contentType := mime.TypeByExtension(filepath.Ext(file))
+		if contentType == "" {
+			contentType = svgContentType
+		}
+		icons[charmId.Path()] = Icon{
+			ContentType: contentType,
+			Data:        data,
+		}
+	}
+	return icons, nil
+}
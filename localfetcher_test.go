@@ -0,0 +1,117 @@
+package jujusvg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+)
+
+type LocalFetcherSuite struct{}
+
+var _ = gc.Suite(&LocalFetcherSuite{})
+
+// writeFiles writes the given files, keyed by slash-separated path
+// relative to dir.
+func writeFiles(c *gc.C, dir string, files map[string]string) {
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		c.Assert(err, gc.IsNil)
+		err = ioutil.WriteFile(path, []byte(data), 0644)
+		c.Assert(err, gc.IsNil)
+	}
+}
+
+func (s *LocalFetcherSuite) TestFetchTypedIcons(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	dir := c.MkDir()
+	writeFiles(c, dir, map[string]string{
+		"precise/mongodb-21/icon.svg":                     "<svg>mongodb</svg>",
+		"~charming-devs/precise/elasticsearch-2/icon.svg": "<svg>elasticsearch</svg>",
+		// The charmworld icon is missing.
+		"~juju-jitsu/precise/charmworld-58/other.svg": "<svg>other</svg>",
+	})
+	fetcher := &LocalFetcher{
+		Dir: dir,
+	}
+	icons, err := fetcher.FetchTypedIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.DeepEquals, map[string]Icon{
+		"precise/mongodb-21": {
+			ContentType: svgContentType,
+			Data:        []byte("<svg>mongodb</svg>"),
+		},
+		"~charming-devs/precise/elasticsearch-2": {
+			ContentType: svgContentType,
+			Data:        []byte("<svg>elasticsearch</svg>"),
+		},
+	})
+	data, err := fetcher.FetchIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(data, gc.DeepEquals, map[string][]byte{
+		"precise/mongodb-21":                     []byte("<svg>mongodb</svg>"),
+		"~charming-devs/precise/elasticsearch-2": []byte("<svg>elasticsearch</svg>"),
+	})
+}
+
+func (s *LocalFetcherSuite) TestPath(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	dir := c.MkDir()
+	writeFiles(c, dir, map[string]string{
+		"mongodb.png":       "png",
+		"elasticsearch.svg": "<svg>elasticsearch</svg>",
+		"charmworld.icon":   "<svg>charmworld</svg>",
+	})
+	fetcher := &LocalFetcher{
+		Dir: dir,
+		Path: func(charmId *charm.URL) string {
+			switch charmId.Name {
+			case "mongodb":
+				return "mongodb.png"
+			case "charmworld":
+				return "charmworld.icon"
+			}
+			return charmId.Name + ".svg"
+		},
+	}
+	icons, err := fetcher.FetchTypedIcons(b)
+	c.Assert(err, gc.IsNil)
+	c.Assert(icons, gc.DeepEquals, map[string]Icon{
+		"precise/mongodb-21": {
+			ContentType: "image/png",
+			Data:        []byte("png"),
+		},
+		"~charming-devs/precise/elasticsearch-2": {
+			ContentType: svgContentType,
+			Data:        []byte("<svg>elasticsearch</svg>"),
+		},
+		"~juju-jitsu/precise/charmworld-58": {
+			ContentType: svgContentType,
+			Data:        []byte("<svg>charmworld</svg>"),
+		},
+	})
+}
+
+func (s *LocalFetcherSuite) TestReadError(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	dir := c.MkDir()
+	// A directory cannot be read as an icon.
+	err = os.MkdirAll(filepath.Join(dir, "precise", "mongodb-21", "icon.svg"), 0755)
+	c.Assert(err, gc.IsNil)
+	fetcher := &LocalFetcher{
+		Dir: dir,
+	}
+	_, err = fetcher.FetchTypedIcons(b)
+	c.Assert(err, gc.ErrorMatches, "cannot read icon for precise/mongodb-21: .*")
+}
+
+func (s *LocalFetcherSuite) TestDefaultLocalIconPath(c *gc.C) {
+	c.Assert(DefaultLocalIconPath(charm.MustParseURL("cs:~user/trusty/wordpress-3")), gc.Equals, "~user/trusty/wordpress-3/icon.svg")
+}
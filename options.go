@@ -0,0 +1,844 @@
+package jujusvg
+
+import (
+	"hash/fnv"
+	"image"
+	"math"
+	"strconv"
+
+	"gopkg.in/juju/charm.v6-unstable"
+)
+
+// A CanvasOption configures optional behavior of the Canvas created by
+// NewFromBundle.
+type CanvasOption func(*Canvas)
+
+// WithIconTint returns an option that tints the icon of each service with
+// the color returned by tint for the service's name. Services for which
+// tint returns the empty string are left untouched.
+func WithIconTint(tint func(serviceName string) string) CanvasOption {
+	return func(c *Canvas) {
+		c.iconTint = tint
+	}
+}
+
+// DefaultInterfacePalette holds the colors used to draw relations by
+// WithInterfaceColors when no other mapping is specified.
+var DefaultInterfacePalette = []string{
+	"#38B44A",
+	"#19B6EE",
+	"#DD4814",
+	"#772953",
+	"#EFB73E",
+	"#6F6F6F",
+	"#0E8420",
+	"#AEA79F",
+}
+
+// PaletteColors returns a function which deterministically maps interface
+// names to colors chosen from the given palette by hashing the names, so
+// that relations with the same interface always share a color.
+func PaletteColors(palette []string) func(interfaceName string) string {
+	return func(interfaceName string) string {
+		if len(palette) == 0 {
+			return ""
+		}
+		return palette[paletteIndex(interfaceName, len(palette))]
+	}
+}
+
+// paletteIndex returns the index of the entry of a palette of n entries
+// chosen for the given interface name.
+func paletteIndex(interfaceName string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(interfaceName))
+	return int(h.Sum32() % uint32(n))
+}
+
+// ColorBlindPalette holds colors which remain distinguishable to people
+// with the common forms of color blindness, from the palette proposed by
+// Okabe and Ito. It may be used with WithInterfaceColors and
+// PaletteColors.
+var ColorBlindPalette = []string{
+	"#E69F00",
+	"#56B4E9",
+	"#009E73",
+	"#F0E442",
+	"#0072B2",
+	"#D55E00",
+	"#CC79A7",
+	"#000000",
+}
+
+// colorBlindInterfaceDashes holds the dash patterns with which relations
+// are drawn according to their interface by WithColorBlindSafe. As it
+// holds as many patterns as DefaultInterfacePalette and ColorBlindPalette
+// hold colors, relations drawn in the same color from either palette
+// share a pattern.
+var colorBlindInterfaceDashes = []string{
+	"",
+	"8, 4",
+	"2, 4",
+	"12, 4, 2, 4",
+	"12, 4, 2, 4, 2, 4",
+	"16, 6",
+	"4, 8",
+	"1, 2",
+}
+
+// WithInterfaceColors returns an option that draws each relation in the
+// color returned by color for the relation's interface. As bundles do not
+// record interfaces, relations are identified by the relation name given
+// in their endpoints; relations without one use the default color. If
+// color is nil, PaletteColors(DefaultInterfacePalette) is used.
+func WithInterfaceColors(color func(interfaceName string) string) CanvasOption {
+	if color == nil {
+		color = PaletteColors(DefaultInterfacePalette)
+	}
+	return func(c *Canvas) {
+		c.interfaceColor = color
+	}
+}
+
+// WithInterfaceDashes returns an option that draws each relation with the
+// dash pattern returned by dash for the relation's interface, identified
+// as for WithInterfaceColors. A pattern is a list of dash and gap lengths
+// separated by commas or spaces, as for the SVG stroke-dasharray
+// property; an empty pattern draws a solid line, as is the default.
+// Creating the canvas fails if a pattern is not well formed.
+func WithInterfaceDashes(dash func(interfaceName string) string) CanvasOption {
+	return func(c *Canvas) {
+		c.interfaceDash = dash
+	}
+}
+
+// WithCompactIcons returns an option that removes insignificant whitespace,
+// such as indentation between elements, from SVG icons before they are
+// embedded, reducing the size of the generated SVG.
+func WithCompactIcons() CanvasOption {
+	return func(c *Canvas) {
+		c.compactIcons = true
+	}
+}
+
+// WithIconErrors returns an option that calls report with the path of
+// each charm whose icon is neither a well-formed SVG document nor a PNG,
+// JPEG or GIF image, and the reason why. Such icons are replaced by a
+// placeholder in the diagram whether or not this option is given.
+func WithIconErrors(report func(charmPath string, err error)) CanvasOption {
+	return func(c *Canvas) {
+		c.iconError = report
+	}
+}
+
+// WithPlaceholderIcons returns an option that embeds the icon returned by
+// placeholder for the name of each charm whose icon is missing or cannot
+// be embedded, in place of a link to the icon or the default placeholder
+// respectively. Missing icons are still reported as such by
+// WithRequiredIcons. The icon returned must be an SVG document, and may
+// be fixed data to use the same placeholder for every charm; if it is
+// not well formed, the default placeholder is used. If placeholder is
+// nil, InitialsPlaceholder(PlaceholderTheme{}) is used.
+func WithPlaceholderIcons(placeholder func(charmName string) []byte) CanvasOption {
+	if placeholder == nil {
+		placeholder = InitialsPlaceholder(PlaceholderTheme{})
+	}
+	return func(c *Canvas) {
+		c.placeholderIcon = placeholder
+	}
+}
+
+// WithDuplicateRelations returns an option that calls report with the
+// endpoints of each relation which is listed more than once in a bundle,
+// in either order. Such duplicates are drawn once whether or not this
+// option is given.
+func WithDuplicateRelations(report func(endpoints []string)) CanvasOption {
+	return func(c *Canvas) {
+		c.duplicateRelation = report
+	}
+}
+
+// WithRequiredIcons returns an option that causes NewFromBundle to fail,
+// listing the affected services, if the icon fetcher does not return an
+// icon for every service, instead of leaving those services without one.
+func WithRequiredIcons() CanvasOption {
+	return func(c *Canvas) {
+		c.requireIcons = true
+	}
+}
+
+// WithIconURL returns an option that specifies the function used by Render
+// to generate the URL of the SVG icon for a charm.
+func WithIconURL(iconURL func(*charm.URL) string) CanvasOption {
+	return func(c *Canvas) {
+		c.iconURL = iconURL
+	}
+}
+
+// IconMode specifies how icons are included in the diagram.
+type IconMode int
+
+const (
+	// IconsLinked refers to icons by their URLs, keeping the
+	// SVG small but requiring the icons to be retrieved when it is
+	// viewed. A LinkFetcher is used to fetch them.
+	IconsLinked IconMode = iota
+
+	// IconsEmbedded fetches icons and includes them in the SVG,
+	// so that it is self-contained. An HTTPFetcher is used to fetch
+	// them.
+	IconsEmbedded
+)
+
+// WithIconMode returns an option that chooses how icons are included when
+// no IconFetcher is given to NewFromBundle or with WithIconFetcher. By
+// default, icons are linked.
+func WithIconMode(mode IconMode) CanvasOption {
+	return func(c *Canvas) {
+		c.iconMode = mode
+	}
+}
+
+// WithIconFetcher returns an option that specifies the fetcher used by
+// Render to retrieve icon contents. See NewFromBundle for the behavior
+// when no fetcher is specified.
+func WithIconFetcher(fetcher IconFetcher) CanvasOption {
+	return func(c *Canvas) {
+		c.iconFetcher = fetcher
+	}
+}
+
+// WithStorageBadges returns an option that marks each service which
+// declares storage with a badge showing the number of storage constraints,
+// drawn in the given color. If color is empty, a default color is used.
+func WithStorageBadges(color string) CanvasOption {
+	if color == "" {
+		color = storageBadgeColor
+	}
+	return func(c *Canvas) {
+		c.storageBadgeColor = color
+	}
+}
+
+// WithSeries returns an option that shows the default series of the
+// bundle in a banner across the top of the diagram, and marks services
+// whose charms use a different series with a badge, all drawn in the given
+// color. If color is empty, a default color is used.
+func WithSeries(color string) CanvasOption {
+	if color == "" {
+		color = seriesColor
+	}
+	return func(c *Canvas) {
+		c.seriesColor = color
+		c.seriesBadgeColor = color
+	}
+}
+
+// WithSeriesBadges returns an option that marks services whose charms use
+// a series other than the default series of the bundle with a badge
+// naming their series, drawn in the given color, without showing the
+// banner drawn by WithSeries. If color is empty, a default color is
+// used.
+func WithSeriesBadges(color string) CanvasOption {
+	if color == "" {
+		color = seriesColor
+	}
+	return func(c *Canvas) {
+		c.seriesBadgeColor = color
+	}
+}
+
+// WithNamespace returns an option that declares the namespace with the
+// given prefix on the root element of the generated SVG, overriding any
+// existing declaration for the prefix. An empty prefix refers to the
+// default namespace, and an empty uri removes the declaration, which is
+// useful when the SVG is embedded in a document which already declares it.
+// The prefix must be a valid XML name without a colon, other than xmlns;
+// namespaces with other prefixes are not declared.
+func WithNamespace(prefix, uri string) CanvasOption {
+	return func(c *Canvas) {
+		if c.namespaces == nil {
+			c.namespaces = make(map[string]string)
+		}
+		c.namespaces[prefix] = uri
+	}
+}
+
+// WithRenderingHints returns an option that sets the text-rendering and
+// shape-rendering properties of the generated SVG to the given values,
+// such as "optimizeLegibility" or "geometricPrecision" for text and
+// "crispEdges" or "geometricPrecision" for shapes. The hints are set on
+// the root element and so apply to all text and shapes drawn, although
+// viewers differ in how they honor them. An empty value leaves the
+// corresponding property unset, as is the default.
+func WithRenderingHints(textRendering, shapeRendering string) CanvasOption {
+	return func(c *Canvas) {
+		c.textRendering = textRendering
+		c.shapeRendering = shapeRendering
+	}
+}
+
+// An Origin specifies where the origin of the coordinate system of the
+// generated SVG lies within the diagram.
+type Origin int
+
+const (
+	// OriginTopLeft places the origin at the top left corner of the
+	// diagram. This is the default.
+	OriginTopLeft Origin = iota
+
+	// OriginBottomLeft places the origin at the bottom left corner of
+	// the diagram, so that the diagram lies above the x axis.
+	OriginBottomLeft
+
+	// OriginCenter places the origin at the center of the diagram.
+	OriginCenter
+)
+
+// offset returns the translation which moves a diagram of the given size
+// with its top left corner at the origin so that the origin lies in the
+// position specified by o.
+func (o Origin) offset(width, height int) image.Point {
+	switch o {
+	case OriginBottomLeft:
+		return image.Point{0, -height}
+	case OriginCenter:
+		return image.Point{-width / 2, -height / 2}
+	}
+	return image.ZP
+}
+
+// WithOrigin returns an option that specifies where the origin of the
+// coordinate system lies within the generated SVG. The diagram occupies
+// the same area of the image whatever the origin, but placing the origin
+// appropriately can simplify embedding the SVG in other documents.
+func WithOrigin(origin Origin) CanvasOption {
+	return func(c *Canvas) {
+		c.origin = origin
+	}
+}
+
+// WithClip returns an option that renders only the given region of the
+// diagram, for instance to generate tiles of a large diagram. The region
+// is given in diagram coordinates, in which the top left of the diagram
+// lies at the origin. Elements lying partly outside the region are
+// clipped. The series banner is not drawn when clipping.
+func WithClip(r image.Rectangle) CanvasOption {
+	return func(c *Canvas) {
+		c.clip = r.Canon()
+	}
+}
+
+// WithRelationsInFront returns an option that draws relations in front of
+// services, so that relation lines are always visible. By default,
+// relations are drawn behind services.
+func WithRelationsInFront() CanvasOption {
+	return func(c *Canvas) {
+		c.relationsInFront = true
+	}
+}
+
+// WithPerimeterRelations returns an option that attaches each relation to
+// the point on the perimeter of each service facing the other service,
+// so that relations to a service with many peers fan out around it. By
+// default, relations attach to the closest of the midpoints of the sides
+// of each service.
+func WithPerimeterRelations() CanvasOption {
+	return func(c *Canvas) {
+		c.perimeterRelations = true
+	}
+}
+
+// Shape represents a shape drawn behind the icon of a service to
+// distinguish services of different kinds.
+type Shape int
+
+const (
+	// ShapeNone draws no shape behind the icon.
+	ShapeNone Shape = iota
+
+	// ShapeRect draws a square behind the icon.
+	ShapeRect
+
+	// ShapeHexagon draws a hexagon behind the icon.
+	ShapeHexagon
+
+	// ShapeCylinder draws a cylinder behind the icon, as is
+	// conventional for databases.
+	ShapeCylinder
+)
+
+// WithServiceShapes returns an option that draws a shape behind the icon
+// of each service, as returned by shape for the service's charm. For
+// instance, databases, load balancers and applications could each be
+// given a shape of their own. By default, no shapes are drawn.
+func WithServiceShapes(shape func(*charm.URL) Shape) CanvasOption {
+	return func(c *Canvas) {
+		c.shape = shape
+	}
+}
+
+// CaptionPosition specifies where a caption is shown.
+type CaptionPosition int
+
+const (
+	// CaptionBottomRight shows the caption at the right below
+	// the diagram.
+	CaptionBottomRight CaptionPosition = iota
+
+	// CaptionBottomLeft shows the caption at the left below the
+	// diagram.
+	CaptionBottomLeft
+
+	// CaptionTopLeft shows the caption at the left above the
+	// diagram.
+	CaptionTopLeft
+
+	// CaptionTopRight shows the caption at the right above the
+	// diagram.
+	CaptionTopRight
+)
+
+// top reports whether the caption is shown above the diagram.
+func (p CaptionPosition) top() bool {
+	return p == CaptionTopLeft || p == CaptionTopRight
+}
+
+// right reports whether the caption is shown at the right.
+func (p CaptionPosition) right() bool {
+	return p == CaptionBottomRight || p == CaptionTopRight
+}
+
+// WithCaption returns an option that shows the given text, for instance a
+// timestamp, at the given position. The image is extended so that the
+// caption does not overlap the diagram, and the caption is sized
+// according to the width of the image. The caption is not shown when
+// clipping.
+func WithCaption(text string, position CaptionPosition) CanvasOption {
+	return func(c *Canvas) {
+		c.caption = text
+		c.captionPosition = position
+	}
+}
+
+// WithCoordinateRounding returns an option that uses round to convert the
+// coordinates given in the position annotations of services to pixels.
+// By default, the fractional part of each coordinate is discarded, so a
+// small change to a coordinate either side of zero or of a whole number
+// can move a service by a pixel; RoundNearest, RoundDown and SnapToGrid
+// provide alternatives.
+func WithCoordinateRounding(round func(float64) int) CanvasOption {
+	return func(c *Canvas) {
+		c.round = round
+	}
+}
+
+// RoundNearest rounds x to the nearest integer, rounding halves away from
+// zero.
+func RoundNearest(x float64) int {
+	return int(math.Floor(math.Abs(x)+0.5) * sign(x))
+}
+
+// RoundDown rounds x down to the next integer.
+func RoundDown(x float64) int {
+	return int(math.Floor(x))
+}
+
+// SnapToGrid returns a function which rounds coordinates to the nearest
+// multiple of the given grid size, aligning services neatly. If size is
+// not positive, coordinates are rounded to the nearest integer.
+func SnapToGrid(size int) func(float64) int {
+	if size <= 0 {
+		return RoundNearest
+	}
+	return func(x float64) int {
+		return RoundNearest(x/float64(size)) * size
+	}
+}
+
+// sign returns -1 if x is negative and 1 otherwise.
+func sign(x float64) float64 {
+	if x < 0 {
+		return -1
+	}
+	return 1
+}
+
+// WithTopologyOnly returns an option that shows only how services are
+// related, ignoring their icons and any positions given in the bundle.
+// The services are instead laid out evenly around a circle. This suits
+// bundles which were not created with the Juju GUI and so have no
+// positions.
+func WithTopologyOnly() CanvasOption {
+	return func(c *Canvas) {
+		c.topologyOnly = true
+	}
+}
+
+// WithServiceAttributes returns an option that adds the attributes
+// returned by attrs for each service, keyed by name, to a group holding
+// the elements drawn for the service. This allows scripts to find
+// information about services, for instance from data-* attributes such
+// as "data-charm" or "data-units". Attribute values are escaped, and
+// attributes whose names are not valid XML names are omitted.
+func WithServiceAttributes(attrs func(serviceName string, spec *charm.ServiceSpec) map[string]string) CanvasOption {
+	return func(c *Canvas) {
+		c.serviceAttrs = attrs
+	}
+}
+
+// LabelPosition specifies where the names of services are shown.
+type LabelPosition int
+
+const (
+	// LabelInside shows names at the top of the service blocks.
+	LabelInside LabelPosition = iota
+
+	// LabelAbove shows names above the service blocks.
+	LabelAbove
+
+	// LabelBelow shows names below the service blocks.
+	LabelBelow
+
+	// LabelNone does not show names.
+	LabelNone
+)
+
+// WithLabelPosition returns an option that specifies where the name of
+// each service is shown. Room is left for names shown outside the
+// service blocks. By default, names are shown inside the blocks, which
+// takes no extra room.
+func WithLabelPosition(position LabelPosition) CanvasOption {
+	return func(c *Canvas) {
+		c.labelPosition = position
+	}
+}
+
+// WithMiniMap returns an option that draws an overview of the whole
+// diagram, scaled down to fit a small box, in the bottom right corner of
+// the image. It is most useful together with WithClip, in which case the
+// rendered region is outlined on the overview.
+func WithMiniMap() CanvasOption {
+	return func(c *Canvas) {
+		c.miniMap = true
+	}
+}
+
+// WithDescription returns an option that shows the description and tags
+// of the bundle in a block above the diagram. The image is extended so
+// that the block does not overlap the diagram, and long descriptions are
+// wrapped to fit the width of the image. The block is not shown when
+// clipping.
+func WithDescription() CanvasOption {
+	return func(c *Canvas) {
+		c.showDescription = true
+	}
+}
+
+// WithAspectRatio returns an option that pads the image evenly on either
+// side, or above and below, so that the ratio of its width to its height
+// is width:height, for instance 16:9. The diagram is kept centered and
+// is not scaled. The option is ignored unless both width and height are
+// positive.
+func WithAspectRatio(width, height int) CanvasOption {
+	return func(c *Canvas) {
+		if width <= 0 || height <= 0 {
+			return
+		}
+		c.aspectRatio = image.Pt(width, height)
+	}
+}
+
+// WithUnitScaling returns an option that draws services larger or smaller
+// according to their number of units. The service with the fewest units
+// is drawn at min times its usual size and the service with the most at
+// max times its usual size, with the others scaled linearly between them.
+// Services are spread further apart as needed so that they do not
+// overlap. The option is ignored unless 0 < min <= max.
+func WithUnitScaling(min, max float64) CanvasOption {
+	return func(c *Canvas) {
+		if min <= 0 || max < min {
+			return
+		}
+		c.minUnitScale, c.maxUnitScale = min, max
+	}
+}
+
+// WithMaxLabelLength returns an option that shows at most n characters of
+// the name of each service in its label. Longer names are cut short, and
+// the full name is shown in a tooltip on the label. If n is not positive,
+// names are always shown in full. By default, names are cut short so that
+// their labels fit across their services.
+func WithMaxLabelLength(n int) CanvasOption {
+	return func(c *Canvas) {
+		if n <= 0 {
+			n = -1
+		}
+		c.maxLabelLength = n
+	}
+}
+
+// WithColorBlindSafe returns an option that makes the distinctions drawn
+// with color also visible without it. Differences shown by
+// NewFromBundleDiff are highlighted with colors from ColorBlindPalette and
+// with a dash pattern for each status, explained by the legend. When
+// relations are colored by WithInterfaceColors and WithInterfaceDashes is
+// not used, each interface is also given a dash pattern. For a complete
+// color-blind-safe theme, combine it with
+// WithInterfaceColors(PaletteColors(ColorBlindPalette)).
+func WithColorBlindSafe() CanvasOption {
+	return func(c *Canvas) {
+		c.colorBlindSafe = true
+	}
+}
+
+// WithoutDiffLegend returns an option that omits the legend explaining
+// the colors used to highlight differences, which is otherwise shown
+// below diagrams created by NewFromBundleDiff.
+func WithoutDiffLegend() CanvasOption {
+	return func(c *Canvas) {
+		c.diffLegend = false
+	}
+}
+
+// WithReadableIds returns an option that derives the ids of the icons
+// defined in the generated SVG from the paths of their charms, for
+// instance "icon-trusty-mysql-23", rather than numbering them. The ids
+// are the same however often the diagram is generated, which makes them
+// easier to refer to from scripts and style sheets.
+func WithReadableIds() CanvasOption {
+	return func(c *Canvas) {
+		c.readableIds = true
+	}
+}
+
+// WithCrossModelRelations returns an option that shows relations in a
+// bundle between its services and applications offered by other models.
+// Such relations have an endpoint of the form
+// "[user/]model.application[:relation]". Each offered application is drawn
+// as a dashed box in a column to the right of the diagram, joined to its
+// services by dashed relations. Without this option, bundles holding such
+// relations cannot be drawn, as they fail verification. It has no effect
+// on diagrams created by NewFromBundleDiff.
+func WithCrossModelRelations() CanvasOption {
+	return func(c *Canvas) {
+		c.crossModel = true
+	}
+}
+
+// WithPrecision returns an option that writes fractional lengths, such as
+// the dash lengths leaving room for the health indicator of relations,
+// with the given number of decimal places. With zero digits, lengths are
+// rounded to whole pixels. By default, two decimal places are used.
+func WithPrecision(digits int) CanvasOption {
+	if digits < 0 {
+		digits = 0
+	}
+	return func(c *Canvas) {
+		c.formatLength = func(x float64) string {
+			return strconv.FormatFloat(x, 'f', digits, 64)
+		}
+	}
+}
+
+// WithFocus returns an option that highlights the named service along
+// with its relations and the services directly related to it by drawing
+// everything else faded. This allows a series of diagrams to walk through
+// a bundle one service at a time. Creating the canvas fails if the bundle
+// has no service with the given name.
+func WithFocus(serviceName string) CanvasOption {
+	return func(c *Canvas) {
+		c.focus = serviceName
+	}
+}
+
+// WithRelationGradients returns an option that draws each relation as a
+// gradient from the color of one of its services to that of the other, so
+// that the services a relation joins can be told apart without labels. A
+// service's color is that of its status in diagrams created by
+// NewFromBundleDiff, or otherwise its tint as chosen by WithIconTint;
+// services with neither take the color of the relation. Relations added or
+// removed in a diff keep the color of their status.
+func WithRelationGradients() CanvasOption {
+	return func(c *Canvas) {
+		c.relationGradients = true
+	}
+}
+
+// WithSelfRelations returns an option that shows relations between a
+// service and itself, such as peer relations listed in a bundle, as a
+// loop around the top right corner of the service. Without this option,
+// bundles holding such relations cannot be drawn, as they fail
+// verification. It has no effect on diagrams created by NewFromBundleDiff.
+func WithSelfRelations() CanvasOption {
+	return func(c *Canvas) {
+		c.selfRelations = true
+	}
+}
+
+// IconShadow describes the drop shadow drawn beneath service icons by
+// WithIconShadows.
+type IconShadow struct {
+	// Color holds the color of the shadow. If it is empty, the
+	// shadow is black.
+	Color string
+
+	// Blur holds the standard deviation of the blur applied to the
+	// shadow, in pixels. If it is zero, the shadow is sharp.
+	Blur float64
+
+	// Offset holds the offset of the shadow from the icon.
+	Offset image.Point
+}
+
+// WithIconShadows returns an option that draws a translucent drop shadow
+// beneath the icon of each service, lifting the icons off the service
+// blocks. The image is extended if the shadow would otherwise be clipped.
+// By default, icons have no shadow.
+func WithIconShadows(shadow IconShadow) CanvasOption {
+	if shadow.Color == "" {
+		shadow.Color = "#000000"
+	}
+	if shadow.Blur < 0 {
+		shadow.Blur = 0
+	}
+	return func(c *Canvas) {
+		c.iconShadow = &shadow
+	}
+}
+
+// WithServiceModels returns an option that shows the name of the model to
+// which each service belongs, as returned by model for the service's name,
+// in smaller text beneath the service's name. As a bundle does not record
+// its model, this allows services drawn from several models to be told
+// apart. Services for which model returns the empty string, and services
+// whose names are not shown, have no model shown.
+func WithServiceModels(model func(serviceName string) string) CanvasOption {
+	return func(c *Canvas) {
+		c.serviceModel = model
+	}
+}
+
+// WithRelationPriority returns an option that draws relations in order of
+// the priority returned by priority for each relation's interface,
+// identified as for WithInterfaceColors, so that relations with higher
+// priorities are drawn over those with lower ones where they cross.
+// Relations with equal priorities are drawn in the order in which the
+// bundle lists them, as is the default.
+func WithRelationPriority(priority func(interfaceName string) int) CanvasOption {
+	return func(c *Canvas) {
+		c.relationPriority = priority
+	}
+}
+
+// WithConstraints returns an option that shows the constraints of each
+// service, such as "cpu-cores=2 mem=4G", as a tooltip shown when hovering
+// over the service, keeping the diagram itself uncluttered. Services
+// without constraints have no tooltip.
+func WithConstraints() CanvasOption {
+	return func(c *Canvas) {
+		c.showConstraints = true
+	}
+}
+
+// WithPadding returns an option that leaves empty space around the
+// diagram, for instance to make room for a legend or watermark added
+// later. As for the CSS padding property, a single value applies to all
+// sides, two values give the padding at the top and bottom and then at
+// the left and right, three give the top, the left and right, and then
+// the bottom, and four give the top, right, bottom and left in turn.
+// Negative values are treated as zero, and further values are ignored.
+// By default, there is no padding.
+func WithPadding(values ...int) CanvasOption {
+	v := make([]int, len(values))
+	for i, value := range values {
+		if value > 0 {
+			v[i] = value
+		}
+	}
+	var p padding
+	switch len(v) {
+	case 0:
+	case 1:
+		p = padding{v[0], v[0], v[0], v[0]}
+	case 2:
+		p = padding{v[0], v[1], v[0], v[1]}
+	case 3:
+		p = padding{v[0], v[1], v[2], v[1]}
+	default:
+		p = padding{v[0], v[1], v[2], v[3]}
+	}
+	return func(c *Canvas) {
+		c.padding = p
+	}
+}
+
+// WithServiceList returns an option that lists each service, along with
+// its charm and number of units, in a block below the diagram, giving a
+// textual summary of the bundle. The image is extended so that the list
+// does not overlap the diagram. The list is not shown when clipping.
+func WithServiceList() CanvasOption {
+	return func(c *Canvas) {
+		c.serviceList = true
+	}
+}
+
+// WithRelationNotes returns an option that shows notes, such as "TLS
+// required", in small callouts beside relations. The note function
+// returns the note for the relation between the given endpoints, as
+// listed in the bundle, or the empty string if the relation has none.
+// Each callout is placed clear of the relation's line and, where
+// possible, of every service, and the image is extended so that no
+// callout is cut off.
+func WithRelationNotes(note func(endpoints []string) string) CanvasOption {
+	return func(c *Canvas) {
+		c.relationNote = note
+	}
+}
+
+// WithCharmLegend returns an option that shows a panel beside the diagram
+// listing each charm used by the services shown, along with its icon and
+// path, to help readers recognize the icons. The image is extended so
+// that the panel does not overlap the diagram. The panel is not shown
+// when clipping.
+func WithCharmLegend() CanvasOption {
+	return func(c *Canvas) {
+		c.charmLegend = true
+	}
+}
+
+// WeightScale specifies how WithRelationWeights maps the weights of
+// relations to the widths of their lines.
+type WeightScale int
+
+const (
+	// LinearWeights makes the widths of relations proportional to
+	// their weights.
+	LinearWeights WeightScale = iota
+
+	// LogWeights makes the widths of relations proportional to the
+	// logarithm of one more than their weights, so that a few
+	// heavily weighted relations do not make all the others
+	// look alike. Negative weights are treated as zero.
+	LogWeights
+)
+
+// WithRelationWeights returns an option that draws relations with widths
+// according to their weights, for instance the traffic they carry. The
+// weight function returns the weight of the relation between the given
+// endpoints, as listed in the bundle, and whether the relation has one;
+// it may look up the weight by the endpoints or by the relation name
+// they give. The relation with the least weight is drawn min pixels wide
+// and that with the most max pixels wide, with the others in between
+// according to scale. Relations without a weight are drawn at the usual
+// width. The option is ignored unless 0 < min <= max.
+func WithRelationWeights(weight func(endpoints []string) (float64, bool), min, max float64, scale WeightScale) CanvasOption {
+	return func(c *Canvas) {
+		if weight == nil || min <= 0 || max < min {
+			return
+		}
+		c.relationWeight = weight
+		c.minRelationWidth, c.maxRelationWidth = min, max
+		c.weightScale = scale
+	}
+}
@@ -0,0 +1,89 @@
+package jujusvg
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the rate at which requests are made, using a token
+// bucket: requests may be made in bursts of up to a given size, after
+// which they are spaced out to keep to the given rate. A RateLimiter may
+// be shared by several fetchers, for instance to keep all the requests
+// made to a charm store within its limits, and may be used concurrently.
+type RateLimiter struct {
+	rate  float64
+	burst int
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing the given number of
+// requests per second, in bursts of up to burst requests. If burst is
+// not positive, requests are made one at a time. If rate is not
+// positive, NewRateLimiter returns nil, which imposes no limit.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if !(rate > 0) {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: float64(burst),
+		last:   timeNow(),
+	}
+}
+
+// Wait blocks until a request may be made, returning ctx.Err() if ctx is
+// done first. If l is nil, Wait returns immediately.
+func (l *RateLimiter) Wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	delay := l.reserve()
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.release()
+		return ctx.Err()
+	}
+}
+
+// reserve takes a token from the bucket, returning how long to wait
+// before the request it allows may be made.
+func (l *RateLimiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := timeNow()
+	if now.After(l.last) {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > float64(l.burst) {
+			l.tokens = float64(l.burst)
+		}
+		l.last = now
+	}
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// release returns a token taken by reserve for a request which was not
+// made.
+func (l *RateLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens++
+}
@@ -0,0 +1,77 @@
+package jujusvg
+
+import (
+	"context"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type RateLimiterSuite struct{}
+
+var _ = gc.Suite(&RateLimiterSuite{})
+
+func (s *RateLimiterSuite) TestReserve(c *gc.C) {
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	defer func(f func() time.Time) {
+		timeNow = f
+	}(timeNow)
+	timeNow = func() time.Time {
+		return now
+	}
+
+	l := NewRateLimiter(2, 3)
+	// The first burst is allowed at once.
+	for i := 0; i < 3; i++ {
+		c.Assert(l.reserve(), gc.Equals, time.Duration(0))
+	}
+	// Later requests are spaced out.
+	c.Assert(l.reserve(), gc.Equals, 500*time.Millisecond)
+	c.Assert(l.reserve(), gc.Equals, time.Second)
+
+	// Tokens accumulate up to the burst size.
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		c.Assert(l.reserve(), gc.Equals, time.Duration(0))
+	}
+	c.Assert(l.reserve(), gc.Equals, 500*time.Millisecond)
+
+	// A non-positive burst allows single requests.
+	l = NewRateLimiter(1, 0)
+	c.Assert(l.reserve(), gc.Equals, time.Duration(0))
+	c.Assert(l.reserve(), gc.Equals, time.Second)
+}
+
+func (s *RateLimiterSuite) TestWait(c *gc.C) {
+	l := NewRateLimiter(100, 1)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		err := l.Wait(context.Background())
+		c.Assert(err, gc.IsNil)
+	}
+	c.Assert(time.Since(start) >= 20*time.Millisecond, gc.Equals, true)
+
+	// Waiting stops when the context is done, and the request is
+	// not counted.
+	l = NewRateLimiter(0.1, 1)
+	err := l.Wait(context.Background())
+	c.Assert(err, gc.IsNil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = l.Wait(ctx)
+	c.Assert(err, gc.Equals, context.DeadlineExceeded)
+	c.Assert(l.tokens > -0.5, gc.Equals, true)
+}
+
+func (s *RateLimiterSuite) TestNonPositiveRate(c *gc.C) {
+	for _, rate := range []float64{0, -1} {
+		c.Logf("rate %v", rate)
+		l := NewRateLimiter(rate, 1)
+		c.Assert(l, gc.IsNil)
+		// A nil limiter imposes no limit.
+		for i := 0; i < 3; i++ {
+			err := l.Wait(context.Background())
+			c.Assert(err, gc.IsNil)
+		}
+	}
+}
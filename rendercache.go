@@ -0,0 +1,160 @@
+package jujusvg
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+)
+
+// RenderCache wraps a Renderer, keeping the SVG output of recently
+// rendered bundles so that rendering an identical bundle again returns
+// the same output without fetching icons or drawing the diagram. Output
+// is identified by a hash of the contents of the bundle and of Key. As
+// the options of the Renderer cannot themselves be hashed, Key must be
+// changed whenever they are, so that output rendered with the old
+// options is not reused. A RenderCache may be used concurrently as long
+// as its Renderer may.
+type RenderCache struct {
+	// Renderer holds the renderer used to render bundles which are
+	// not in the cache. It must be set.
+	Renderer *Renderer
+
+	// Key identifies the options of Renderer, for instance by
+	// naming or encoding them. Output is only reused for renders
+	// made with the same key.
+	Key string
+
+	// MaxEntries holds the maximum number of rendered bundles kept
+	// in the cache, beyond which the least recently used are
+	// discarded. If it is zero, the number is not limited.
+	MaxEntries int
+
+	// Expiry holds how long the output for a bundle is kept after
+	// it was rendered. If it is zero, output does not expire.
+	Expiry time.Duration
+
+	mu sync.Mutex
+	// entries holds the elements of lru, keyed by bundle hash.
+	entries map[string]*list.Element
+	// lru holds a *renderCacheEntry for each cached bundle,
+	// most recently used first.
+	lru *list.List
+}
+
+// renderCacheEntry holds the output of rendering a bundle.
+type renderCacheEntry struct {
+	key     string
+	data    []byte
+	expires time.Time
+}
+
+// Render writes an SVG representation of the given bundle to w, using
+// cached output if the bundle has been rendered before.
+func (c *RenderCache) Render(b *charm.BundleData, w io.Writer) error {
+	return c.RenderContext(context.Background(), b, w)
+}
+
+// RenderContext is like Render, but returns ctx.Err() if ctx is done
+// before rendering has finished. Nothing is written to w unless
+// rendering succeeds, and failed renders are not cached.
+func (c *RenderCache) RenderContext(ctx context.Context, b *charm.BundleData, w io.Writer) error {
+	if c.Renderer == nil {
+		return errgo.New("no renderer specified")
+	}
+	key, err := bundleHash(c.Key, b)
+	if err != nil {
+		return errgo.Notef(err, "cannot hash bundle")
+	}
+	if data, ok := c.get(key); ok {
+		_, err := w.Write(data)
+		return err
+	}
+	// Concurrent renders of the same bundle are not coalesced;
+	// the output of the last to finish is kept.
+	var buf bytes.Buffer
+	if err := c.Renderer.RenderContext(ctx, b, &buf); err != nil {
+		return err
+	}
+	c.add(key, buf.Bytes())
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// bundleHash returns a hash of the given options key and the contents of
+// the given bundle. As maps are encoded with their keys in sorted order,
+// identical bundles always have the same hash.
+func bundleHash(optionsKey string, b *charm.BundleData) (string, error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	h := sha256.New()
+	// Encode the key as JSON too, so that it cannot run into
+	// the bundle.
+	key, err := json.Marshal(optionsKey)
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	h.Write(key)
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// get returns the cached output for the bundle with the given hash,
+// discarding it if it has expired.
+func (c *RenderCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*renderCacheEntry)
+	if !entry.expires.IsZero() && !timeNow().Before(entry.expires) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.data, true
+}
+
+// add caches the output rendered for the bundle with the given hash,
+// discarding the least recently used output if the cache is full.
+func (c *RenderCache) add(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*list.Element)
+		c.lru = list.New()
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	entry := &renderCacheEntry{
+		key:  key,
+		data: data,
+	}
+	if c.Expiry > 0 {
+		entry.expires = timeNow().Add(c.Expiry)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.MaxEntries > 0 && c.lru.Len() > c.MaxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove discards the given cache element. It must be called with c.mu
+// held.
+func (c *RenderCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*renderCacheEntry).key)
+}
@@ -0,0 +1,181 @@
+package jujusvg
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v6-unstable"
+)
+
+type RenderCacheSuite struct{}
+
+var _ = gc.Suite(&RenderCacheSuite{})
+
+// countingFetcher is an IconFetcher which counts the bundles for which
+// icons are fetched, and so the bundles rendered.
+type countingFetcher int
+
+func (f *countingFetcher) FetchIcons(*charm.BundleData) (map[string][]byte, error) {
+	*f++
+	return nil, nil
+}
+
+// countingRenderer returns a Renderer and a pointer to the number of
+// bundles it has rendered.
+func countingRenderer() (*Renderer, *countingFetcher) {
+	renders := new(countingFetcher)
+	return &Renderer{
+		IconURL:     iconURL,
+		IconFetcher: renders,
+	}, renders
+}
+
+func (s *RenderCacheSuite) TestRender(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	r, renders := countingRenderer()
+	var expected bytes.Buffer
+	err = r.Render(b, &expected)
+	c.Assert(err, gc.IsNil)
+	*renders = 0
+
+	cache := &RenderCache{Renderer: r}
+	for i := 0; i < 3; i++ {
+		var buf bytes.Buffer
+		err = cache.Render(b, &buf)
+		c.Assert(err, gc.IsNil)
+		c.Assert(buf.String(), gc.Equals, expected.String())
+	}
+	c.Assert(*renders, gc.Equals, countingFetcher(1))
+
+	// An identical bundle read separately is a hit.
+	b, err = charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	err = cache.Render(b, new(bytes.Buffer))
+	c.Assert(err, gc.IsNil)
+	c.Assert(*renders, gc.Equals, countingFetcher(1))
+
+	// A changed bundle is rendered again.
+	b.Services["mongodb"].Annotations["gui-x"] = "1000"
+	var buf bytes.Buffer
+	err = cache.Render(b, &buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(*renders, gc.Equals, countingFetcher(2))
+	c.Assert(buf.String(), gc.Not(gc.Equals), expected.String())
+}
+
+func (s *RenderCacheSuite) TestKey(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	r, renders := countingRenderer()
+	cache := &RenderCache{
+		Renderer: r,
+		Key:      "plain",
+	}
+	var plain bytes.Buffer
+	err = cache.Render(b, &plain)
+	c.Assert(err, gc.IsNil)
+	c.Assert(*renders, gc.Equals, countingFetcher(1))
+
+	// Once the options and key change, the bundle is rendered
+	// again with the new options.
+	r.Options = []CanvasOption{WithSeries("#FF0000")}
+	cache.Key = "series"
+	var series bytes.Buffer
+	err = cache.Render(b, &series)
+	c.Assert(err, gc.IsNil)
+	c.Assert(*renders, gc.Equals, countingFetcher(2))
+	c.Assert(series.String(), gc.Not(gc.Equals), plain.String())
+
+	// Output for each key is kept.
+	r.Options = nil
+	cache.Key = "plain"
+	var buf bytes.Buffer
+	err = cache.Render(b, &buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(*renders, gc.Equals, countingFetcher(2))
+	c.Assert(buf.String(), gc.Equals, plain.String())
+}
+
+func (s *RenderCacheSuite) TestMaxEntries(c *gc.C) {
+	r, renders := countingRenderer()
+	cache := &RenderCache{
+		Renderer:   r,
+		MaxEntries: 2,
+	}
+	bundles := make([]*charm.BundleData, 3)
+	for i := range bundles {
+		b, err := charm.ReadBundleData(strings.NewReader(bundle))
+		c.Assert(err, gc.IsNil)
+		b.Description = strings.Repeat("x", i)
+		bundles[i] = b
+	}
+	render := func(i int) {
+		err := cache.Render(bundles[i], new(bytes.Buffer))
+		c.Assert(err, gc.IsNil)
+	}
+	render(0)
+	render(1)
+	render(0)
+	c.Assert(*renders, gc.Equals, countingFetcher(2))
+	// Bundle 1 is now the least recently used, so it is discarded.
+	render(2)
+	c.Assert(*renders, gc.Equals, countingFetcher(3))
+	c.Assert(cache.entries, gc.HasLen, 2)
+	render(0)
+	c.Assert(*renders, gc.Equals, countingFetcher(3))
+	render(1)
+	c.Assert(*renders, gc.Equals, countingFetcher(4))
+}
+
+func (s *RenderCacheSuite) TestExpiry(c *gc.C) {
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	defer func(f func() time.Time) {
+		timeNow = f
+	}(timeNow)
+	timeNow = func() time.Time {
+		return now
+	}
+
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+	r, renders := countingRenderer()
+	cache := &RenderCache{
+		Renderer: r,
+		Expiry:   time.Minute,
+	}
+	err = cache.Render(b, new(bytes.Buffer))
+	c.Assert(err, gc.IsNil)
+	now = now.Add(59 * time.Second)
+	err = cache.Render(b, new(bytes.Buffer))
+	c.Assert(err, gc.IsNil)
+	c.Assert(*renders, gc.Equals, countingFetcher(1))
+	now = now.Add(time.Second)
+	err = cache.Render(b, new(bytes.Buffer))
+	c.Assert(err, gc.IsNil)
+	c.Assert(*renders, gc.Equals, countingFetcher(2))
+}
+
+func (s *RenderCacheSuite) TestErrors(c *gc.C) {
+	b, err := charm.ReadBundleData(strings.NewReader(bundle))
+	c.Assert(err, gc.IsNil)
+
+	var buf bytes.Buffer
+	err = new(RenderCache).Render(b, &buf)
+	c.Assert(err, gc.ErrorMatches, "no renderer specified")
+
+	ef := errFetcher("bad-wolf")
+	cache := &RenderCache{
+		Renderer: &Renderer{
+			IconURL:     iconURL,
+			IconFetcher: &ef,
+		},
+	}
+	err = cache.Render(b, &buf)
+	c.Assert(err, gc.ErrorMatches, "bad-wolf")
+	c.Assert(buf.Len(), gc.Equals, 0)
+	// Failures are not cached.
+	c.Assert(cache.entries, gc.HasLen, 0)
+}
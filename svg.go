@@ -1,18 +1,92 @@
 package jujusvg
 
 import (
+	"bytes"
+	"fmt"
 	"io"
+	"strconv"
+	"strings"
+	"unicode"
 
 	"github.com/juju/xml"
 	"gopkg.in/errgo.v1"
 )
 
-const svgNamespace = "http://www.w3.org/2000/svg"
+const (
+	svgNamespace   = "http://www.w3.org/2000/svg"
+	xlinkNamespace = "http://www.w3.org/1999/xlink"
+)
+
+// placeholderIcon holds the icon embedded in place of icons which are not
+// well-formed SVG documents.
+const placeholderIcon = `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 96 96">` +
+	`<circle cx="48" cy="48" r="44" fill="#DDDDDD"/>` +
+	`<text x="48" y="62" font-size="40" text-anchor="middle" fill="#FFFFFF">?</text>` +
+	`</svg>`
+
+// PlaceholderTheme holds the colors of the placeholder icons generated by
+// InitialsPlaceholder.
+type PlaceholderTheme struct {
+	// Palette holds the colors from which the background of each
+	// placeholder is chosen by hashing the charm name, so that
+	// placeholders for the same charm always share a color. If it
+	// is empty, DefaultInterfacePalette is used.
+	Palette []string
+
+	// TextColor holds the color of the initials. If it is empty,
+	// white is used.
+	TextColor string
+}
+
+// InitialsPlaceholder returns a function, suitable for use with
+// WithPlaceholderIcons, which generates a placeholder icon for charms
+// with the given name: a rounded box, colored according to the theme,
+// labelled with the initials of the name. The initials are the first
+// letters of the first two words of the name, which are separated by
+// hyphens, so that the placeholder for "juju-gui" reads "JG".
+func InitialsPlaceholder(theme PlaceholderTheme) func(charmName string) []byte {
+	palette := theme.Palette
+	if len(palette) == 0 {
+		palette = DefaultInterfacePalette
+	}
+	textColor := theme.TextColor
+	if textColor == "" {
+		textColor = "#FFFFFF"
+	}
+	return func(charmName string) []byte {
+		return []byte(fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 96 96">`+
+			`<rect x="4" y="4" width="88" height="88" rx="12" ry="12" fill="%s"/>`+
+			`<text x="48" y="62" font-size="40" text-anchor="middle" fill="%s">%s</text>`+
+			`</svg>`,
+			escapeString(palette[paletteIndex(charmName, len(palette))]),
+			escapeString(textColor),
+			escapeString(charmInitials(charmName)),
+		))
+	}
+}
+
+// charmInitials returns the initials of the given charm name, as
+// described by InitialsPlaceholder.
+func charmInitials(charmName string) string {
+	var initials []rune
+	for _, word := range strings.FieldsFunc(charmName, func(r rune) bool {
+		return r == '-'
+	}) {
+		initials = append(initials, unicode.ToUpper([]rune(word)[0]))
+		if len(initials) == 2 {
+			break
+		}
+	}
+	return string(initials)
+}
 
 // Process an icon SVG file from a reader, removing anything surrounding
 // the <svg></svg> tags, which would be invalid in this context (such as
-// <?xml...?> decls, directives, etc), writing out to a writer.  In
-// addition, loosely check that the icon is a valid SVG file.  The id
+// <?xml...?> decls, directives, etc), writing out to a writer.  Icons are
+// untrusted, so anything which could run code in the page showing the
+// diagram is removed too, as described by unsafeElements, animatesLink
+// and safeAttrs, along with any processing instructions.
+// In addition, loosely check that the icon is a valid SVG file.  The id
 // argument provides a unique identifier for the icon SVG so that it can
 // be referenced within the bundle diagram.  If an id attribute on the SVG
 // tag already exists, it will be replaced with this argument.
@@ -37,9 +111,10 @@ func processIcon(r io.Reader, w io.Writer, id string) error {
 		if ok && tag.Name.Space == svgNamespace && tag.Name.Local == "svg" {
 			svgStartFound = true
 			depth++
-			tag.Attr = setXMLAttr(tag.Attr, xml.Name{
+			tag.Attr = setXMLAttr(safeAttrs(tag.Attr), xml.Name{
 				Local: "id",
 			}, id)
+			tag.Attr = normalizeIconSize(tag.Attr)
 			if err := enc.EncodeToken(tag); err != nil {
 				return errgo.Notef(err, "cannot encode token %#v", tag)
 			}
@@ -55,9 +130,24 @@ func processIcon(r io.Reader, w io.Writer, id string) error {
 		}
 		switch tag := tok.(type) {
 		case xml.StartElement:
+			if unsafeElements[strings.ToLower(tag.Name.Local)] || animatesLink(tag) {
+				if err := dec.Skip(); err != nil {
+					return errgo.Notef(err, "cannot skip element")
+				}
+				continue
+			}
 			if tag.Name.Space == svgNamespace && tag.Name.Local == "svg" {
 				depth++
 			}
+			tag.Attr = safeAttrs(tag.Attr)
+			tok = tag
+		case xml.Directive:
+			// Directives may declare entities or an external DTD.
+			continue
+		case xml.ProcInst:
+			// Processing instructions such as xml-stylesheet
+			// may load external content.
+			continue
 		case xml.EndElement:
 			if tag.Name.Space == svgNamespace && tag.Name.Local == "svg" {
 				depth--
@@ -82,6 +172,200 @@ func processIcon(r io.Reader, w io.Writer, id string) error {
 	return nil
 }
 
+// unsafeElements holds the local names, in lower case, of the elements
+// removed from icons, along with their contents, as they may run scripts
+// or embed arbitrary HTML. Names are compared regardless of case, as
+// HTML parsers lower the case of elements in SVG content inlined in a
+// page.
+var unsafeElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+}
+
+// animatedElements holds the local names, in lower case, of the elements
+// which animate the attributes of other elements.
+var animatedElements = map[string]bool{
+	"animate": true,
+	"set":     true,
+}
+
+// animatesLink reports whether the given element is an animation setting
+// the link of another element, which could point it anywhere whatever
+// its original value. Such animations are removed from icons.
+func animatesLink(tag xml.StartElement) bool {
+	if !animatedElements[strings.ToLower(tag.Name.Local)] {
+		return false
+	}
+	for _, attr := range tag.Attr {
+		if !strings.EqualFold(attr.Name.Local, "attributeName") {
+			continue
+		}
+		name := normalizeAttrValue(attr.Value)
+		if name == "href" || strings.HasSuffix(name, ":href") {
+			return true
+		}
+	}
+	return false
+}
+
+// safeLinkPrefixes holds the prefixes of the links allowed in icons: links
+// to fragments of the diagram, web pages and images.
+var safeLinkPrefixes = []string{
+	"#",
+	"http:",
+	"https:",
+	"data:image/",
+}
+
+// safeAttrs returns the given attributes without any event handler
+// attributes, such as onload, attributes any of whose semicolon-separated
+// values, as used by animations, is a javascript: URL, or links other
+// than those allowed by safeLinkPrefixes.
+func safeAttrs(attrs []xml.Attr) []xml.Attr {
+	safe := attrs[:0]
+	for _, attr := range attrs {
+		if strings.HasPrefix(strings.ToLower(attr.Name.Local), "on") {
+			continue
+		}
+		value := normalizeAttrValue(attr.Value)
+		if strings.EqualFold(attr.Name.Local, "href") && !hasAnyPrefix(value, safeLinkPrefixes) {
+			continue
+		}
+		if hasJavaScriptValue(value) {
+			continue
+		}
+		safe = append(safe, attr)
+	}
+	return safe
+}
+
+// normalizeAttrValue returns the given attribute value in lower case
+// without any white space or control characters, which browsers ignore
+// in URLs.
+func normalizeAttrValue(value string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, value)
+}
+
+// hasJavaScriptValue reports whether any of the semicolon-separated items
+// of the given normalized attribute value is a javascript: URL.
+func hasJavaScriptValue(value string) bool {
+	for _, item := range strings.Split(value, ";") {
+		if strings.HasPrefix(item, "javascript:") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAnyPrefix reports whether s starts with any of the given prefixes.
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeIconSize returns the given attributes of an icon's root svg
+// element amended so that the icon is scaled to fit the area in which it
+// is used without distortion, centered within that area, whatever its
+// own dimensions. This requires the intrinsic dimensions of the icon,
+// taken from its viewBox or, failing that, its width and height. If they
+// cannot be determined, the icon is assumed to be drawn on the standard
+// 96x96 canvas for charm icons. The width and height themselves are
+// removed, so that only the element using the icon sets its size.
+func normalizeIconSize(attrs []xml.Attr) []xml.Attr {
+	if _, ok := iconViewBox(attrs); !ok {
+		viewBox := fmt.Sprintf("0 0 %d %d", iconSize, iconSize)
+		width, wok := iconLength(attrs, "width")
+		height, hok := iconLength(attrs, "height")
+		if wok && hok {
+			viewBox = fmt.Sprintf("0 0 %g %g", width, height)
+		}
+		attrs = setXMLAttr(attrs, xml.Name{
+			Local: "viewBox",
+		}, viewBox)
+	}
+	attrs = removeXMLAttr(attrs, "width")
+	attrs = removeXMLAttr(attrs, "height")
+	return setXMLAttr(attrs, xml.Name{
+		Local: "preserveAspectRatio",
+	}, "xMidYMid meet")
+}
+
+// iconViewBox returns the view box given in the attributes of an svg
+// element, and whether it has a valid one.
+func iconViewBox(attrs []xml.Attr) ([4]float64, bool) {
+	var viewBox [4]float64
+	val, ok := xmlAttr(attrs, "viewBox")
+	if !ok {
+		return viewBox, false
+	}
+	fields := strings.FieldsFunc(val, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	if len(fields) != len(viewBox) {
+		return viewBox, false
+	}
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return viewBox, false
+		}
+		viewBox[i] = v
+	}
+	return viewBox, viewBox[2] > 0 && viewBox[3] > 0
+}
+
+// iconLength returns the value of the given length attribute of an svg
+// element in user units, and whether it has a valid value. Lengths in
+// units other than pixels are not supported.
+func iconLength(attrs []xml.Attr, name string) (float64, bool) {
+	val, ok := xmlAttr(attrs, name)
+	if !ok {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(val), "px"), 64)
+	if err != nil || v <= 0 {
+		return 0, false
+	}
+	return v, true
+}
+
+// xmlAttr returns the value of the unqualified attribute with the given
+// name, and whether it is present.
+func xmlAttr(attrs []xml.Attr, name string) (string, bool) {
+	for _, attr := range attrs {
+		if attr.Name.Space == "" && attr.Name.Local == name {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
+// isXMLName reports whether the given string can be used as the name of
+// an unqualified XML attribute.
+func isXMLName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r == '_' || unicode.IsLetter(r):
+		case i > 0 && (r == '-' || r == '.' || unicode.IsDigit(r)):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 // setXMLAttr returns the given attributes with the given attribute name set to
 // val, adding an attribute if necessary.
 func setXMLAttr(attrs []xml.Attr, name xml.Name, val string) []xml.Attr {
@@ -96,3 +380,75 @@ func setXMLAttr(attrs []xml.Attr, name xml.Name, val string) []xml.Attr {
 		Value: val,
 	})
 }
+
+// removeXMLAttr returns the given attributes without the unqualified
+// attribute with the given name.
+func removeXMLAttr(attrs []xml.Attr, name string) []xml.Attr {
+	for i, attr := range attrs {
+		if attr.Name.Space == "" && attr.Name.Local == name {
+			return append(attrs[:i], attrs[i+1:]...)
+		}
+	}
+	return attrs
+}
+
+// textElements holds the names of the elements within which whitespace
+// may be significant.
+var textElements = map[string]bool{
+	"desc":          true,
+	"foreignObject": true,
+	"script":        true,
+	"style":         true,
+	"text":          true,
+	"textPath":      true,
+	"title":         true,
+	"tspan":         true,
+}
+
+// compactIcon returns the given icon SVG with whitespace-only text between
+// elements removed, which does not change how the icon renders. Whitespace
+// inside text content elements or where xml:space="preserve" applies is
+// kept intact.
+func compactIcon(icon []byte) ([]byte, error) {
+	dec := xml.NewDecoder(bytes.NewReader(icon))
+	var buf bytes.Buffer
+	enc := xml.NewEncoder(&buf)
+	// preserve holds, for each open element, whether whitespace
+	// within it must be kept.
+	var preserve []bool
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, errgo.Notef(err, "cannot get token")
+		}
+		switch tag := tok.(type) {
+		case xml.StartElement:
+			keep := textElements[tag.Name.Local]
+			if len(preserve) > 0 && preserve[len(preserve)-1] {
+				keep = true
+			}
+			for _, attr := range tag.Attr {
+				if attr.Name.Local == "space" && attr.Name.Space == "http://www.w3.org/XML/1998/namespace" {
+					keep = attr.Value == "preserve"
+				}
+			}
+			preserve = append(preserve, keep)
+		case xml.EndElement:
+			preserve = preserve[:len(preserve)-1]
+		case xml.CharData:
+			if (len(preserve) == 0 || !preserve[len(preserve)-1]) && len(bytes.TrimSpace(tag)) == 0 {
+				continue
+			}
+		}
+		if err := enc.EncodeToken(tok); err != nil {
+			return nil, errgo.Notef(err, "cannot encode token %#v", tok)
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
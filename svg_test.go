@@ -3,6 +3,7 @@ package jujusvg
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 
 	"github.com/juju/xml"
 	gc "gopkg.in/check.v1"
@@ -27,7 +28,7 @@ func (s *SVGSuite) TestProcessIcon(c *gc.C) {
 				</svg>
 				`,
 			expected: `
-				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" id="test-0">
+				<svg xmlns="http://www.w3.org/2000/svg" id="test-0" viewBox="0 0 100 100" preserveAspectRatio="xMidYMid meet">
 					<g id="foo"></g>
 				</svg>`,
 		},
@@ -42,7 +43,7 @@ func (s *SVGSuite) TestProcessIcon(c *gc.C) {
 				</svg>
 				`,
 			expected: `
-				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" id="test-1">
+				<svg xmlns="http://www.w3.org/2000/svg" id="test-1" viewBox="0 0 100 100" preserveAspectRatio="xMidYMid meet">
 					<svg>
 						<g id="foo"></g>
 					</svg>
@@ -58,7 +59,7 @@ func (s *SVGSuite) TestProcessIcon(c *gc.C) {
 				</svg>
 				`,
 			expected: `
-				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" id="test-2">
+				<svg xmlns="http://www.w3.org/2000/svg" id="test-2" viewBox="0 0 100 100" preserveAspectRatio="xMidYMid meet">
 					<g id="foo"></g>
 				</svg>`,
 		},
@@ -71,7 +72,7 @@ func (s *SVGSuite) TestProcessIcon(c *gc.C) {
 				</svg>
 				`,
 			expected: `
-				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" id="test-3">
+				<svg xmlns="http://www.w3.org/2000/svg" id="test-3" viewBox="0 0 100 100" preserveAspectRatio="xMidYMid meet">
 					<g id="foo"></g>
 				</svg>`,
 		},
@@ -84,7 +85,7 @@ func (s *SVGSuite) TestProcessIcon(c *gc.C) {
 				<?procinst foo="bar"?>
 				`,
 			expected: `
-				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" id="test-4">
+				<svg xmlns="http://www.w3.org/2000/svg" id="test-4" viewBox="0 0 100 100" preserveAspectRatio="xMidYMid meet">
 					<g id="foo"></g>
 				</svg>`,
 		},
@@ -97,12 +98,12 @@ func (s *SVGSuite) TestProcessIcon(c *gc.C) {
 				<!DOCTYPE svg>
 				`,
 			expected: `
-				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" id="test-5">
+				<svg xmlns="http://www.w3.org/2000/svg" id="test-5" viewBox="0 0 100 100" preserveAspectRatio="xMidYMid meet">
 					<g id="foo"></g>
 				</svg>`,
 		},
 		{
-			about: "ProcInsts/Directives inside svg left in place",
+			about: "ProcInsts and Directives inside svg stripped",
 			icon: `
 				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100">
 					<!DOCTYPE svg>
@@ -111,12 +112,131 @@ func (s *SVGSuite) TestProcessIcon(c *gc.C) {
 				</svg>
 				`,
 			expected: `
-				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100" id="test-6">
-					<!DOCTYPE svg>
-					<?proc foo="bar"?>
+				<svg xmlns="http://www.w3.org/2000/svg" id="test-6" viewBox="0 0 100 100" preserveAspectRatio="xMidYMid meet">
 					<g id="foo"></g>
 				</svg>`,
 		},
+		{
+			about: "Scripts and foreign objects stripped",
+			icon: `
+				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100">
+					<script>alert("bad-wolf")</script>
+					<g id="foo">
+						<foreignObject><svg><script>alert("bad-wolf")</script></svg></foreignObject>
+					</g>
+					<script xmlns="http://www.w3.org/1999/xhtml"><![CDATA[alert("bad-wolf")]]></script>
+				</svg>
+				`,
+			expected: `
+				<svg xmlns="http://www.w3.org/2000/svg" id="test-7" viewBox="0 0 100 100" preserveAspectRatio="xMidYMid meet">
+					<g id="foo">
+					</g>
+				</svg>`,
+		},
+		{
+			about: "Event handlers and javascript URLs stripped",
+			icon: `
+				<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="100" height="100" onload="alert(1)">
+					<a xlink:href=" Java&#x0A;Script:alert(1)" href="https://jujucharms.com/">
+						<circle r="5" ONCLICK="alert(2)" fill="red"/>
+					</a>
+					<set attributeName="href" to="javascript:alert(3)"/>
+				</svg>
+				`,
+			expected: `
+				<svg xmlns:xlink="http://www.w3.org/1999/xlink" xmlns="http://www.w3.org/2000/svg" id="test-8" viewBox="0 0 100 100" preserveAspectRatio="xMidYMid meet">
+					<a href="https://jujucharms.com/">
+						<circle r="5" fill="red"/>
+					</a>
+				</svg>`,
+		},
+		{
+			about: "javascript URLs among several values stripped",
+			icon: `
+				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100">
+					<animate attributeName="fill" values="red;JavaScript:alert(1)" dur="1s"/>
+					<animate attributeName="fill" values="red;blue" dur="1s"/>
+				</svg>
+				`,
+			expected: `
+				<svg xmlns="http://www.w3.org/2000/svg" id="test-9" viewBox="0 0 100 100" preserveAspectRatio="xMidYMid meet">
+					<animate attributeName="fill" dur="1s"/>
+					<animate attributeName="fill" values="red;blue" dur="1s"/>
+				</svg>`,
+		},
+		{
+			about: "Links other than fragments, web pages and images stripped",
+			icon: `
+				<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="100" height="100">
+					<a href="data:text/html,&lt;script&gt;alert(1)&lt;/script&gt;"><circle r="1"/></a>
+					<a xlink:href="vbscript:msgbox(1)"><circle r="2"/></a>
+					<a href="HTTPS://jujucharms.com/"><circle r="3"/></a>
+					<use xlink:href="#shape"/>
+					<image href="data:image/png;base64,iVBORw0KGgo="/>
+				</svg>
+				`,
+			expected: `
+				<svg xmlns:xlink="http://www.w3.org/1999/xlink" xmlns="http://www.w3.org/2000/svg" id="test-10" viewBox="0 0 100 100" preserveAspectRatio="xMidYMid meet">
+					<a><circle r="1"/></a>
+					<a><circle r="2"/></a>
+					<a href="HTTPS://jujucharms.com/"><circle r="3"/></a>
+					<use xlink:href="#shape"/>
+					<image href="data:image/png;base64,iVBORw0KGgo="/>
+				</svg>`,
+		},
+		{
+			about: "Animations of links stripped",
+			icon: `
+				<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="100" height="100">
+					<a href="#a">
+						<animate attributeName="href" values="#a;javascript:alert(1)" dur="1s"/>
+						<set attributeName="xlink:href" to="data:text/html,bad-wolf"/>
+						<set attributeName="fill" to="red"/>
+					</a>
+				</svg>
+				`,
+			expected: `
+				<svg xmlns:xlink="http://www.w3.org/1999/xlink" xmlns="http://www.w3.org/2000/svg" id="test-11" viewBox="0 0 100 100" preserveAspectRatio="xMidYMid meet">
+					<a href="#a">
+						<set attributeName="fill" to="red"/>
+					</a>
+				</svg>`,
+		},
+		{
+			about: "Unsafe elements stripped whatever their case",
+			icon: `
+				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100">
+					<SCRIPT>alert(1)</SCRIPT>
+					<Script>alert(2)</Script>
+					<foreignobject><iframe/></foreignobject>
+					<FOREIGNOBJECT><iframe/></FOREIGNOBJECT>
+					<a href="#a">
+						<Set attributeName="href" to="javascript:alert(3)"/>
+						<SET ATTRIBUTENAME="HREF" to="javascript:alert(4)"/>
+						<Animate attributeName="xlink:HREF" values="#a;javascript:alert(5)" dur="1s"/>
+					</a>
+					<a HREF="data:text/html,bad-wolf"/>
+				</svg>
+				`,
+			expected: `
+				<svg xmlns="http://www.w3.org/2000/svg" id="test-12" viewBox="0 0 100 100" preserveAspectRatio="xMidYMid meet">
+					<a href="#a">
+					</a>
+					<a/>
+				</svg>`,
+		},
+		{
+			about: "ProcInsts inside svg stripped",
+			icon: `
+				<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100">
+					<g><?xml-stylesheet href="http://example.com/bad-wolf.css"?></g>
+				</svg>
+				`,
+			expected: `
+				<svg xmlns="http://www.w3.org/2000/svg" id="test-13" viewBox="0 0 100 100" preserveAspectRatio="xMidYMid meet">
+					<g></g>
+				</svg>`,
+		},
 		{
 			about: "Not an SVG",
 			icon: `
@@ -215,3 +335,125 @@ func (s *SVGSuite) TestSetXMLAttr(c *gc.C) {
 	}, "foo")
 	c.Assert(result, gc.DeepEquals, expected)
 }
+
+func (s *SVGSuite) TestCompactIcon(c *gc.C) {
+	tests := []struct {
+		about    string
+		icon     string
+		expected string
+		err      string
+	}{{
+		about: "Whitespace between elements removed",
+		icon: `
+			<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100">
+				<g id="foo">
+					<circle cx="10" cy="10" r="5" />
+				</g>
+			</svg>
+			`,
+		expected: `<svg xmlns="http://www.w3.org/2000/svg" width="100" height="100"><g id="foo"><circle cx="10" cy="10" r="5"></circle></g></svg>`,
+	}, {
+		about: "Whitespace in text kept",
+		icon: `
+			<svg xmlns="http://www.w3.org/2000/svg">
+				<text> a <tspan> </tspan></text>
+			</svg>`,
+		expected: `<svg xmlns="http://www.w3.org/2000/svg"><text> a <tspan> </tspan></text></svg>`,
+	}, {
+		about: "Whitespace kept where preserved",
+		icon: `
+			<svg xmlns="http://www.w3.org/2000/svg">
+				<g xml:space="preserve"> <g> </g> </g>
+			</svg>`,
+		expected: `<svg xmlns="http://www.w3.org/2000/svg"><g xml:space="preserve"> <g> </g> </g></svg>`,
+	}, {
+		about: "Malformed icon",
+		icon:  `<svg><g></svg>`,
+		err:   "cannot get token: .*",
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		out, err := compactIcon([]byte(test.icon))
+		if test.err != "" {
+			c.Assert(err, gc.ErrorMatches, test.err)
+			continue
+		}
+		c.Assert(err, gc.IsNil)
+		c.Assert(string(out), gc.Equals, test.expected)
+	}
+}
+
+func (s *SVGSuite) TestPreserveAspectRatio(c *gc.C) {
+	tests := []struct {
+		about    string
+		icon     string
+		expected string
+	}{{
+		about:    "viewBox kept",
+		icon:     `<svg xmlns="http://www.w3.org/2000/svg" width="200" height="100" viewBox="0,0 20 10"></svg>`,
+		expected: `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0,0 20 10" id="icon" preserveAspectRatio="xMidYMid meet"></svg>`,
+	}, {
+		about:    "viewBox from dimensions",
+		icon:     `<svg xmlns="http://www.w3.org/2000/svg" width="200px" height="100.5"></svg>`,
+		expected: `<svg xmlns="http://www.w3.org/2000/svg" id="icon" viewBox="0 0 200 100.5" preserveAspectRatio="xMidYMid meet"></svg>`,
+	}, {
+		about:    "no dimensions",
+		icon:     `<svg xmlns="http://www.w3.org/2000/svg"></svg>`,
+		expected: `<svg xmlns="http://www.w3.org/2000/svg" id="icon" viewBox="0 0 96 96" preserveAspectRatio="xMidYMid meet"></svg>`,
+	}, {
+		about:    "relative dimensions",
+		icon:     `<svg xmlns="http://www.w3.org/2000/svg" width="100%" height="100%"></svg>`,
+		expected: `<svg xmlns="http://www.w3.org/2000/svg" id="icon" viewBox="0 0 96 96" preserveAspectRatio="xMidYMid meet"></svg>`,
+	}, {
+		about:    "one dimension",
+		icon:     `<svg xmlns="http://www.w3.org/2000/svg" width="48"></svg>`,
+		expected: `<svg xmlns="http://www.w3.org/2000/svg" id="icon" viewBox="0 0 96 96" preserveAspectRatio="xMidYMid meet"></svg>`,
+	}, {
+		about:    "invalid viewBox",
+		icon:     `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 0 10"></svg>`,
+		expected: `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 96 96" id="icon" preserveAspectRatio="xMidYMid meet"></svg>`,
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		var out bytes.Buffer
+		err := processIcon(bytes.NewBufferString(test.icon), &out, "icon")
+		c.Assert(err, gc.IsNil)
+		assertXMLEqual(c, out.Bytes(), []byte(test.expected))
+	}
+}
+
+func (s *SVGSuite) TestCharmInitials(c *gc.C) {
+	tests := map[string]string{
+		"mongodb":              "M",
+		"juju-gui":             "JG",
+		"apache2-reverseproxy": "AR",
+		"a-b-c":                "AB",
+		"-odd--name-":          "ON",
+	}
+	for name, expect := range tests {
+		c.Check(charmInitials(name), gc.Equals, expect, gc.Commentf("name %q", name))
+	}
+}
+
+func (s *SVGSuite) TestInitialsPlaceholder(c *gc.C) {
+	placeholder := InitialsPlaceholder(PlaceholderTheme{})
+	c.Assert(string(placeholder("juju-gui")), gc.Equals,
+		`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 96 96">`+
+			`<rect x="4" y="4" width="88" height="88" rx="12" ry="12" fill="`+PaletteColors(DefaultInterfacePalette)("juju-gui")+`"/>`+
+			`<text x="48" y="62" font-size="40" text-anchor="middle" fill="#FFFFFF">JG</text>`+
+			`</svg>`)
+	// Placeholders are deterministic.
+	c.Assert(placeholder("juju-gui"), gc.DeepEquals, placeholder("juju-gui"))
+	err := processIcon(bytes.NewReader(placeholder("juju-gui")), ioutil.Discard, "")
+	c.Assert(err, gc.IsNil)
+
+	placeholder = InitialsPlaceholder(PlaceholderTheme{
+		Palette:   []string{"#000000"},
+		TextColor: "#FF0000",
+	})
+	c.Assert(string(placeholder("mysql")), gc.Equals,
+		`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 96 96">`+
+			`<rect x="4" y="4" width="88" height="88" rx="12" ry="12" fill="#000000"/>`+
+			`<text x="48" y="62" font-size="40" text-anchor="middle" fill="#FF0000">M</text>`+
+			`</svg>`)
+}